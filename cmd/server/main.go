@@ -27,7 +27,7 @@ func main() {
 
 	// 初始化 HTTP 客户端服务
 	log.Info("正在初始化客户端服务...")
-	client.GetService()
+	h := handler.New(client.GetService())
 
 	// 创建 Gin 引擎
 	r := gin.Default()
@@ -35,25 +35,29 @@ func main() {
 	// ==================== 路由配置 ====================
 
 	// OpenAI 兼容接口
-	r.GET("/v1/models", handler.ListModels)
-	r.POST("/v1/chat/completions", handler.ChatCompletions)
+	r.GET("/v1/models", h.ListModels)
+	r.POST("/v1/chat/completions", h.ChatCompletions)
 
 	// Anthropic Messages API 兼容接口
-	r.POST("/v1/messages", handler.Messages)
-	r.POST("/messages", handler.Messages)
-	r.POST("/v1/messages/count_tokens", handler.CountTokens)
-	r.POST("/messages/count_tokens", handler.CountTokens)
+	r.POST("/v1/messages", h.Messages)
+	r.POST("/messages", h.Messages)
+	r.POST("/v1/messages/count_tokens", h.CountTokens)
+	r.POST("/messages/count_tokens", h.CountTokens)
 
 	// 健康检查
 	r.GET("/health", func(c *gin.Context) {
 		c.JSON(200, gin.H{"status": "ok"})
 	})
 
-	// 客户端状态
+	// 客户端状态（后端健康状态由后台定期检查，这里不生成 token 也不发起检查）
 	r.GET("/status", func(c *gin.Context) {
-		svc := client.GetService()
-		hasToken := svc.GetXIsHuman() != ""
-		c.JSON(200, gin.H{"hasToken": hasToken})
+		pool := token.GetPool()
+		c.JSON(200, gin.H{
+			"hasToken":       pool.Healthy(),
+			"tokenProviders": pool.Health(),
+			"scriptVersions": pool.ScriptVersions(),
+			"models":         h.ModelStatus(),
+		})
 	})
 
 	// 静态文件
@@ -3,11 +3,16 @@
 package client
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"io"
 	"sync"
+	"time"
 
 	"cursor2api/internal/config"
 	"cursor2api/internal/logger"
+	"cursor2api/internal/sse"
 	"cursor2api/internal/token"
 
 	"github.com/enetx/g"
@@ -19,6 +24,13 @@ var log = logger.Get().WithPrefix("Client")
 // Cursor API 端点
 const cursorChatAPI = "https://cursor.com/api/chat"
 
+// 上游超时错误
+var (
+	ErrFirstByteTimeout = errors.New("等待上游首字节超时")
+	ErrIdleTimeout      = errors.New("上游响应空闲超时")
+	ErrTotalTimeout     = errors.New("上游请求总超时")
+)
+
 // Chrome 浏览器请求头模拟
 var chromeChatHeaders = map[string]string{
 	"Content-Type":               "application/json",
@@ -43,6 +55,8 @@ var chromeChatHeaders = map[string]string{
 type Service struct {
 	surfClient *surf.Client
 	cfg        *config.Config
+	endpoint   string                                                   // 聊天接口地址，测试中替换
+	tokens     func(ctx context.Context, apiKey string) (string, error) // 获取 x-is-human token，测试中替换
 }
 
 var (
@@ -68,23 +82,36 @@ func (s *Service) init() {
 		Impersonate().
 		Chrome().
 		Build()
+	s.endpoint = cursorChatAPI
+	s.tokens = func(ctx context.Context, apiKey string) (string, error) {
+		return token.GetPool().GetToken(ctx, apiKey)
+	}
 
 	log.Info("客户端初始化完成")
 }
 
-// GetXIsHuman 获取当前 token（兼容旧接口）
-func (s *Service) GetXIsHuman() string {
-	return s.GetXIsHumanForKey("")
+// apiKeyCtxKey 请求 API Key 在 context 中的键
+type apiKeyCtxKey struct{}
+
+// WithAPIKey 将客户端 API Key 放入 context，用于按 Key 获取 token
+func WithAPIKey(ctx context.Context, apiKey string) context.Context {
+	return context.WithValue(ctx, apiKeyCtxKey{}, apiKey)
+}
+
+// apiKeyFromContext 从 context 中取出 API Key
+func apiKeyFromContext(ctx context.Context) string {
+	apiKey, _ := ctx.Value(apiKeyCtxKey{}).(string)
+	return apiKey
+}
+
+// GetXIsHuman 获取当前请求的 token（API Key 取自 context）
+func (s *Service) GetXIsHuman(ctx context.Context) (string, error) {
+	return s.GetXIsHumanForKey(ctx, apiKeyFromContext(ctx))
 }
 
 // GetXIsHumanForKey 获取指定 API Key 的 token
-func (s *Service) GetXIsHumanForKey(apiKey string) string {
-	t, err := token.GetPool().GetToken(apiKey)
-	if err != nil {
-		log.Error("获取 token 失败: %v", err)
-		return ""
-	}
-	return t
+func (s *Service) GetXIsHumanForKey(ctx context.Context, apiKey string) (string, error) {
+	return s.tokens(ctx, apiKey)
 }
 
 // CursorChatRequest Cursor API 请求格式
@@ -117,61 +144,164 @@ type CursorPart struct {
 }
 
 // SendRequest 发送非流式请求
-func (s *Service) SendRequest(req CursorChatRequest) (string, error) {
-	return s.SendRequestWithIP(req, "")
+func (s *Service) SendRequest(ctx context.Context, req CursorChatRequest) (string, error) {
+	return s.SendRequestWithIP(ctx, req, "")
 }
 
 // SendRequestWithIP 发送非流式请求（带客户端 IP）
-func (s *Service) SendRequestWithIP(req CursorChatRequest, clientIP string) (string, error) {
-	return s.doRequest(req, nil, clientIP)
+func (s *Service) SendRequestWithIP(ctx context.Context, req CursorChatRequest, clientIP string) (string, error) {
+	return s.doRequest(ctx, req, nil, clientIP)
 }
 
 // SendStreamRequest 发送流式请求
-func (s *Service) SendStreamRequest(req CursorChatRequest, onChunk func(chunk string)) error {
-	return s.SendStreamRequestWithIP(req, onChunk, "")
+func (s *Service) SendStreamRequest(ctx context.Context, req CursorChatRequest, onEvent func(event sse.Event)) error {
+	return s.SendStreamRequestWithIP(ctx, req, onEvent, "")
 }
 
 // SendStreamRequestWithIP 发送流式请求（带客户端 IP）
-func (s *Service) SendStreamRequestWithIP(req CursorChatRequest, onChunk func(chunk string), clientIP string) error {
-	_, err := s.doRequest(req, onChunk, clientIP)
+// 上游每到达一个 SSE 事件即调用一次 onEvent
+func (s *Service) SendStreamRequestWithIP(ctx context.Context, req CursorChatRequest, onEvent func(event sse.Event), clientIP string) error {
+	_, err := s.doRequest(ctx, req, onEvent, clientIP)
 	return err
 }
 
 // doRequest 发送 API 请求
-func (s *Service) doRequest(req CursorChatRequest, onChunk func(chunk string), clientIP string) (string, error) {
-	headers := s.buildChatHeaders(clientIP)
+// onEvent 不为空时按 SSE 事件逐条回调，否则读取完整响应体后返回
+// ctx 取消（客户端断开）、首字节超时、空闲超时或总超时都会中止上游请求
+func (s *Service) doRequest(ctx context.Context, req CursorChatRequest, onEvent func(event sse.Event), clientIP string) (string, error) {
+	xIsHuman, err := s.GetXIsHuman(ctx)
+	if err != nil {
+		log.Error("获取 token 失败: %v", err)
+		return "", fmt.Errorf("获取 token 失败: %w", err)
+	}
+	headers := s.buildChatHeaders(xIsHuman, clientIP)
+
+	// 总超时从发出请求开始计算，不包含 token 生成
+	ctx, cancelTotal := context.WithTimeoutCause(ctx, s.totalTimeout(), ErrTotalTimeout)
+	defer cancelTotal()
+
+	// 首字节超时：在收到第一个响应字节前触发则取消请求
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+	firstByteTimer := time.AfterFunc(s.firstByteTimeout(), func() {
+		cancel(ErrFirstByteTimeout)
+	})
+	defer firstByteTimer.Stop()
 
 	log.Debug("发送请求到 Cursor API: model=%s", req.Model)
 
-	resp := s.surfClient.Post(g.String(cursorChatAPI), req).SetHeaders(headers).Do()
+	resp := s.surfClient.Post(g.String(s.endpoint), req).SetHeaders(headers).WithContext(ctx).Do()
 	if resp.IsErr() {
-		log.Error("Cursor API 请求失败: %v", resp.Err())
-		return "", fmt.Errorf("请求失败: %w", resp.Err())
+		err := requestError(ctx, resp.Err())
+		log.Error("Cursor API 请求失败: %v", err)
+		return "", fmt.Errorf("请求失败: %w", err)
 	}
 
 	r := resp.Ok()
+	defer r.Body.Reader.Close()
+
+	reader := r.Body.Stream()
+	if _, err := reader.Peek(1); err != nil && err != io.EOF {
+		err = requestError(ctx, err)
+		log.Error("读取 Cursor 响应失败: %v", err)
+		return "", fmt.Errorf("读取响应失败: %w", err)
+	}
+	firstByteTimer.Stop()
+
+	// 空闲超时：收到首字节后，超过 idleTimeout 没有读到新数据则取消请求
+	idleTimer := time.AfterFunc(s.idleTimeout(), func() {
+		cancel(ErrIdleTimeout)
+	})
+	defer idleTimer.Stop()
+	body := &idleReader{r: reader, timer: idleTimer, timeout: s.idleTimeout()}
+
 	if r.StatusCode != 200 {
-		body := string(r.Body.String())
+		body, _ := io.ReadAll(body)
 		log.Error("Cursor API 返回错误: HTTP %d, 响应: %s", r.StatusCode, body)
 		return "", fmt.Errorf("HTTP %d: %s", r.StatusCode, body)
 	}
 
-	bodyStr := string(r.Body.String())
-	if onChunk != nil {
-		onChunk(bodyStr)
+	if onEvent != nil {
+		decoder := sse.NewDecoder(body)
+		count := 0
+		for event := range decoder.Events() {
+			onEvent(event)
+			count++
+		}
+		if err := decoder.Err(); err != nil {
+			err = requestError(ctx, err)
+			log.Error("读取 Cursor 流式响应失败: %v", err)
+			return "", fmt.Errorf("读取响应失败: %w", err)
+		}
+		log.Debug("Cursor API 流式响应结束, 事件数: %d, 跳过: %d", count, decoder.Skipped())
+		return "", nil
 	}
 
+	data, err := io.ReadAll(body)
+	if err != nil {
+		err = requestError(ctx, err)
+		log.Error("读取 Cursor 响应失败: %v", err)
+		return "", fmt.Errorf("读取响应失败: %w", err)
+	}
+	bodyStr := string(data)
 	log.Debug("Cursor API 响应成功, 长度: %d", len(bodyStr))
 	return bodyStr, nil
 }
 
+// requestError 请求被 ctx 中止时返回具体原因（客户端断开/超时），否则返回原错误
+func requestError(ctx context.Context, err error) error {
+	if ctx.Err() != nil {
+		return context.Cause(ctx)
+	}
+	return err
+}
+
+// idleReader 每读到数据就重置空闲计时器
+type idleReader struct {
+	r       io.Reader
+	timer   *time.Timer
+	timeout time.Duration
+}
+
+func (r *idleReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if n > 0 {
+		r.timer.Reset(r.timeout)
+	}
+	return n, err
+}
+
+// idleTimeout 收到首字节后两次读到数据之间的最长间隔
+func (s *Service) idleTimeout() time.Duration {
+	if s.cfg.Timeout <= 0 {
+		return 60 * time.Second
+	}
+	return time.Duration(s.cfg.Timeout) * time.Second
+}
+
+// totalTimeout 上游请求总超时（不包含 token 生成），覆盖整个流式输出，应远大于 idleTimeout
+func (s *Service) totalTimeout() time.Duration {
+	if s.cfg.TotalTimeout <= 0 {
+		return 30 * time.Minute
+	}
+	return time.Duration(s.cfg.TotalTimeout) * time.Second
+}
+
+// firstByteTimeout 等待上游首字节的超时
+func (s *Service) firstByteTimeout() time.Duration {
+	if s.cfg.FirstByteTimeout <= 0 {
+		return s.idleTimeout()
+	}
+	return time.Duration(s.cfg.FirstByteTimeout) * time.Second
+}
+
 // buildChatHeaders 构建聊天请求头
-func (s *Service) buildChatHeaders(clientIP string) map[string]string {
+func (s *Service) buildChatHeaders(xIsHuman, clientIP string) map[string]string {
 	headers := make(map[string]string, len(chromeChatHeaders)+3)
 	for k, v := range chromeChatHeaders {
 		headers[k] = v
 	}
-	headers["x-is-human"] = s.GetXIsHuman()
+	headers["x-is-human"] = xIsHuman
 	// 转发客户端 IP
 	if clientIP != "" {
 		headers["X-Forwarded-For"] = clientIP
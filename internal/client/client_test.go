@@ -0,0 +1,263 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"cursor2api/internal/config"
+	"cursor2api/internal/sse"
+
+	"github.com/enetx/surf"
+)
+
+// newTestService 返回请求发往 handler 的客户端，token 固定为 "test-token"
+func newTestService(t *testing.T, cfg *config.Config, handler http.HandlerFunc) *Service {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// 读完请求体后服务端才能察觉客户端断开
+		_, _ = io.Copy(io.Discard, r.Body)
+		handler(w, r)
+	}))
+	t.Cleanup(srv.Close)
+	return &Service{
+		surfClient: surf.NewClient().Builder().Impersonate().Chrome().Build(),
+		cfg:        cfg,
+		endpoint:   srv.URL,
+		tokens: func(ctx context.Context, apiKey string) (string, error) {
+			return "test-token", nil
+		},
+	}
+}
+
+// writeEvent 写出一个 SSE 事件并立即发送
+func writeEvent(w http.ResponseWriter, data string) {
+	fmt.Fprintf(w, "data: %s\n\n", data)
+	w.(http.Flusher).Flush()
+}
+
+// wait 等待 d 或客户端断开，返回客户端是否已断开
+func wait(r *http.Request, d time.Duration) bool {
+	select {
+	case <-r.Context().Done():
+		return true
+	case <-time.After(d):
+		return false
+	}
+}
+
+func TestStreamTimeouts(t *testing.T) {
+	delta := `{"type":"text-delta","delta":"x"}`
+	cases := []struct {
+		name    string
+		cfg     config.Config
+		handler http.HandlerFunc
+		events  int
+		want    error
+	}{
+		{
+			"first byte timeout",
+			config.Config{Timeout: 10, FirstByteTimeout: 1, TotalTimeout: 10},
+			func(w http.ResponseWriter, r *http.Request) {
+				wait(r, 5*time.Second)
+			},
+			0, ErrFirstByteTimeout,
+		},
+		{
+			"idle timeout",
+			config.Config{Timeout: 1, FirstByteTimeout: 10, TotalTimeout: 10},
+			func(w http.ResponseWriter, r *http.Request) {
+				writeEvent(w, delta)
+				wait(r, 5*time.Second)
+			},
+			1, ErrIdleTimeout,
+		},
+		{
+			// 输出时间超过空闲超时，但每次间隔都在空闲超时之内
+			"long generation within the idle limit",
+			config.Config{Timeout: 1, FirstByteTimeout: 1, TotalTimeout: 10},
+			func(w http.ResponseWriter, r *http.Request) {
+				for i := 0; i < 6; i++ {
+					writeEvent(w, delta)
+					if wait(r, 400*time.Millisecond) {
+						return
+					}
+				}
+			},
+			6, nil,
+		},
+		{
+			"total timeout",
+			config.Config{Timeout: 10, FirstByteTimeout: 10, TotalTimeout: 1},
+			func(w http.ResponseWriter, r *http.Request) {
+				for {
+					writeEvent(w, delta)
+					if wait(r, 300*time.Millisecond) {
+						return
+					}
+				}
+			},
+			-1, ErrTotalTimeout,
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			s := newTestService(t, &tc.cfg, tc.handler)
+			events := 0
+			start := time.Now()
+			err := s.SendStreamRequest(context.Background(), CursorChatRequest{}, func(sse.Event) { events++ })
+			if tc.want == nil && err != nil || tc.want != nil && !errors.Is(err, tc.want) {
+				t.Fatalf("err = %v, want %v", err, tc.want)
+			}
+			if tc.events >= 0 && events != tc.events {
+				t.Errorf("events = %d, want %d", events, tc.events)
+			}
+			if elapsed := time.Since(start); elapsed > 4*time.Second {
+				t.Errorf("request took %v", elapsed)
+			}
+		})
+	}
+}
+
+func TestClientDisconnectCancelsUpstream(t *testing.T) {
+	aborted := make(chan bool, 1)
+	s := newTestService(t, &config.Config{}, func(w http.ResponseWriter, r *http.Request) {
+		writeEvent(w, `{"type":"text-delta","delta":"x"}`)
+		aborted <- wait(r, 5*time.Second)
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	err := s.SendStreamRequest(ctx, CursorChatRequest{}, func(sse.Event) { cancel() })
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("err = %v, want context.Canceled", err)
+	}
+	if !<-aborted {
+		t.Error("upstream request was not cancelled")
+	}
+}
+
+func TestTokenFailureSkipsRequest(t *testing.T) {
+	var requests atomic.Int32
+	s := newTestService(t, &config.Config{}, func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+	})
+	boom := errors.New("all token providers failed")
+	s.tokens = func(ctx context.Context, apiKey string) (string, error) {
+		return "", boom
+	}
+
+	_, err := s.SendRequest(context.Background(), CursorChatRequest{})
+	if !errors.Is(err, boom) {
+		t.Errorf("err = %v, want %v", err, boom)
+	}
+	if requests.Load() != 0 {
+		t.Error("request was sent without a token")
+	}
+}
+
+func TestRequestHeaders(t *testing.T) {
+	headers := make(chan http.Header, 1)
+	s := newTestService(t, &config.Config{}, func(w http.ResponseWriter, r *http.Request) {
+		headers <- r.Header
+		writeEvent(w, `{"type":"finish"}`)
+	})
+	s.tokens = func(ctx context.Context, apiKey string) (string, error) {
+		return "token-for-" + apiKey, nil
+	}
+
+	ctx := WithAPIKey(context.Background(), "key1")
+	if _, err := s.SendRequestWithIP(ctx, CursorChatRequest{}, "10.0.0.1"); err != nil {
+		t.Fatal(err)
+	}
+	h := <-headers
+	if got := h.Get("x-is-human"); got != "token-for-key1" {
+		t.Errorf("x-is-human = %q", got)
+	}
+	if got := h.Get("X-Forwarded-For"); !strings.Contains(got, "10.0.0.1") {
+		t.Errorf("X-Forwarded-For = %q", got)
+	}
+}
+
+func TestStreamDeliversEventsIncrementally(t *testing.T) {
+	// 上游发出第一个事件后等调用方收到才继续，整体读完再回调会一直等到超时
+	received := make(chan struct{})
+	s := newTestService(t, &config.Config{}, func(w http.ResponseWriter, r *http.Request) {
+		writeEvent(w, `{"type":"text-delta","delta":"Hel"}`)
+		select {
+		case <-received:
+		case <-time.After(3 * time.Second):
+			return
+		}
+		writeEvent(w, `{"type":"text-delta","delta":"lo"}`)
+	})
+
+	var deltas []string
+	err := s.SendStreamRequest(context.Background(), CursorChatRequest{}, func(event sse.Event) {
+		deltas = append(deltas, event.Delta)
+		if len(deltas) == 1 {
+			close(received)
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(deltas, "|") != "Hel|lo" {
+		t.Errorf("deltas = %q", deltas)
+	}
+}
+
+func TestStreamEventTypes(t *testing.T) {
+	stream := []string{
+		`{"type":"start"}`,
+		`{"type":"reasoning-delta","id":"r1","delta":"think"}`,
+		`{"type":"text-delta","id":"t1","delta":"hi"}`,
+		`{"type":"finish-step","finishReason":"tool-calls","usage":{"inputTokens":12,"outputTokens":3}}`,
+		`{"type":"message-metadata","messageMetadata":{"usage":{"promptTokens":12}}}`,
+		`{"type":"error","errorText":"rate limited"}`,
+		`{"type":"finish","finishReason":"stop"}`,
+	}
+	want := []sse.Event{
+		{Type: "start"},
+		{Type: sse.TypeReasoningDelta, ID: "r1", Delta: "think"},
+		{Type: sse.TypeTextDelta, ID: "t1", Delta: "hi"},
+		{Type: sse.TypeFinishStep, FinishReason: "tool-calls", Usage: &sse.Usage{InputTokens: 12, OutputTokens: 3}},
+		{Type: sse.TypeMessageMetadata, MessageMetadata: map[string]interface{}{"usage": map[string]interface{}{"promptTokens": float64(12)}}},
+		{Type: sse.TypeError, ErrorText: "rate limited"},
+		{Type: sse.TypeFinish, FinishReason: "stop"},
+	}
+	s := newTestService(t, &config.Config{}, func(w http.ResponseWriter, r *http.Request) {
+		for _, data := range stream {
+			writeEvent(w, data)
+		}
+		writeEvent(w, "[DONE]")
+	})
+
+	var got []sse.Event
+	if err := s.SendStreamRequest(context.Background(), CursorChatRequest{}, func(event sse.Event) {
+		got = append(got, event)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("events = %+v, want %+v", got, want)
+	}
+
+	// 非流式请求返回完整响应体，由调用方解析
+	body, err := s.SendRequest(context.Background(), CursorChatRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, data := range stream {
+		if !strings.Contains(body, "data: "+data+"\n") {
+			t.Errorf("body is missing %s", data)
+		}
+	}
+}
@@ -15,20 +15,56 @@ import (
 type Config struct {
 	// Port 服务监听端口
 	Port string `yaml:"port"`
-	// Timeout 请求超时时间（秒）
+	// Timeout 上游空闲超时时间（秒），收到首字节后超过该时间没有新数据则中止请求
 	Timeout int `yaml:"timeout"`
+	// FirstByteTimeout 等待上游首字节的超时时间（秒）
+	FirstByteTimeout int `yaml:"first_byte_timeout"`
+	// TotalTimeout 上游请求总超时时间（秒），覆盖整个流式输出，不包含 token 生成
+	TotalTimeout int `yaml:"total_timeout"`
 	// Proxy 代理地址
 	Proxy string `yaml:"proxy"`
 	// ScriptURL Cursor 验证脚本 URL
 	ScriptURL string `yaml:"script_url"`
+	// ScriptCacheTTL 验证脚本缓存有效期（秒），过期后按 ETag/Last-Modified 重新验证
+	ScriptCacheTTL int `yaml:"script_cache_ttl"`
+	// ScriptCacheDir 验证脚本磁盘缓存目录，为空则只缓存在内存
+	ScriptCacheDir string `yaml:"script_cache_dir"`
 	// XIsHumanServerURL 外部 token 计算服务地址
 	XIsHumanServerURL string `yaml:"x_is_human_server_url"`
+	// TokenProvider 首选 token 后端: node / http / goja，为空时按是否配置 XIsHumanServerURL 自动选择
+	TokenProvider string `yaml:"token_provider"`
+	// TokenTimeout 单个 token 后端生成超时（秒）
+	TokenTimeout int `yaml:"token_timeout"`
+	// NodeWorkers 常驻 node worker 数量，0 表示每个 token 启动一个 node 进程
+	NodeWorkers int `yaml:"node_workers"`
 	// Fingerprint 浏览器指纹配置
 	Fingerprint FingerprintConfig `yaml:"fingerprint"`
-	// Models 支持的模型列表
-	Models string `yaml:"models"`
+	// Models 模型注册表：公开 ID、别名到 Cursor 模型 ID 的映射及模型能力
+	Models ModelList `yaml:"models"`
 	// TokenPoolSize Token 轮询池大小
 	TokenPoolSize int `yaml:"token_pool_size"`
+	// TokenStrategy Token 使用策略: fresh / round_robin / per_key
+	TokenStrategy string `yaml:"token_strategy"`
+	// ToolRepairRetries 工具参数校验失败时要求模型修正的最大次数，0 表示不重试
+	ToolRepairRetries int `yaml:"tool_repair_retries"`
+	// ToolDialect 默认工具调用格式: xml / vm / hermes / json / function
+	ToolDialect string `yaml:"tool_dialect"`
+	// ToolDialects 按模型覆盖工具调用格式，key 为注册表中的模型 ID
+	ToolDialects map[string]string `yaml:"tool_dialects"`
+	// ModelHealth 模型健康统计，用于回退链路由
+	ModelHealth ModelHealthConfig `yaml:"model_health"`
+}
+
+// ModelHealthConfig 模型健康统计配置
+type ModelHealthConfig struct {
+	// Window 统计错误率的滚动窗口（秒）
+	Window int `yaml:"window"`
+	// MinRequests 窗口内请求数达到该值才判断错误率
+	MinRequests int `yaml:"min_requests"`
+	// ErrorRate 窗口内错误率达到该值时标记为不健康
+	ErrorRate float64 `yaml:"error_rate"`
+	// Cooldown 不健康状态持续时间（秒），到期后恢复尝试
+	Cooldown int `yaml:"cooldown"`
 }
 
 // FingerprintConfig 浏览器指纹配置
@@ -50,9 +86,22 @@ var (
 func Get() *Config {
 	once.Do(func() {
 		cfg = &Config{
-			Port:    "3010",
-			Timeout: 60,
-			Models:  "gpt-4o,claude-3.5-sonnet,claude-3.7-sonnet",
+			Port:             "3010",
+			Timeout:          60,
+			FirstByteTimeout: 30,
+			TotalTimeout:     1800,
+			TokenTimeout:     20,
+			TokenStrategy:    "fresh",
+			ToolDialect:      "xml",
+			ScriptCacheTTL:   300,
+			ScriptCacheDir:   "cache/script",
+			Models:           defaultModels(),
+			ModelHealth: ModelHealthConfig{
+				Window:      60,
+				MinRequests: 3,
+				ErrorRate:   0.5,
+				Cooldown:    60,
+			},
 			Fingerprint: FingerprintConfig{
 				UserAgent: "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/139.0.0.0 Safari/537.36",
 			},
@@ -89,6 +138,12 @@ func load(c *Config) {
 	if xIsHumanServerURL := os.Getenv("X_IS_HUMAN_SERVER_URL"); xIsHumanServerURL != "" {
 		c.XIsHumanServerURL = xIsHumanServerURL
 	}
+	if tokenProvider := os.Getenv("TOKEN_PROVIDER"); tokenProvider != "" {
+		c.TokenProvider = tokenProvider
+	}
+	if tokenStrategy := os.Getenv("TOKEN_STRATEGY"); tokenStrategy != "" {
+		c.TokenStrategy = tokenStrategy
+	}
 	if fp := os.Getenv("FP"); fp != "" {
 		// FP 是 base64 编码的 JSON
 		if decoded, err := base64.StdEncoding.DecodeString(fp); err == nil {
@@ -98,12 +153,19 @@ func load(c *Config) {
 			}
 		}
 	}
+	if toolDialect := os.Getenv("TOOL_DIALECT"); toolDialect != "" {
+		c.ToolDialect = toolDialect
+	}
 	if models := os.Getenv("MODELS"); models != "" {
-		c.Models = models
+		c.Models = c.Models.restrict(models)
+	}
+	if err := c.Models.Validate(); err != nil {
+		log.Printf("[配置] 模型注册表无效: %v，使用默认模型", err)
+		c.Models = defaultModels()
 	}
 
 	// 输出最终配置
-	log.Printf("[配置] 端口: %s, 超时: %ds", c.Port, c.Timeout)
+	log.Printf("[配置] 端口: %s, 空闲超时: %ds, 首字节超时: %ds, 总超时: %ds", c.Port, c.Timeout, c.FirstByteTimeout, c.TotalTimeout)
 	if c.ScriptURL != "" {
 		log.Printf("[配置] ScriptURL: %s", c.ScriptURL)
 	}
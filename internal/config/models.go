@@ -0,0 +1,211 @@
+package config
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// 支持的 tokenizer 编码，与 internal/tokenizer 内嵌的词表一一对应
+const (
+	TokenizerCl100k = "cl100k_base"
+	TokenizerO200k  = "o200k_base"
+)
+
+// Tokenizers 模型 tokenizer 字段可用的编码名
+var Tokenizers = []string{TokenizerCl100k, TokenizerO200k}
+
+// ModelConfig 模型注册表中的一个模型
+type ModelConfig struct {
+	// ID 对外公开的模型 ID
+	ID string `yaml:"id"`
+	// CursorID 实际发给 Cursor 的模型 ID，为空时与 ID 相同
+	CursorID string `yaml:"cursor_id"`
+	// Aliases 也可以用来请求该模型的名称
+	Aliases []string `yaml:"aliases"`
+	// ContextWindow 上下文窗口（token），0 表示未知
+	ContextWindow int `yaml:"context_window"`
+	// MaxOutput 最大输出 token 数，0 表示不限制
+	MaxOutput int `yaml:"max_output"`
+	// Tools 是否支持工具调用，默认支持
+	Tools *bool `yaml:"tools"`
+	// Thinking 是否支持扩展思考
+	Thinking bool `yaml:"thinking"`
+	// ThinkingCursorID 开启扩展思考时发给 Cursor 的模型 ID，为空时与 Upstream() 相同（模型默认就会推理）
+	ThinkingCursorID string `yaml:"thinking_cursor_id"`
+	// Enabled 是否启用，默认启用
+	Enabled *bool `yaml:"enabled"`
+	// ToolDialect 该模型使用的工具调用格式，为空时按 tool_dialects / tool_dialect
+	ToolDialect string `yaml:"tool_dialect"`
+	// Fallbacks 该模型失败或不健康时依次尝试的模型 ID
+	Fallbacks []string `yaml:"fallbacks"`
+	// Tokenizer 计算用量使用的 BPE 编码（cl100k_base / o200k_base），为空时使用 cl100k_base
+	Tokenizer string `yaml:"tokenizer"`
+}
+
+// SupportsTools 是否支持工具调用
+func (m ModelConfig) SupportsTools() bool {
+	return m.Tools == nil || *m.Tools
+}
+
+// IsEnabled 是否启用
+func (m ModelConfig) IsEnabled() bool {
+	return m.Enabled == nil || *m.Enabled
+}
+
+// Upstream 发给 Cursor 的模型 ID
+func (m ModelConfig) Upstream() string {
+	if m.CursorID != "" {
+		return m.CursorID
+	}
+	return m.ID
+}
+
+// UpstreamFor 按是否开启扩展思考返回发给 Cursor 的模型 ID
+func (m ModelConfig) UpstreamFor(thinking bool) string {
+	if thinking && m.ThinkingCursorID != "" {
+		return m.ThinkingCursorID
+	}
+	return m.Upstream()
+}
+
+// ModelList 模型注册表
+// 兼容旧的逗号分隔写法 models: "a,b"，每项可写成 "公开ID=CursorID"
+type ModelList []ModelConfig
+
+// UnmarshalYAML 同时支持列表和逗号分隔的字符串
+func (l *ModelList) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.ScalarNode {
+		*l = parseModelList(value.Value)
+		return nil
+	}
+	var models []ModelConfig
+	if err := value.Decode(&models); err != nil {
+		return err
+	}
+	*l = models
+	return nil
+}
+
+// parseModelList 解析 "a,b=cursor-b" 形式的模型列表
+func parseModelList(s string) ModelList {
+	var models ModelList
+	for _, item := range strings.Split(s, ",") {
+		id, cursorID, _ := strings.Cut(strings.TrimSpace(item), "=")
+		if id = strings.TrimSpace(id); id == "" {
+			continue
+		}
+		models = append(models, ModelConfig{ID: id, CursorID: strings.TrimSpace(cursorID)})
+	}
+	return models
+}
+
+// Find 按 ID 或别名查找模型（忽略大小写），包括未启用的模型
+func (l ModelList) Find(name string) (ModelConfig, bool) {
+	name = strings.TrimSpace(name)
+	for _, m := range l {
+		if strings.EqualFold(m.ID, name) {
+			return m, true
+		}
+	}
+	for _, m := range l {
+		for _, alias := range m.Aliases {
+			if strings.EqualFold(alias, name) {
+				return m, true
+			}
+		}
+	}
+	return ModelConfig{}, false
+}
+
+// Validate 检查 ID 和别名是否重复，回退模型和 tokenizer 是否存在
+func (l ModelList) Validate() error {
+	seen := make(map[string]string)
+	for _, m := range l {
+		if m.ID == "" {
+			return fmt.Errorf("model entry without id")
+		}
+		for _, name := range append([]string{m.ID}, m.Aliases...) {
+			key := strings.ToLower(name)
+			if owner, ok := seen[key]; ok {
+				return fmt.Errorf("model name %q is used by both %s and %s", name, owner, m.ID)
+			}
+			seen[key] = m.ID
+		}
+		if m.ThinkingCursorID != "" && !m.Thinking {
+			return fmt.Errorf("model %s sets thinking_cursor_id but does not enable thinking", m.ID)
+		}
+		if m.Tokenizer != "" && !slices.Contains(Tokenizers, m.Tokenizer) {
+			return fmt.Errorf("model %s uses unknown tokenizer %q", m.ID, m.Tokenizer)
+		}
+	}
+	for _, m := range l {
+		for _, fallback := range m.Fallbacks {
+			if _, ok := l.Find(fallback); !ok {
+				return fmt.Errorf("model %s falls back to unknown model %q", m.ID, fallback)
+			}
+		}
+	}
+	return nil
+}
+
+// restrict 按 MODELS 环境变量覆盖注册表
+// 列出的模型保留注册表中的配置并启用，注册表中没有的按 "公开ID=CursorID" 新增，未列出的模型停用
+func (l ModelList) restrict(s string) ModelList {
+	enabled := true
+	disabled := false
+	listed := make(map[string]bool)
+	var models ModelList
+	for _, item := range parseModelList(s) {
+		m, ok := l.Find(item.ID)
+		if !ok {
+			m = item
+		} else if item.CursorID != "" {
+			m.CursorID = item.CursorID
+		}
+		m.Enabled = &enabled
+		if !listed[strings.ToLower(m.ID)] {
+			listed[strings.ToLower(m.ID)] = true
+			models = append(models, m)
+		}
+	}
+	for _, m := range l {
+		if !listed[strings.ToLower(m.ID)] {
+			m.Enabled = &disabled
+			models = append(models, m)
+		}
+	}
+	return models
+}
+
+// defaultModels 没有配置 models 时使用的注册表
+func defaultModels() ModelList {
+	return ModelList{
+		{
+			ID:               "claude-4.5-opus",
+			CursorID:         "claude-opus-4-5-20251101",
+			Aliases:          []string{"claude-opus-4-5", "claude-opus-4-5-20251101"},
+			ContextWindow:    200000,
+			MaxOutput:        64000,
+			Thinking:         true,
+			ThinkingCursorID: "claude-4.5-opus-high-thinking",
+		},
+		{
+			ID:               "claude-4.5-sonnet",
+			CursorID:         "claude-sonnet-4-5-20250929",
+			Aliases:          []string{"claude-sonnet-4-5", "claude-sonnet-4-5-20250929"},
+			ContextWindow:    200000,
+			MaxOutput:        64000,
+			Thinking:         true,
+			ThinkingCursorID: "claude-4.5-sonnet-thinking",
+		},
+		{ID: "composer-1", ContextWindow: 200000},
+		{ID: "gemini-3-flash", ContextWindow: 1000000, MaxOutput: 65536, Thinking: true},
+		{ID: "gemini-3-pro", ContextWindow: 1000000, MaxOutput: 65536, Thinking: true},
+		{ID: "gpt-5.1-codex-max", ContextWindow: 400000, MaxOutput: 128000, Thinking: true, Tokenizer: TokenizerO200k},
+		{ID: "gpt-5.2", ContextWindow: 400000, MaxOutput: 128000, Thinking: true, Tokenizer: TokenizerO200k},
+		{ID: "grok-code", ContextWindow: 256000},
+	}
+}
@@ -0,0 +1,35 @@
+package config
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestModelListValidate(t *testing.T) {
+	cases := []struct {
+		name    string
+		models  ModelList
+		wantErr string
+	}{
+		{"defaults", defaultModels(), ""},
+		{"known tokenizer", ModelList{{ID: "a", Tokenizer: TokenizerO200k}}, ""},
+		{"unknown tokenizer", ModelList{{ID: "a", Tokenizer: "p50k_base"}}, `unknown tokenizer "p50k_base"`},
+		{"duplicate alias", ModelList{{ID: "a"}, {ID: "b", Aliases: []string{"A"}}}, "used by both a and b"},
+		{"unknown fallback", ModelList{{ID: "a", Fallbacks: []string{"b"}}}, `unknown model "b"`},
+		{"thinking id without thinking", ModelList{{ID: "a", ThinkingCursorID: "a-thinking"}}, "does not enable thinking"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.models.Validate()
+			if tc.wantErr == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Fatalf("err = %v, want %q", err, tc.wantErr)
+			}
+		})
+	}
+}
@@ -3,12 +3,17 @@
 package handler
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"net/http"
 	"strings"
 
 	"cursor2api/internal/client"
+	"cursor2api/internal/config"
+	"cursor2api/internal/sse"
 	"cursor2api/internal/toolify"
 
 	"github.com/gin-gonic/gin"
@@ -21,12 +26,53 @@ import (
 
 // MessagesRequest Anthropic Messages API 请求格式
 type MessagesRequest struct {
-	Model     string                   `json:"model"`
-	Messages  []Message                `json:"messages"`
-	MaxTokens int                      `json:"max_tokens"`
-	Stream    bool                     `json:"stream"`
-	System    interface{}              `json:"system,omitempty"` // 可以是 string 或 []ContentBlock
-	Tools     []toolify.ToolDefinition `json:"tools,omitempty"`
+	Model         string                   `json:"model"`
+	Messages      []Message                `json:"messages"`
+	MaxTokens     int                      `json:"max_tokens"`
+	Stream        bool                     `json:"stream"`
+	System        interface{}              `json:"system,omitempty"` // 可以是 string 或 []ContentBlock
+	Tools         []toolify.ToolDefinition `json:"tools,omitempty"`
+	ToolChoice    interface{}              `json:"tool_choice,omitempty"` // {"type":"auto|any|tool|none",...}
+	Thinking      *ThinkingConfig          `json:"thinking,omitempty"`
+	StopSequences []string                 `json:"stop_sequences,omitempty"`
+}
+
+// ThinkingConfig 扩展思考配置
+type ThinkingConfig struct {
+	Type         string `json:"type"` // enabled / disabled
+	BudgetTokens int    `json:"budget_tokens,omitempty"`
+}
+
+// minThinkingBudget budget_tokens 的最小值
+const minThinkingBudget = 1024
+
+// thinkingEnabled 是否开启了扩展思考
+func (r MessagesRequest) thinkingEnabled() bool {
+	return r.Thinking != nil && r.Thinking.Type == "enabled"
+}
+
+// validateThinking 检查 thinking 参数，规则与 Anthropic API 一致
+func (r MessagesRequest) validateThinking(choice toolify.ToolChoice) error {
+	if r.Thinking == nil {
+		return nil
+	}
+	switch r.Thinking.Type {
+	case "disabled":
+		return nil
+	case "enabled":
+	default:
+		return fmt.Errorf("thinking.type: Input should be 'enabled' or 'disabled'")
+	}
+	if r.Thinking.BudgetTokens < minThinkingBudget {
+		return fmt.Errorf("thinking.enabled.budget_tokens: Input should be greater than or equal to %d", minThinkingBudget)
+	}
+	if r.MaxTokens > 0 && r.Thinking.BudgetTokens >= r.MaxTokens {
+		return fmt.Errorf("`max_tokens` must be greater than `thinking.budget_tokens`")
+	}
+	if choice.Required() {
+		return fmt.Errorf("Thinking may not be enabled when tool_choice forces tool use.")
+	}
+	return nil
 }
 
 // Message 消息格式
@@ -49,11 +95,13 @@ type MessagesResponse struct {
 
 // ContentBlock 内容块
 type ContentBlock struct {
-	Type  string                 `json:"type"`
-	Text  string                 `json:"text,omitempty"`
-	ID    string                 `json:"id,omitempty"`    // tool_use
-	Name  string                 `json:"name,omitempty"`  // tool_use
-	Input map[string]interface{} `json:"input,omitempty"` // tool_use
+	Type      string          `json:"type"`
+	Text      string          `json:"text,omitempty"`
+	Thinking  string          `json:"thinking,omitempty"`  // thinking
+	Signature string          `json:"signature,omitempty"` // thinking
+	ID        string          `json:"id,omitempty"`        // tool_use
+	Name      string          `json:"name,omitempty"`      // tool_use
+	Input     json.RawMessage `json:"input,omitempty"`     // tool_use
 }
 
 // Usage token 使用统计
@@ -62,12 +110,6 @@ type Usage struct {
 	OutputTokens int `json:"output_tokens"`
 }
 
-// CursorSSEEvent Cursor SSE 事件格式
-type CursorSSEEvent struct {
-	Type  string `json:"type"`
-	Delta string `json:"delta,omitempty"`
-}
-
 // ================== 辅助函数 ==================
 
 // generateID 生成唯一标识符
@@ -101,37 +143,31 @@ func getTextContent(content interface{}) string {
 	}
 }
 
-// mapModelName 将模型名称映射到 Cursor 支持的格式
-func mapModelName(model string) string {
-	// 统一使用 claude-opus-4-5-20251101
-	const targetModel = "claude-opus-4-5-20251101"
-	if model != targetModel {
-		log.Debug("模型映射: %s -> %s", model, targetModel)
-	}
-	return targetModel
-}
-
 // ================== 处理器函数 ==================
 
-// CountTokens 估算 token 数量
-func CountTokens(c *gin.Context) {
+// CountTokens 计算请求的输入 token 数
+// 按实际发给 Cursor 的提示计算，包括注入的工具提示，与 Messages 响应中的 input_tokens 一致
+func (h *Handler) CountTokens(c *gin.Context) {
 	var req MessagesRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": gin.H{"message": err.Error()}})
 		return
 	}
 
-	// 简单估算：每 4 个字符约 1 个 token
-	totalChars := len(getTextContent(req.System))
-	for _, msg := range req.Messages {
-		totalChars += len(getTextContent(msg.Content))
+	model, merr := h.resolveModel(req.Model, modelNeeds{tools: len(req.Tools) > 0, thinking: req.thinkingEnabled()})
+	if merr != nil {
+		writeAnthropicModelError(c, merr)
+		return
 	}
-	tokens := totalChars / 4
-	if tokens < 1 {
-		tokens = 1
+	choice := toolify.ParseToolChoice(req.ToolChoice)
+	if err := choice.Resolve(req.Tools); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"type": "error", "error": gin.H{"type": "invalid_request_error", "message": err.Error()}})
+		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{"input_tokens": tokens})
+	ts := h.newToolSetup(model, req.Tools, choice, nil)
+	cursorReq := h.convertToCursor(req, ts, model.UpstreamFor(req.thinkingEnabled()))
+	c.JSON(http.StatusOK, gin.H{"input_tokens": promptTokens(model, cursorReq)})
 }
 
 // getClientIP 获取客户端真实 IP
@@ -152,8 +188,25 @@ func getClientIP(c *gin.Context) string {
 	return c.ClientIP()
 }
 
+// getAPIKey 获取客户端 API Key（x-api-key 或 Authorization: Bearer）
+func getAPIKey(c *gin.Context) string {
+	if key := c.GetHeader("x-api-key"); key != "" {
+		return key
+	}
+	auth := c.GetHeader("Authorization")
+	if strings.HasPrefix(auth, "Bearer ") {
+		return strings.TrimSpace(strings.TrimPrefix(auth, "Bearer "))
+	}
+	return ""
+}
+
+// requestContext 返回携带 API Key 的请求 context
+func requestContext(c *gin.Context) context.Context {
+	return client.WithAPIKey(c.Request.Context(), getAPIKey(c))
+}
+
 // Messages 处理 Anthropic Messages API 请求
-func Messages(c *gin.Context) {
+func (h *Handler) Messages(c *gin.Context) {
 	// 记录请求 Headers
 	log.Debug("[Anthropic] ========== 请求开始 ==========")
 	log.Debug("[Anthropic] 请求路径: %s", c.Request.URL.String())
@@ -178,6 +231,12 @@ func Messages(c *gin.Context) {
 	if len(req.Tools) > 0 {
 		log.Info("  工具数: %d", len(req.Tools))
 	}
+	if req.thinkingEnabled() {
+		log.Info("  扩展思考: budget_tokens=%d", req.Thinking.BudgetTokens)
+	}
+	if len(req.StopSequences) > 0 {
+		log.Info("  停止序列: %q", req.StopSequences)
+	}
 
 	// 记录消息内容
 	for i, msg := range req.Messages {
@@ -188,22 +247,55 @@ func Messages(c *gin.Context) {
 		log.Debug("  消息[%d] 角色=%s 内容=%s", i, msg.Role, content)
 	}
 
-	// 转换为 Cursor 请求格式
-	cursorReq := convertToCursor(req)
+	thinking := req.thinkingEnabled()
+	needs := modelNeeds{maxTokens: req.MaxTokens, tools: len(req.Tools) > 0, thinking: thinking}
+	model, merr := h.resolveModel(req.Model, needs)
+	if merr != nil {
+		writeAnthropicModelError(c, merr)
+		return
+	}
+
+	choice := toolify.ParseToolChoice(req.ToolChoice)
+	if err := choice.Resolve(req.Tools); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"type": "error", "error": gin.H{"type": "invalid_request_error", "message": err.Error()}})
+		return
+	}
+	if err := req.validateThinking(choice); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"type": "error", "error": gin.H{"type": "invalid_request_error", "message": err.Error()}})
+		return
+	}
+
+	// 按回退链依次尝试，每个模型单独转换为 Cursor 请求格式
+	route := &modelRoute{
+		chain: h.modelChain(model, needs),
+		prepare: func(m config.ModelConfig) (toolSetup, client.CursorChatRequest) {
+			ts := h.newToolSetup(m, req.Tools, choice, req.StopSequences)
+			return ts, h.convertToCursor(req, ts, m.UpstreamFor(thinking))
+		},
+	}
 	clientIP := getClientIP(c)
 	log.Debug("[Anthropic] 客户端 IP: %s", clientIP)
 
 	if req.Stream {
-		handleStream(c, cursorReq, req.Model, req.Tools, clientIP)
+		h.handleStream(c, route, req.Model, thinking, clientIP)
 	} else {
-		handleNonStream(c, cursorReq, req.Model, req.Tools, clientIP)
+		h.handleNonStream(c, route, req.Model, thinking, clientIP)
 	}
 }
 
+// writeAnthropicModelError 返回 Anthropic 格式的模型错误
+func writeAnthropicModelError(c *gin.Context, merr *modelError) {
+	errType := "invalid_request_error"
+	if merr.status == http.StatusNotFound {
+		errType = "not_found_error"
+	}
+	c.JSON(merr.status, gin.H{"type": "error", "error": gin.H{"type": errType, "message": merr.message}})
+}
+
 // ================== 请求转换 ==================
 
 // convertToCursor 将 Anthropic 请求转换为 Cursor 格式
-func convertToCursor(req MessagesRequest) client.CursorChatRequest {
+func (h *Handler) convertToCursor(req MessagesRequest, ts toolSetup, cursorModel string) client.CursorChatRequest {
 	messages := make([]client.CursorMessage, 0, len(req.Messages)+1)
 
 	// 构建系统消息
@@ -216,37 +308,18 @@ func convertToCursor(req MessagesRequest) client.CursorChatRequest {
 		})
 	}
 
-	// 检测是否有 tool_result（表示工具已执行过）
-	hasToolResult := false
-	for _, msg := range req.Messages {
-		if msg.Role == "user" {
-			if content, ok := msg.Content.([]interface{}); ok {
-				for _, item := range content {
-					if block, ok := item.(map[string]interface{}); ok {
-						if block["type"] == "tool_result" {
-							hasToolResult = true
-							break
-						}
-					}
-				}
-			}
-		}
-	}
-
-	// 只有第一次调用时才注入工具提示（没有 tool_result）
-	toolPrompt := ""
-	if len(req.Tools) > 0 && !hasToolResult {
-		toolPrompt = toolify.GenerateToolPrompt(req.Tools)
-		log.Info("[Anthropic] 注入工具提示词, 长度: %d, 工具数: %d", len(toolPrompt), len(req.Tools))
+	// 工具提示在整个 agent 循环中都保留，否则模型在后续轮次会忘记调用格式
+	toolPrompt := toolify.GenerateToolPrompt(ts.dialect, ts.tools, ts.choice)
+	if toolPrompt != "" {
+		log.Info("[Anthropic] 注入工具提示词, 格式: %s, 长度: %d, 工具数: %d", ts.dialect.Name(), len(toolPrompt), len(ts.tools))
 		log.Debug("[Anthropic] 工具提示词内容:\n%s", toolPrompt)
-	} else if len(req.Tools) > 0 && hasToolResult {
-		log.Debug("[Anthropic] 跳过工具提示词注入 (已有 tool_result)")
 	}
+	toolNames := h.toolUseNames(req.Messages)
 
 	// 添加用户/助手消息
 	firstUserMsg := true
 	for _, msg := range req.Messages {
-		text := extractMessageText(msg)
+		text := extractMessageText(msg, toolNames, ts.dialect)
 		if text != "" {
 			// 把工具提示放在第一条用户消息前面
 			if msg.Role == "user" && firstUserMsg && toolPrompt != "" {
@@ -263,15 +336,46 @@ func convertToCursor(req MessagesRequest) client.CursorChatRequest {
 	}
 
 	return client.CursorChatRequest{
-		Model:    mapModelName(req.Model),
+		Model:    cursorModel,
 		ID:       generateID(),
 		Messages: messages,
 		Trigger:  "submit-message",
 	}
 }
 
+// toolUseNames 收集历史中所有 tool_use 的 id -> 工具名，用于 tool_result 配对
+// 历史中找不到的调用按代理之前发出的记录补全
+func (h *Handler) toolUseNames(messages []Message) map[string]string {
+	names := make(map[string]string)
+	var resultIDs []string
+	for _, msg := range messages {
+		content, ok := msg.Content.([]interface{})
+		if !ok {
+			continue
+		}
+		for _, item := range content {
+			block, ok := item.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			switch block["type"] {
+			case "tool_use":
+				id, _ := block["id"].(string)
+				name, _ := block["name"].(string)
+				names[id] = name
+			case "tool_result":
+				id, _ := block["tool_use_id"].(string)
+				resultIDs = append(resultIDs, id)
+			}
+		}
+	}
+	h.calls.resolve(names, resultIDs)
+	return names
+}
+
 // extractMessageText 从消息中提取文本
-func extractMessageText(msg Message) string {
+// tool_use 和 tool_result 按 dialect 的格式还原，tool_result 通过 toolNames 关联到对应的调用
+func extractMessageText(msg Message, toolNames map[string]string, dialect toolify.Dialect) string {
 	content := msg.Content
 	if content == nil {
 		return ""
@@ -292,6 +396,14 @@ func extractMessageText(msg Message) string {
 				if text, ok := block["text"].(string); ok {
 					texts = append(texts, text)
 				}
+			case "thinking", "redacted_thinking":
+				// 之前轮次的推理内容不转发给上游
+			case "tool_use":
+				// 还原模型自己之前发起的工具调用
+				id, _ := block["id"].(string)
+				name, _ := block["name"].(string)
+				input, _ := json.Marshal(block["input"])
+				texts = append(texts, dialect.RenderCall(id, name, string(input)))
 			case "tool_result":
 				// 提取 tool_result 内容
 				toolID := ""
@@ -312,7 +424,8 @@ func extractMessageText(msg Message) string {
 						}
 					}
 				}
-				texts = append(texts, fmt.Sprintf("[Tool %s result]: %s", toolID, resultContent))
+				isError, _ := block["is_error"].(bool)
+				texts = append(texts, dialect.RenderResult(toolID, toolNames[toolID], resultContent, isError))
 			}
 		}
 		return strings.Join(texts, "\n")
@@ -324,195 +437,427 @@ func extractMessageText(msg Message) string {
 // ================== API 处理 ==================
 
 // handleStream 处理流式请求
-func handleStream(c *gin.Context, cursorReq client.CursorChatRequest, model string, tools []toolify.ToolDefinition, clientIP string) {
-	c.Header("Content-Type", "text/event-stream")
-	c.Header("Cache-Control", "no-cache")
-	c.Header("Connection", "keep-alive")
-	c.Header("X-Accel-Buffering", "no")
-
+func (h *Handler) handleStream(c *gin.Context, route *modelRoute, model string, thinking bool, clientIP string) {
 	flusher, _ := c.Writer.(http.Flusher)
 	id := "msg_" + generateID()
 
-	// 发送 message_start
-	_, _ = c.Writer.WriteString("event: message_start\n")
-	_, _ = fmt.Fprintf(c.Writer, `data: {"type":"message_start","message":{"id":"%s","type":"message","role":"assistant","content":[],"model":"%s","stop_reason":null,"stop_sequence":null,"usage":{"input_tokens":100,"output_tokens":0}}}`+"\n\n", id, model)
-	flusher.Flush()
+	var (
+		ts        toolSetup
+		cursorReq client.CursorChatRequest
+		result    *cursorResult
+		filter    *outputFilter
+		served    config.ModelConfig
+		started   bool
+	)
+
+	// 写出响应头和 message_start，之后不能再回退到其他模型
+	start := func() {
+		if started {
+			return
+		}
+		started = true
+		c.Header(servedModelHeader, served.ID)
+		c.Header("Content-Type", "text/event-stream")
+		c.Header("Cache-Control", "no-cache")
+		c.Header("Connection", "keep-alive")
+		c.Header("X-Accel-Buffering", "no")
+
+		_, _ = c.Writer.WriteString("event: message_start\n")
+		_, _ = fmt.Fprintf(c.Writer, `data: {"type":"message_start","message":{"id":"%s","type":"message","role":"assistant","content":[],"model":"%s","stop_reason":null,"stop_sequence":null,"usage":{"input_tokens":%d,"output_tokens":0}}}`+"\n\n", id, model, promptTokens(served, cursorReq))
+		flusher.Flush()
+	}
 
-	var buffer, fullResponse strings.Builder
 	blockIndex := 0
 	toolCount := 0
 
-	// 发送工具调用的辅助函数
-	sendToolCall := func(toolName, argsJSON string) {
-		toolID := fmt.Sprintf("toolu_%d", toolCount)
-		toolCount++
+	// 当前 thinking 块的内容，结束时据此生成签名
+	var thinkingText strings.Builder
+	thinkingBlockStarted := false
+
+	// 结束当前 thinking 块，先发送签名
+	stopThinking := func() {
+		if thinkingBlockStarted {
+			_, _ = c.Writer.WriteString("event: content_block_delta\n")
+			_, _ = fmt.Fprintf(c.Writer, `data: {"type":"content_block_delta","index":%d,"delta":{"type":"signature_delta","signature":"%s"}}`+"\n\n", blockIndex, thinkingSignature(thinkingText.String()))
+			_, _ = c.Writer.WriteString("event: content_block_stop\n")
+			_, _ = fmt.Fprintf(c.Writer, `data: {"type":"content_block_stop","index":%d}`+"\n\n", blockIndex)
+			blockIndex++
+			thinkingBlockStarted = false
+		}
+	}
 
-		var args map[string]any
-		_ = json.Unmarshal([]byte(argsJSON), &args)
-		inputJSON, _ := json.Marshal(args)
-		partialJSONStr, _ := json.Marshal(string(inputJSON))
+	// 标记是否已发送文本块开始
+	textBlockStarted := false
 
-		_, _ = c.Writer.WriteString("event: content_block_start\n")
-		_, _ = fmt.Fprintf(c.Writer, `data: {"type":"content_block_start","index":%d,"content_block":{"type":"tool_use","id":"%s","name":"%s","input":{}}}`+"\n\n", blockIndex, toolID, toolName)
+	// 发送文本的辅助函数
+	sendText := func(text string) {
+		stopThinking()
+		if !textBlockStarted {
+			_, _ = c.Writer.WriteString("event: content_block_start\n")
+			_, _ = fmt.Fprintf(c.Writer, `data: {"type":"content_block_start","index":%d,"content_block":{"type":"text","text":""}}`+"\n\n", blockIndex)
+			textBlockStarted = true
+		}
+
+		textJSON, _ := json.Marshal(text)
 		_, _ = c.Writer.WriteString("event: content_block_delta\n")
-		_, _ = fmt.Fprintf(c.Writer, `data: {"type":"content_block_delta","index":%d,"delta":{"type":"input_json_delta","partial_json":%s}}`+"\n\n", blockIndex, string(partialJSONStr))
-		_, _ = c.Writer.WriteString("event: content_block_stop\n")
-		_, _ = fmt.Fprintf(c.Writer, `data: {"type":"content_block_stop","index":%d}`+"\n\n", blockIndex)
-		blockIndex++
-		flusher.Flush()
+		_, _ = fmt.Fprintf(c.Writer, `data: {"type":"content_block_delta","index":%d,"delta":{"type":"text_delta","text":%s}}`+"\n\n", blockIndex, string(textJSON))
 	}
 
-	// 标记是否已发送文本块开始
-	textBlockStarted := false
+	// 结束当前文本块
+	stopText := func() {
+		if textBlockStarted {
+			_, _ = c.Writer.WriteString("event: content_block_stop\n")
+			_, _ = fmt.Fprintf(c.Writer, `data: {"type":"content_block_stop","index":%d}`+"\n\n", blockIndex)
+			blockIndex++
+			textBlockStarted = false
+		}
+	}
 
-	svc := client.GetService()
-	err := svc.SendStreamRequestWithIP(cursorReq, func(chunk string) {
-		buffer.WriteString(chunk)
-		content := buffer.String()
-		lines := strings.Split(content, "\n")
+	// 输出推理内容，先结束文本块，thinking 块使用新的 index
+	writeThinking := func(text string) {
+		stopText()
+		if !thinkingBlockStarted {
+			_, _ = c.Writer.WriteString("event: content_block_start\n")
+			_, _ = fmt.Fprintf(c.Writer, `data: {"type":"content_block_start","index":%d,"content_block":{"type":"thinking","thinking":""}}`+"\n\n", blockIndex)
+			thinkingBlockStarted = true
+			thinkingText.Reset()
+		}
+		thinkingText.WriteString(text)
 
-		if !strings.HasSuffix(content, "\n") && len(lines) > 0 {
-			buffer.Reset()
-			buffer.WriteString(lines[len(lines)-1])
-			lines = lines[:len(lines)-1]
-		} else {
-			buffer.Reset()
+		textJSON, _ := json.Marshal(text)
+		_, _ = c.Writer.WriteString("event: content_block_delta\n")
+		_, _ = fmt.Fprintf(c.Writer, `data: {"type":"content_block_delta","index":%d,"delta":{"type":"thinking_delta","thinking":%s}}`+"\n\n", blockIndex, string(textJSON))
+	}
+
+	// 当前的 tool_use 块，调用块未闭合时就已开始输出
+	var (
+		toolArgs *toolify.ArgumentStream // 非 nil 表示 tool_use 块已开始
+		skipTool bool                    // disable_parallel_tool_use 时丢弃当前调用
+
+		// tool_use 块未结束时到达的推理内容，块结束后再输出
+		heldThinking []string
+	)
+
+	// 输出推理内容，tool_use 块未结束时先留着
+	showThinking := func(text string) {
+		if toolArgs != nil {
+			heldThinking = append(heldThinking, text)
+			return
 		}
+		writeThinking(text)
+	}
 
-		for _, line := range lines {
-			if !strings.HasPrefix(line, "data: ") {
-				continue
-			}
-			data := strings.TrimPrefix(line, "data: ")
-			if data == "" {
-				continue
-			}
+	// 开始 tool_use 块，disable_parallel_tool_use 时只允许一个调用
+	startToolCall := func(name string) bool {
+		if ts.choice.DisableParallel && toolCount > 0 {
+			log.Debug("[Anthropic] disable_parallel_tool_use, 丢弃工具调用 %s", name)
+			return false
+		}
+		stopThinking()
+		stopText()
+		toolID := newToolUseID()
+		h.calls.record(toolID, name)
+		toolCount++
+		toolArgs = &toolify.ArgumentStream{}
+
+		nameJSON, _ := json.Marshal(name)
+		_, _ = c.Writer.WriteString("event: content_block_start\n")
+		_, _ = fmt.Fprintf(c.Writer, `data: {"type":"content_block_start","index":%d,"content_block":{"type":"tool_use","id":"%s","name":%s,"input":{}}}`+"\n\n", blockIndex, toolID, nameJSON)
+		return true
+	}
+
+	// 输出 input_json_delta
+	sendArguments := func(chunks []string) {
+		for _, chunk := range chunks {
+			partialJSONStr, _ := json.Marshal(chunk)
+			_, _ = c.Writer.WriteString("event: content_block_delta\n")
+			_, _ = fmt.Fprintf(c.Writer, `data: {"type":"content_block_delta","index":%d,"delta":{"type":"input_json_delta","partial_json":%s}}`+"\n\n", blockIndex, string(partialJSONStr))
+		}
+	}
+
+	// 调用块未闭合时提前开始 tool_use 块，并输出已写完的参数
+	sendProgress := func(progress toolify.CallProgress) {
+		if skipTool {
+			return
+		}
+		if toolArgs == nil && !startToolCall(progress.Name) {
+			skipTool = true
+			return
+		}
+		sendArguments(toolArgs.Next(progress.Arguments))
+	}
+
+	// 发送工具调用，参数按字段分片输出 input_json_delta；已提前开始的块只补齐剩余参数
+	sendToolCall := func(call toolify.ToolCall) {
+		if skipTool {
+			skipTool = false
+			return
+		}
+		if toolArgs == nil && !startToolCall(call.Function.Name) {
+			return
+		}
+		sendArguments(toolArgs.Finish(call.Function.Arguments))
+		toolArgs = nil
+		_, _ = c.Writer.WriteString("event: content_block_stop\n")
+		_, _ = fmt.Fprintf(c.Writer, `data: {"type":"content_block_stop","index":%d}`+"\n\n", blockIndex)
+		blockIndex++
+		for _, text := range heldThinking {
+			writeThinking(text)
+		}
+		heldThinking = nil
+	}
 
-			var event CursorSSEEvent
-			if err := json.Unmarshal([]byte(data), &event); err != nil {
+	// 输出解析器产生的文本和工具调用
+	// 参数需要修正的工具调用及其后的内容先暂存，流结束修正后再按原顺序输出
+	var deferred []toolify.StreamEvent
+	emitEvent := func(ev toolify.StreamEvent) {
+		switch {
+		case ev.ToolCall != nil:
+			sendToolCall(*ev.ToolCall)
+		case ev.Progress != nil:
+			sendProgress(*ev.Progress)
+		default:
+			sendText(ev.Text)
+		}
+	}
+	sendEvents := func(events []toolify.StreamEvent) {
+		for _, ev := range events {
+			if !acceptStreamEvent(ev, ts.choice) {
 				continue
 			}
+			if len(deferred) > 0 || (ev.ToolCall != nil && h.needsRepair(*ev.ToolCall)) {
+				deferred = append(deferred, ev)
+			} else {
+				emitEvent(ev)
+			}
+		}
+		if len(events) > 0 {
+			flusher.Flush()
+		}
+	}
 
-			if event.Type == "text-delta" && event.Delta != "" {
-				fullResponse.WriteString(event.Delta)
-
-				// 实时发送文本块
-				if !textBlockStarted {
-					_, _ = c.Writer.WriteString("event: content_block_start\n")
-					_, _ = fmt.Fprintf(c.Writer, `data: {"type":"content_block_start","index":%d,"content_block":{"type":"text","text":""}}`+"\n\n", blockIndex)
-					textBlockStarted = true
-				}
+	// 有暂存的工具调用时到达的推理内容，at 为它之前暂存的事件数，修正后按原位置输出
+	type pendingThinking struct {
+		at   int
+		text string
+	}
+	var deferredThinking []pendingThinking
+
+	// 推理内容先让过滤器输出暂存的正文，保证两者按模型输出的顺序
+	sendThinking := func(text string) {
+		sendEvents(filter.interrupt())
+		if len(deferred) > 0 {
+			deferredThinking = append(deferredThinking, pendingThinking{at: len(deferred), text: text})
+			return
+		}
+		showThinking(text)
+	}
 
-				textJSON, _ := json.Marshal(event.Delta)
-				_, _ = c.Writer.WriteString("event: content_block_delta\n")
-				_, _ = fmt.Fprintf(c.Writer, `data: {"type":"content_block_delta","index":%d,"delta":{"type":"text_delta","text":%s}}`+"\n\n", blockIndex, string(textJSON))
+	// 收到第一段内容前失败时回退到下一个模型
+	err := h.routeModels(requestContext(c), route.chain, func(m config.ModelConfig) (bool, error) {
+		ts, cursorReq = route.prepare(m)
+		result = &cursorResult{}
+		filter = newOutputFilter(ts)
+		served = m
+
+		// 文本实时发送，工具调用在工具名和每个参数写完时逐步输出
+		err := h.streamWithStops(requestContext(c), cursorReq, filter, func(event sse.Event) {
+			result.apply(event)
+
+			switch {
+			case event.Type == sse.TypeReasoningDelta && event.Delta != "" && thinking:
+				// 开启扩展思考时推理内容作为 thinking 块实时发送
+				start()
+				sendThinking(event.Delta)
 				flusher.Flush()
+			case event.Type == sse.TypeTextDelta && event.Delta != "":
+				start()
 			}
+		}, sendEvents, clientIP)
+		if err == nil {
+			// 上游返回了错误事件
+			err = result.err
 		}
-	}, clientIP)
+		return started, err
+	})
 
 	if err != nil {
-		_, _ = c.Writer.WriteString("event: error\n")
-		_, _ = c.Writer.WriteString(`data: {"type":"error","error":{"message":"` + err.Error() + `"}}` + "\n\n")
-		flusher.Flush()
+		if c.Request.Context().Err() != nil {
+			log.Info("[Anthropic] 客户端已断开，中止上游请求")
+			return
+		}
+		start()
+		stopThinking()
+		stopText()
+		writeStreamError(c, flusher, err)
 		return
 	}
-
-	// 结束文本块
-	if textBlockStarted {
-		_, _ = c.Writer.WriteString("event: content_block_stop\n")
-		_, _ = fmt.Fprintf(c.Writer, `data: {"type":"content_block_stop","index":%d}`+"\n\n", blockIndex)
+	start()
+
+	// 输出缓冲区中剩余的内容，修正暂存的工具调用，然后结束文本块
+	sendEvents(filter.flush())
+	filter.truncate(result)
+	stopSeq := filter.matched
+	if len(deferred) > 0 {
+		events := h.repairStreamEvents(requestContext(c), cursorReq, ts, deferred, clientIP)
+		deferred = nil
+		// 修正后仍不合法的调用也照常输出，不能再次暂存
+		for i, ev := range events {
+			for len(deferredThinking) > 0 && deferredThinking[0].at == i {
+				showThinking(deferredThinking[0].text)
+				deferredThinking = deferredThinking[1:]
+			}
+			emitEvent(ev)
+		}
+		for _, pending := range deferredThinking {
+			showThinking(pending.text)
+		}
+		deferredThinking = nil
 		flusher.Flush()
-		blockIndex++
 	}
 
-	// 解析完整响应检查工具调用
-	responseText := fullResponse.String()
-	toolCalls, _ := toolify.ParseToolCalls(responseText)
+	// tool_choice 要求调用工具但模型没有调用
+	if ts.choice.Required() && toolCount == 0 {
+		calls, err := h.forceToolCall(requestContext(c), cursorReq, ts, result.Text(), clientIP)
+		if err != nil {
+			stopText()
+			writeStreamError(c, flusher, err)
+			return
+		}
+		for _, call := range calls {
+			sendToolCall(call)
+		}
+	}
+	stopThinking()
+	stopText()
+	flusher.Flush()
 
-	// 发送工具调用
-	stopReason := "end_turn"
-	if len(toolCalls) > 0 {
+	stopReason := anthropicStopReason(result.finishReason)
+	stopSeqJSON := []byte("null")
+	if toolCount > 0 {
 		stopReason = "tool_use"
-		for _, call := range toolCalls {
-			sendToolCall(call.Function.Name, call.Function.Arguments)
-		}
+	} else if stopSeq != "" {
+		stopReason = "stop_sequence"
+		stopSeqJSON, _ = json.Marshal(stopSeq)
 	}
 
 	_, _ = c.Writer.WriteString("event: message_delta\n")
-	_, _ = fmt.Fprintf(c.Writer, `data: {"type":"message_delta","delta":{"stop_reason":"%s","stop_sequence":null},"usage":{"output_tokens":100}}`+"\n\n", stopReason)
+	usage := countUsage(served, cursorReq, result)
+	_, _ = fmt.Fprintf(c.Writer, `data: {"type":"message_delta","delta":{"stop_reason":"%s","stop_sequence":%s},"usage":{"output_tokens":%d}}`+"\n\n", stopReason, stopSeqJSON, usage.output)
 	_, _ = c.Writer.WriteString("event: message_stop\n")
 	_, _ = c.Writer.WriteString(`data: {"type":"message_stop"}` + "\n\n")
 	flusher.Flush()
 }
 
 // handleNonStream 处理非流式请求
-func handleNonStream(c *gin.Context, cursorReq client.CursorChatRequest, model string, tools []toolify.ToolDefinition, clientIP string) {
-	svc := client.GetService()
-	result, err := svc.SendRequestWithIP(cursorReq, clientIP)
+func (h *Handler) handleNonStream(c *gin.Context, route *modelRoute, model string, thinking bool, clientIP string) {
+	var (
+		ts        toolSetup
+		cursorReq client.CursorChatRequest
+		result    *cursorResult
+		filter    *outputFilter
+		served    config.ModelConfig
+	)
+	err := h.routeModels(requestContext(c), route.chain, func(m config.ModelConfig) (bool, error) {
+		ts, cursorReq = route.prepare(m)
+		filter = newOutputFilter(ts)
+		served = m
+		var err error
+		result, err = h.completeRequest(requestContext(c), cursorReq, filter, clientIP)
+		if err != nil {
+			return false, err
+		}
+		if result.err != nil {
+			return false, result.err
+		}
+		c.Header(servedModelHeader, m.ID)
+		return false, nil
+	})
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": gin.H{"message": err.Error()}})
+		if result != nil {
+			c.JSON(http.StatusBadGateway, gin.H{"type": "error", "error": gin.H{"type": "api_error", "message": err.Error()}})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": gin.H{"message": err.Error()}})
+		}
 		return
 	}
 
-	// 解析响应
-	var fullText strings.Builder
-	lines := strings.Split(result, "\n")
-	for _, line := range lines {
-		if !strings.HasPrefix(line, "data: ") {
-			continue
-		}
-		data := strings.TrimPrefix(line, "data: ")
-		if data == "" {
-			continue
-		}
+	responseText := result.Text()
+	var contentBlocks []ContentBlock
+	stopReason := anthropicStopReason(result.finishReason)
+
+	// 开启扩展思考时推理内容作为 thinking 块放在最前面
+	if reasoning := result.Reasoning(); thinking && reasoning != "" {
+		contentBlocks = append(contentBlocks, ContentBlock{
+			Type:      "thinking",
+			Thinking:  reasoning,
+			Signature: thinkingSignature(reasoning),
+		})
+	}
 
-		var event CursorSSEEvent
-		if err := json.Unmarshal([]byte(data), &event); err != nil {
+	// 检测工具调用，文本块和 tool_use 块保持模型输出的顺序
+	segments, err := h.toolSegments(requestContext(c), cursorReq, ts, responseText, clientIP)
+	if err != nil {
+		c.JSON(http.StatusBadGateway, gin.H{"type": "error", "error": gin.H{"type": "api_error", "message": err.Error()}})
+		return
+	}
+	if segments == nil {
+		contentBlocks = append(contentBlocks, ContentBlock{Type: "text", Text: responseText})
+	}
+	for _, seg := range segments {
+		if seg.ToolCall == nil {
+			if text := strings.TrimSpace(seg.Text); text != "" {
+				contentBlocks = append(contentBlocks, ContentBlock{Type: "text", Text: text})
+			}
 			continue
 		}
-
-		if event.Type == "text-delta" && event.Delta != "" {
-			fullText.WriteString(event.Delta)
-		}
+		call := seg.ToolCall
+		toolID := newToolUseID()
+		h.calls.record(toolID, call.Function.Name)
+		contentBlocks = append(contentBlocks, ContentBlock{
+			Type:  "tool_use",
+			ID:    toolID,
+			Name:  call.Function.Name,
+			Input: json.RawMessage(call.Function.Arguments),
+		})
+		stopReason = "tool_use"
 	}
 
-	responseText := fullText.String()
-	var contentBlocks []ContentBlock
-	stopReason := "end_turn"
-
-	// 检测工具调用
-	if len(tools) > 0 {
-		toolCalls, cleanText := toolify.ParseToolCalls(responseText)
-		if len(toolCalls) > 0 {
-			stopReason = "tool_use"
-			if cleanText != "" {
-				contentBlocks = append(contentBlocks, ContentBlock{Type: "text", Text: cleanText})
-			}
-			for _, call := range toolCalls {
-				var args map[string]any
-				_ = json.Unmarshal([]byte(call.Function.Arguments), &args)
-				contentBlocks = append(contentBlocks, ContentBlock{
-					Type:  "tool_use",
-					ID:    "toolu_" + call.ID,
-					Name:  call.Function.Name,
-					Input: args,
-				})
-			}
-		} else {
-			contentBlocks = append(contentBlocks, ContentBlock{Type: "text", Text: responseText})
-		}
-	} else {
-		contentBlocks = append(contentBlocks, ContentBlock{Type: "text", Text: responseText})
+	// 已经输出了工具调用时仍报告 tool_use，客户端据此执行工具
+	var stopSequence *string
+	if stopSeq := filter.matched; stopSeq != "" && stopReason != "tool_use" {
+		stopReason = "stop_sequence"
+		stopSequence = &stopSeq
 	}
 
 	c.JSON(http.StatusOK, MessagesResponse{
-		ID:         "msg_" + generateID(),
-		Type:       "message",
-		Role:       "assistant",
-		Content:    contentBlocks,
-		Model:      model,
-		StopReason: stopReason,
-		Usage:      Usage{InputTokens: 100, OutputTokens: 100},
+		ID:           "msg_" + generateID(),
+		Type:         "message",
+		Role:         "assistant",
+		Content:      contentBlocks,
+		Model:        model,
+		StopReason:   stopReason,
+		StopSequence: stopSequence,
+		Usage:        anthropicUsage(countUsage(served, cursorReq, result)),
 	})
 }
+
+// anthropicUsage 转换为 Anthropic 格式的用量
+func anthropicUsage(usage tokenUsage) Usage {
+	return Usage{InputTokens: usage.input, OutputTokens: usage.output}
+}
+
+// thinkingSignature 生成 thinking 块的签名
+// Cursor 不返回签名，客户端回传的 thinking 块也不会转发给上游，这里只需要一个与内容对应的不透明值
+func thinkingSignature(thinking string) string {
+	sum := sha256.Sum256([]byte(thinking))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// writeStreamError 发送 Anthropic 流式错误事件
+func writeStreamError(c *gin.Context, flusher http.Flusher, err error) {
+	errJSON, _ := json.Marshal(gin.H{"type": "error", "error": gin.H{"type": "api_error", "message": err.Error()}})
+	_, _ = c.Writer.WriteString("event: error\n")
+	_, _ = fmt.Fprintf(c.Writer, "data: %s\n\n", errJSON)
+	flusher.Flush()
+}
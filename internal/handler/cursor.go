@@ -0,0 +1,142 @@
+// Package handler 提供 HTTP 请求处理器
+// 包含 Cursor SSE 事件的解析
+package handler
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"cursor2api/internal/sse"
+)
+
+// knownEventTypes 已知但不需要处理的事件类型
+var knownEventTypes = map[string]bool{
+	"start":           true,
+	"start-step":      true,
+	"text-start":      true,
+	"text-end":        true,
+	"reasoning-start": true,
+	"reasoning-end":   true,
+	"abort":           true,
+}
+
+// seenUnknownTypes 已记录过日志的未知事件类型
+var seenUnknownTypes sync.Map
+
+// cursorResult 汇总一次 Cursor 响应中的事件
+type cursorResult struct {
+	text         strings.Builder
+	reasoning    strings.Builder
+	finishReason string
+	err          error
+	usage        *sse.Usage
+}
+
+// apply 记录一个事件
+func (r *cursorResult) apply(event sse.Event) {
+	switch event.Type {
+	case sse.TypeTextDelta:
+		r.text.WriteString(event.Delta)
+	case sse.TypeReasoningDelta:
+		r.reasoning.WriteString(event.Delta)
+	case sse.TypeFinish, sse.TypeFinishStep:
+		if event.FinishReason != "" {
+			r.finishReason = event.FinishReason
+		}
+		r.applyUsage(event)
+	case sse.TypeMessageMetadata:
+		r.applyUsage(event)
+	case sse.TypeError:
+		msg := event.ErrorText
+		if msg == "" {
+			msg = "unknown upstream error"
+		}
+		log.Error("Cursor 返回错误事件: %s", msg)
+		r.err = fmt.Errorf("upstream error: %s", msg)
+	default:
+		if !knownEventTypes[event.Type] && !strings.HasPrefix(event.Type, "data-") {
+			if _, seen := seenUnknownTypes.LoadOrStore(event.Type, true); !seen {
+				log.Warn("未知的 Cursor 事件类型: %s", event.Type)
+			}
+		}
+	}
+}
+
+// applyUsage 从事件或 messageMetadata 中提取用量
+func (r *cursorResult) applyUsage(event sse.Event) {
+	if event.Usage != nil {
+		r.usage = event.Usage
+		return
+	}
+	raw, ok := event.MessageMetadata["usage"].(map[string]interface{})
+	if !ok {
+		return
+	}
+	usage := &sse.Usage{
+		InputTokens:  intField(raw, "inputTokens", "promptTokens", "input_tokens"),
+		OutputTokens: intField(raw, "outputTokens", "completionTokens", "output_tokens"),
+	}
+	if usage.InputTokens > 0 || usage.OutputTokens > 0 {
+		r.usage = usage
+	}
+}
+
+// intField 按顺序取第一个存在的数字字段
+func intField(m map[string]interface{}, keys ...string) int {
+	for _, key := range keys {
+		if v, ok := m[key].(float64); ok {
+			return int(v)
+		}
+	}
+	return 0
+}
+
+// Text 返回累计的正文
+func (r *cursorResult) Text() string {
+	return r.text.String()
+}
+
+// Reasoning 返回累计的推理内容
+func (r *cursorResult) Reasoning() string {
+	return r.reasoning.String()
+}
+
+// parseCursorResponse 解析完整的 SSE 响应体
+func parseCursorResponse(body string) *cursorResult {
+	result := &cursorResult{}
+	decoder := sse.NewDecoder(strings.NewReader(body))
+	for event := range decoder.Events() {
+		result.apply(event)
+	}
+	if n := decoder.Skipped(); n > 0 {
+		log.Debug("跳过 %d 个无法解析的 Cursor 事件", n)
+	}
+	return result
+}
+
+// anthropicStopReason 将上游 finishReason 映射为 Anthropic stop_reason
+func anthropicStopReason(finishReason string) string {
+	switch finishReason {
+	case "length":
+		return "max_tokens"
+	case "tool-calls":
+		return "tool_use"
+	default:
+		return "end_turn"
+	}
+}
+
+// openAIFinishReason 将上游 finishReason 映射为 OpenAI finish_reason
+func openAIFinishReason(finishReason string) string {
+	switch finishReason {
+	case "length":
+		return "length"
+	case "content-filter":
+		return "content_filter"
+	case "tool-calls":
+		return "tool_calls"
+	default:
+		return "stop"
+	}
+}
@@ -0,0 +1,100 @@
+package handler
+
+import (
+	"reflect"
+	"testing"
+
+	"cursor2api/internal/sse"
+)
+
+func TestCursorResultApply(t *testing.T) {
+	cases := []struct {
+		name   string
+		events []sse.Event
+		text   string
+		finish string
+		usage  *sse.Usage
+		err    string
+	}{
+		{
+			"text and reasoning",
+			[]sse.Event{{Type: sse.TypeReasoningDelta, Delta: "hm"}, {Type: sse.TypeTextDelta, Delta: "a"}, {Type: sse.TypeTextDelta, Delta: "b"}},
+			"ab", "", nil, "",
+		},
+		{
+			"finish-step then finish without a reason",
+			[]sse.Event{{Type: sse.TypeFinishStep, FinishReason: "length"}, {Type: sse.TypeFinish}},
+			"", "length", nil, "",
+		},
+		{
+			"usage on finish",
+			[]sse.Event{{Type: sse.TypeFinish, FinishReason: "stop", Usage: &sse.Usage{InputTokens: 5, OutputTokens: 7}}},
+			"", "stop", &sse.Usage{InputTokens: 5, OutputTokens: 7}, "",
+		},
+		{
+			"usage in message metadata",
+			[]sse.Event{{Type: sse.TypeMessageMetadata, MessageMetadata: map[string]interface{}{
+				"usage": map[string]interface{}{"promptTokens": float64(4), "completionTokens": float64(2)},
+			}}},
+			"", "", &sse.Usage{InputTokens: 4, OutputTokens: 2}, "",
+		},
+		{
+			"metadata without usage",
+			[]sse.Event{{Type: sse.TypeMessageMetadata, MessageMetadata: map[string]interface{}{"model": "x"}}},
+			"", "", nil, "",
+		},
+		{
+			"error event",
+			[]sse.Event{{Type: sse.TypeTextDelta, Delta: "a"}, {Type: sse.TypeError, ErrorText: "rate limited"}},
+			"a", "", nil, "upstream error: rate limited",
+		},
+		{
+			"error without text",
+			[]sse.Event{{Type: sse.TypeError}},
+			"", "", nil, "upstream error: unknown upstream error",
+		},
+		{
+			"known and unknown types are ignored",
+			[]sse.Event{{Type: "start-step"}, {Type: "data-usage"}, {Type: "brand-new"}, {Type: sse.TypeTextDelta, Delta: "a"}},
+			"a", "", nil, "",
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			var r cursorResult
+			for _, ev := range tc.events {
+				r.apply(ev)
+			}
+			if r.Text() != tc.text || r.finishReason != tc.finish || !reflect.DeepEqual(r.usage, tc.usage) {
+				t.Errorf("text = %q, finish = %q, usage = %+v", r.Text(), r.finishReason, r.usage)
+			}
+			errText := ""
+			if r.err != nil {
+				errText = r.err.Error()
+			}
+			if errText != tc.err {
+				t.Errorf("err = %q, want %q", errText, tc.err)
+			}
+		})
+	}
+}
+
+func TestFinishReasonMapping(t *testing.T) {
+	cases := []struct {
+		upstream, anthropic, openai string
+	}{
+		{"stop", "end_turn", "stop"},
+		{"length", "max_tokens", "length"},
+		{"tool-calls", "tool_use", "tool_calls"},
+		{"content-filter", "end_turn", "content_filter"},
+		{"", "end_turn", "stop"},
+	}
+	for _, tc := range cases {
+		if got := anthropicStopReason(tc.upstream); got != tc.anthropic {
+			t.Errorf("anthropicStopReason(%q) = %q, want %q", tc.upstream, got, tc.anthropic)
+		}
+		if got := openAIFinishReason(tc.upstream); got != tc.openai {
+			t.Errorf("openAIFinishReason(%q) = %q, want %q", tc.upstream, got, tc.openai)
+		}
+	}
+}
@@ -0,0 +1,75 @@
+package handler
+
+import (
+	"context"
+
+	"cursor2api/internal/client"
+	"cursor2api/internal/config"
+)
+
+// servedModelHeader 响应头，报告实际处理请求的模型 ID
+const servedModelHeader = "X-Served-Model"
+
+// modelRoute 一次请求按顺序尝试的模型
+// prepare 为每个模型生成工具设置和 Cursor 请求（不同模型的工具调用格式可能不同）
+type modelRoute struct {
+	chain   []config.ModelConfig
+	prepare func(model config.ModelConfig) (toolSetup, client.CursorChatRequest)
+}
+
+// modelChain 返回请求的模型及其回退链
+// 不满足请求（max_tokens、工具、扩展思考）的回退模型被跳过；不健康的模型排到最后，全部不健康时仍按原顺序尝试
+func (h *Handler) modelChain(model config.ModelConfig, needs modelNeeds) []config.ModelConfig {
+	chain := []config.ModelConfig{model}
+	seen := map[string]bool{model.ID: true}
+	for _, name := range model.Fallbacks {
+		fallback, merr := h.resolveModel(name, needs)
+		if merr != nil {
+			log.Debug("跳过回退模型 %s: %s", name, merr.message)
+			continue
+		}
+		if !seen[fallback.ID] {
+			seen[fallback.ID] = true
+			chain = append(chain, fallback)
+		}
+	}
+
+	var healthy, unhealthy []config.ModelConfig
+	for _, m := range chain {
+		if h.health.healthy(m.ID) {
+			healthy = append(healthy, m)
+		} else {
+			unhealthy = append(unhealthy, m)
+		}
+	}
+	if len(unhealthy) > 0 && len(healthy) > 0 {
+		log.Info("模型 %s 暂时不健康，优先使用 %s", unhealthy[0].ID, healthy[0].ID)
+	}
+	return append(healthy, unhealthy...)
+}
+
+// routeModels 按 chain 依次调用 send，直到某个模型成功
+// send 返回 committed 表示已经开始向客户端输出，此时失败也不再回退；客户端断开不计入模型错误
+func (h *Handler) routeModels(ctx context.Context, chain []config.ModelConfig, send func(model config.ModelConfig) (committed bool, err error)) error {
+	var err error
+	for i, m := range chain {
+		var committed bool
+		committed, err = send(m)
+		if ctx.Err() != nil {
+			return err
+		}
+		h.health.record(m.ID, err != nil)
+		if err == nil || committed {
+			return err
+		}
+		if i+1 < len(chain) {
+			log.Warn("模型 %s 请求失败: %v，回退到 %s", m.ID, err, chain[i+1].ID)
+		}
+	}
+	return err
+}
+
+// ModelStatus 返回各模型的健康状态
+func (h *Handler) ModelStatus() map[string]ModelStatus {
+	return h.health.status()
+}
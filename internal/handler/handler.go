@@ -0,0 +1,34 @@
+// Package handler 提供 HTTP 请求处理器
+package handler
+
+import (
+	"context"
+
+	"cursor2api/internal/client"
+	"cursor2api/internal/config"
+	"cursor2api/internal/sse"
+)
+
+// Upstream 上游聊天服务，client.Service 是其默认实现
+type Upstream interface {
+	// SendRequestWithIP 发送非流式请求，返回完整的 SSE 响应体
+	SendRequestWithIP(ctx context.Context, req client.CursorChatRequest, clientIP string) (string, error)
+	// SendStreamRequestWithIP 发送流式请求，每收到一个 SSE 事件调用一次 onEvent
+	SendStreamRequestWithIP(ctx context.Context, req client.CursorChatRequest, onEvent func(event sse.Event), clientIP string) error
+}
+
+// Handler HTTP 处理器集合
+type Handler struct {
+	upstream Upstream
+	cfg      *config.Config
+	calls    *toolCallLog // 已发出的工具调用，用于 tool_result 配对
+	health   *modelHealth // 各模型的错误率，用于回退链路由
+}
+
+// New 创建处理器
+func New(upstream Upstream) *Handler {
+	cfg := config.Get()
+	return &Handler{upstream: upstream, cfg: cfg, calls: newToolCallLog(), health: newModelHealth(cfg.ModelHealth)}
+}
+
+var _ Upstream = (*client.Service)(nil)
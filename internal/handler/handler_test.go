@@ -0,0 +1,204 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"cursor2api/internal/client"
+	"cursor2api/internal/config"
+	"cursor2api/internal/sse"
+
+	"github.com/gin-gonic/gin"
+)
+
+// fakeReply 假上游的一次回复
+type fakeReply struct {
+	events    []sse.Event // 按原顺序发送，用于推理和正文交替的回复
+	reasoning []string
+	deltas    []string
+	err       error
+}
+
+// fakeUpstream 按顺序返回预设回复的上游，最后一条回复会被重复使用
+type fakeUpstream struct {
+	mu       sync.Mutex
+	replies  []fakeReply
+	fail     map[string]error // 按 Cursor 模型 ID 返回错误
+	requests []client.CursorChatRequest
+	ips      []string
+	aborted  bool // 流式请求是否在读完前被取消
+}
+
+func (f *fakeUpstream) next(req client.CursorChatRequest, clientIP string) (fakeReply, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.requests = append(f.requests, req)
+	f.ips = append(f.ips, clientIP)
+	if err := f.fail[req.Model]; err != nil {
+		return fakeReply{}, err
+	}
+	if len(f.replies) == 0 {
+		return fakeReply{}, nil
+	}
+	reply := f.replies[0]
+	if len(f.replies) > 1 {
+		f.replies = f.replies[1:]
+	}
+	return reply, reply.err
+}
+
+func (r fakeReply) stream() []sse.Event {
+	events := append([]sse.Event(nil), r.events...)
+	for _, d := range r.reasoning {
+		events = append(events, sse.Event{Type: sse.TypeReasoningDelta, Delta: d})
+	}
+	for _, d := range r.deltas {
+		events = append(events, sse.Event{Type: sse.TypeTextDelta, Delta: d})
+	}
+	return append(events, sse.Event{Type: sse.TypeFinish, FinishReason: "stop"})
+}
+
+func (f *fakeUpstream) SendRequestWithIP(ctx context.Context, req client.CursorChatRequest, clientIP string) (string, error) {
+	reply, err := f.next(req, clientIP)
+	if err != nil {
+		return "", err
+	}
+	var b strings.Builder
+	for _, e := range reply.stream() {
+		data, _ := json.Marshal(e)
+		fmt.Fprintf(&b, "data: %s\n\n", data)
+	}
+	return b.String(), nil
+}
+
+func (f *fakeUpstream) SendStreamRequestWithIP(ctx context.Context, req client.CursorChatRequest, onEvent func(event sse.Event), clientIP string) error {
+	reply, err := f.next(req, clientIP)
+	if err != nil {
+		return err
+	}
+	for _, e := range reply.stream() {
+		if ctx.Err() != nil {
+			f.mu.Lock()
+			f.aborted = true
+			f.mu.Unlock()
+			return ctx.Err()
+		}
+		onEvent(e)
+	}
+	return nil
+}
+
+// newTestHandler 返回使用假上游和默认配置副本的处理器
+func newTestHandler(upstream Upstream, configure func(cfg *config.Config)) *Handler {
+	cfg := *config.Get()
+	cfg.ToolDialect = "xml"
+	cfg.ToolDialects = nil
+	cfg.ToolRepairRetries = 1
+	if configure != nil {
+		configure(&cfg)
+	}
+	return &Handler{upstream: upstream, cfg: &cfg, calls: newToolCallLog(), health: newModelHealth(cfg.ModelHealth)}
+}
+
+// serve 把 body 发到 h 的对应接口，返回响应
+func serve(h *Handler, path, body string) *httptest.ResponseRecorder {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.POST("/v1/messages", h.Messages)
+	r.POST("/v1/messages/count_tokens", h.CountTokens)
+	r.POST("/v1/chat/completions", h.ChatCompletions)
+
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Forwarded-For", "203.0.113.7")
+	r.ServeHTTP(w, req)
+	return w
+}
+
+// sseData 返回 SSE 响应中所有 data 行的内容
+func sseData(body string) []string {
+	var data []string
+	for _, line := range strings.Split(body, "\n") {
+		if rest, ok := strings.CutPrefix(line, "data: "); ok {
+			data = append(data, rest)
+		}
+	}
+	return data
+}
+
+func TestMessagesNonStream(t *testing.T) {
+	up := &fakeUpstream{replies: []fakeReply{{deltas: []string{"Hello", " world"}}}}
+	h := newTestHandler(up, nil)
+
+	w := serve(h, "/v1/messages", `{"model":"claude-4.5-sonnet","max_tokens":100,"messages":[{"role":"user","content":"hi"}]}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, body = %s", w.Code, w.Body)
+	}
+	var resp MessagesResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Content) != 1 || resp.Content[0].Text != "Hello world" || resp.StopReason != "end_turn" {
+		t.Fatalf("unexpected response: %s", w.Body)
+	}
+	if got := w.Header().Get(servedModelHeader); got != "claude-4.5-sonnet" {
+		t.Errorf("%s = %q", servedModelHeader, got)
+	}
+	if len(up.requests) != 1 || up.requests[0].Model != "claude-sonnet-4-5-20250929" {
+		t.Fatalf("upstream requests = %+v", up.requests)
+	}
+	if up.ips[0] != "203.0.113.7" {
+		t.Errorf("client IP = %q, want forwarded address", up.ips[0])
+	}
+}
+
+func TestChatCompletionsStream(t *testing.T) {
+	up := &fakeUpstream{replies: []fakeReply{{deltas: []string{"Hel", "lo"}}}}
+	h := newTestHandler(up, nil)
+
+	w := serve(h, "/v1/chat/completions", `{"model":"gpt-5.2","stream":true,"messages":[{"role":"user","content":"hi"}]}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, body = %s", w.Code, w.Body)
+	}
+	data := sseData(w.Body.String())
+	if len(data) == 0 || data[len(data)-1] != "[DONE]" {
+		t.Fatalf("stream not terminated: %s", w.Body)
+	}
+	var text strings.Builder
+	var finish string
+	for _, d := range data[:len(data)-1] {
+		var chunk ChatCompletionChunk
+		if err := json.Unmarshal([]byte(d), &chunk); err != nil {
+			t.Fatal(err)
+		}
+		for _, ch := range chunk.Choices {
+			if s, ok := ch.Delta.Content.(string); ok {
+				text.WriteString(s)
+			}
+			if ch.FinishReason != nil {
+				finish = *ch.FinishReason
+			}
+		}
+	}
+	if text.String() != "Hello" || finish != "stop" {
+		t.Fatalf("text = %q, finish = %q", text.String(), finish)
+	}
+	if up.ips[0] != "203.0.113.7" {
+		t.Errorf("client IP = %q, want forwarded address", up.ips[0])
+	}
+}
+
+func TestUnknownModel(t *testing.T) {
+	h := newTestHandler(&fakeUpstream{}, nil)
+	w := serve(h, "/v1/messages", `{"model":"no-such-model","max_tokens":10,"messages":[{"role":"user","content":"hi"}]}`)
+	if w.Code != http.StatusNotFound || !strings.Contains(w.Body.String(), "not_found_error") {
+		t.Fatalf("status = %d, body = %s", w.Code, w.Body)
+	}
+}
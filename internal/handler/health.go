@@ -0,0 +1,116 @@
+package handler
+
+import (
+	"sync"
+	"time"
+
+	"cursor2api/internal/config"
+)
+
+// modelHealth 按模型统计滚动窗口内的上游错误率
+// 错误率超过阈值的模型在冷却期内被视为不健康，回退链会优先绕开它
+type modelHealth struct {
+	mu     sync.Mutex
+	cfg    config.ModelHealthConfig
+	models map[string]*modelStats
+	now    func() time.Time // 测试中替换
+}
+
+type modelStats struct {
+	outcomes       []modelOutcome // 窗口内的请求结果，按时间排列
+	unhealthyUntil time.Time
+}
+
+type modelOutcome struct {
+	at     time.Time
+	failed bool
+}
+
+// ModelStatus 模型健康状态，用于 /status
+type ModelStatus struct {
+	Healthy        bool    `json:"healthy"`
+	Requests       int     `json:"requests"`
+	ErrorRate      float64 `json:"errorRate"`
+	UnhealthyUntil string  `json:"unhealthyUntil,omitempty"`
+}
+
+func newModelHealth(cfg config.ModelHealthConfig) *modelHealth {
+	return &modelHealth{cfg: cfg, models: make(map[string]*modelStats), now: time.Now}
+}
+
+// record 记录一次请求结果，错误率达到阈值时把模型标记为不健康
+func (mh *modelHealth) record(id string, failed bool) {
+	mh.mu.Lock()
+	defer mh.mu.Unlock()
+
+	now := mh.now()
+	stats := mh.stats(id, now)
+	stats.outcomes = append(stats.outcomes, modelOutcome{at: now, failed: failed})
+	if !failed {
+		return
+	}
+
+	requests, rate := stats.errorRate()
+	if requests >= mh.cfg.MinRequests && rate >= mh.cfg.ErrorRate && now.After(stats.unhealthyUntil) {
+		stats.unhealthyUntil = now.Add(time.Duration(mh.cfg.Cooldown) * time.Second)
+		stats.outcomes = nil // 冷却结束后重新统计
+		log.Warn("模型 %s 错误率 %.0f%% (%d 次请求)，%ds 内标记为不健康", id, rate*100, requests, mh.cfg.Cooldown)
+	}
+}
+
+// healthy 模型当前是否健康
+func (mh *modelHealth) healthy(id string) bool {
+	mh.mu.Lock()
+	defer mh.mu.Unlock()
+	stats, ok := mh.models[id]
+	return !ok || mh.now().After(stats.unhealthyUntil)
+}
+
+// status 返回所有有记录的模型的健康状态
+func (mh *modelHealth) status() map[string]ModelStatus {
+	mh.mu.Lock()
+	defer mh.mu.Unlock()
+
+	now := mh.now()
+	result := make(map[string]ModelStatus, len(mh.models))
+	for id := range mh.models {
+		stats := mh.stats(id, now)
+		requests, rate := stats.errorRate()
+		status := ModelStatus{Healthy: now.After(stats.unhealthyUntil), Requests: requests, ErrorRate: rate}
+		if !status.Healthy {
+			status.UnhealthyUntil = stats.unhealthyUntil.Format(time.RFC3339)
+		}
+		result[id] = status
+	}
+	return result
+}
+
+// stats 返回模型的统计数据，并丢弃窗口外的结果（调用方需持有锁）
+func (mh *modelHealth) stats(id string, now time.Time) *modelStats {
+	stats, ok := mh.models[id]
+	if !ok {
+		stats = &modelStats{}
+		mh.models[id] = stats
+	}
+	cutoff := now.Add(-time.Duration(mh.cfg.Window) * time.Second)
+	i := 0
+	for i < len(stats.outcomes) && stats.outcomes[i].at.Before(cutoff) {
+		i++
+	}
+	stats.outcomes = stats.outcomes[i:]
+	return stats
+}
+
+// errorRate 返回窗口内的请求数和错误率
+func (s *modelStats) errorRate() (int, float64) {
+	if len(s.outcomes) == 0 {
+		return 0, 0
+	}
+	failed := 0
+	for _, o := range s.outcomes {
+		if o.failed {
+			failed++
+		}
+	}
+	return len(s.outcomes), float64(failed) / float64(len(s.outcomes))
+}
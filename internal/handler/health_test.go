@@ -0,0 +1,102 @@
+package handler
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"cursor2api/internal/config"
+)
+
+func TestModelHealthTransitions(t *testing.T) {
+	// 每一步先把时间推进 after 秒，再记录结果（为空时只检查），最后检查是否健康
+	type step struct {
+		after   int
+		outcome string
+		healthy bool
+	}
+	fail := func(healthy bool) step { return step{outcome: "fail", healthy: healthy} }
+	ok := step{outcome: "ok", healthy: true}
+	cases := []struct {
+		name  string
+		steps []step
+	}{
+		{"too few requests", []step{fail(true), fail(true)}},
+		{"error rate reached", []step{fail(true), fail(true), fail(false)}},
+		{"below error rate", []step{ok, ok, ok, fail(true)}},
+		{"rate exactly at threshold", []step{ok, fail(true), ok, fail(false)}},
+		{"cooldown expires", []step{fail(true), fail(true), fail(false), {after: 29}, {after: 2, healthy: true}}},
+		{"failures during cooldown do not extend it", []step{fail(true), fail(true), fail(false), {after: 10, outcome: "fail"}, fail(false), fail(false), {after: 21, healthy: true}}},
+		{"counts restart after cooldown", []step{fail(true), fail(true), fail(false), {after: 31, outcome: "fail", healthy: true}, fail(true), fail(false)}},
+		{"old failures leave the window", []step{fail(true), fail(true), {after: 61, outcome: "fail", healthy: true}}},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			mh := newModelHealth(config.ModelHealthConfig{Window: 60, MinRequests: 3, ErrorRate: 0.5, Cooldown: 30})
+			now := time.Unix(1700000000, 0)
+			mh.now = func() time.Time { return now }
+			for i, s := range tc.steps {
+				now = now.Add(time.Duration(s.after) * time.Second)
+				if s.outcome != "" {
+					mh.record("m", s.outcome == "fail")
+				}
+				if got := mh.healthy("m"); got != s.healthy {
+					t.Fatalf("step %d: healthy = %v, want %v", i, got, s.healthy)
+				}
+			}
+		})
+	}
+}
+
+func TestModelHealthStatus(t *testing.T) {
+	mh := newModelHealth(config.ModelHealthConfig{Window: 60, MinRequests: 2, ErrorRate: 0.5, Cooldown: 30})
+	now := time.Unix(1700000000, 0).UTC()
+	mh.now = func() time.Time { return now }
+
+	mh.record("good", false)
+	mh.record("good", false)
+	mh.record("good", true)
+	mh.record("bad", true)
+	mh.record("bad", true)
+
+	status := mh.status()
+	if s := status["good"]; !s.Healthy || s.Requests != 3 || s.ErrorRate != 1.0/3 || s.UnhealthyUntil != "" {
+		t.Errorf("good = %+v", s)
+	}
+	if s := status["bad"]; s.Healthy || s.Requests != 0 || s.UnhealthyUntil != now.Add(30*time.Second).Format(time.RFC3339) {
+		t.Errorf("bad = %+v", s)
+	}
+	if !mh.healthy("never-used") {
+		t.Error("models without requests should be healthy")
+	}
+}
+
+func TestFallbackSkipsUnhealthyModel(t *testing.T) {
+	up := &fakeUpstream{
+		replies: []fakeReply{{deltas: []string{"ok"}}},
+		fail:    map[string]error{"primary": errors.New("upstream 503")},
+	}
+	h := newTestHandler(up, func(cfg *config.Config) {
+		cfg.Models = config.ModelList{{ID: "primary", Fallbacks: []string{"backup"}}, {ID: "backup"}}
+		cfg.ModelHealth = config.ModelHealthConfig{Window: 60, MinRequests: 2, ErrorRate: 0.5, Cooldown: 60}
+	})
+
+	body := `{"model":"primary","max_tokens":10,"messages":[{"role":"user","content":"hi"}]}`
+	var tried []int
+	for i := 0; i < 3; i++ {
+		before := len(up.requests)
+		w := serve(h, "/v1/messages", body)
+		if w.Code != http.StatusOK || w.Header().Get(servedModelHeader) != "backup" {
+			t.Fatalf("request %d: status = %d, served by %q", i, w.Code, w.Header().Get(servedModelHeader))
+		}
+		tried = append(tried, len(up.requests)-before)
+	}
+	// 两次失败后 primary 不健康，第三次直接使用 backup
+	if tried[0] != 2 || tried[1] != 2 || tried[2] != 1 {
+		t.Errorf("upstream requests per call = %v, want [2 2 1]", tried)
+	}
+	if h.ModelStatus()["primary"].Healthy {
+		t.Error("primary should be reported unhealthy")
+	}
+}
@@ -2,30 +2,30 @@
 package handler
 
 import (
+	"fmt"
 	"net/http"
 	"time"
 
+	"cursor2api/internal/config"
+
 	"github.com/gin-gonic/gin"
 )
 
-// SupportedModels 支持的模型列表
-var SupportedModels = []string{
-	"claude-4.5-opus",
-	"claude-4.5-sonnet",
-	"composer-1",
-	"gemini-3-flash",
-	"gemini-3-pro",
-	"gpt-5.1-codex-max",
-	"gpt-5.2",
-	"grok-code",
-}
-
 // Model 模型信息
 type Model struct {
-	ID      string `json:"id"`
-	Object  string `json:"object"`
-	Created int64  `json:"created"`
-	OwnedBy string `json:"owned_by"`
+	ID              string             `json:"id"`
+	Object          string             `json:"object"`
+	Created         int64              `json:"created"`
+	OwnedBy         string             `json:"owned_by"`
+	ContextWindow   int                `json:"context_window,omitempty"`
+	MaxOutputTokens int                `json:"max_output_tokens,omitempty"`
+	Capabilities    *ModelCapabilities `json:"capabilities,omitempty"`
+}
+
+// ModelCapabilities 模型能力
+type ModelCapabilities struct {
+	Tools    bool `json:"tools"`
+	Thinking bool `json:"thinking"`
 }
 
 // ModelsResponse 模型列表响应
@@ -34,18 +34,24 @@ type ModelsResponse struct {
 	Data   []Model `json:"data"`
 }
 
-// ListModels 返回支持的模型列表
-func ListModels(c *gin.Context) {
-	models := make([]Model, len(SupportedModels))
+// ListModels 返回注册表中已启用的模型
+func (h *Handler) ListModels(c *gin.Context) {
+	models := make([]Model, 0, len(h.cfg.Models))
 	now := time.Now().Unix()
 
-	for i, id := range SupportedModels {
-		models[i] = Model{
-			ID:      id,
-			Object:  "model",
-			Created: now,
-			OwnedBy: "cursor",
+	for _, m := range h.cfg.Models {
+		if !m.IsEnabled() {
+			continue
 		}
+		models = append(models, Model{
+			ID:              m.ID,
+			Object:          "model",
+			Created:         now,
+			OwnedBy:         "cursor",
+			ContextWindow:   m.ContextWindow,
+			MaxOutputTokens: m.MaxOutput,
+			Capabilities:    &ModelCapabilities{Tools: m.SupportsTools(), Thinking: m.Thinking},
+		})
 	}
 
 	c.JSON(http.StatusOK, ModelsResponse{
@@ -53,3 +59,58 @@ func ListModels(c *gin.Context) {
 		Data:   models,
 	})
 }
+
+// modelError 请求的模型不可用，或请求超出了模型的能力
+type modelError struct {
+	status  int
+	param   string
+	message string
+}
+
+func (e *modelError) Error() string {
+	return e.message
+}
+
+// modelNeeds 请求对模型能力的要求
+type modelNeeds struct {
+	maxTokens int
+	tools     bool
+	thinking  bool
+}
+
+// resolveModel 按 ID 或别名查找已启用的模型，并检查 max_tokens、工具和扩展思考是否超出模型能力
+func (h *Handler) resolveModel(name string, needs modelNeeds) (config.ModelConfig, *modelError) {
+	model, ok := h.cfg.Models.Find(name)
+	if !ok || !model.IsEnabled() {
+		return config.ModelConfig{}, &modelError{
+			status:  http.StatusNotFound,
+			param:   "model",
+			message: fmt.Sprintf("model %q does not exist or is not enabled", name),
+		}
+	}
+	if model.MaxOutput > 0 && needs.maxTokens > model.MaxOutput {
+		return config.ModelConfig{}, &modelError{
+			status:  http.StatusBadRequest,
+			param:   "max_tokens",
+			message: fmt.Sprintf("max_tokens: %d > %d, which is the maximum allowed number of output tokens for %s", needs.maxTokens, model.MaxOutput, model.ID),
+		}
+	}
+	if needs.tools && !model.SupportsTools() {
+		return config.ModelConfig{}, &modelError{
+			status:  http.StatusBadRequest,
+			param:   "tools",
+			message: fmt.Sprintf("model %s does not support tools", model.ID),
+		}
+	}
+	if needs.thinking && !model.Thinking {
+		return config.ModelConfig{}, &modelError{
+			status:  http.StatusBadRequest,
+			param:   "thinking",
+			message: fmt.Sprintf("model %s does not support extended thinking", model.ID),
+		}
+	}
+	if model.ID != name {
+		log.Debug("模型映射: %s -> %s (%s)", name, model.ID, model.Upstream())
+	}
+	return model, nil
+}
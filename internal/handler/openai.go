@@ -10,7 +10,10 @@ import (
 	"time"
 
 	"cursor2api/internal/client"
+	"cursor2api/internal/config"
 	"cursor2api/internal/logger"
+	"cursor2api/internal/sse"
+	"cursor2api/internal/toolify"
 
 	"github.com/gin-gonic/gin"
 )
@@ -19,17 +22,64 @@ var log = logger.Get().WithPrefix("Handler")
 
 // ChatCompletionRequest OpenAI Chat Completion 请求格式
 type ChatCompletionRequest struct {
-	Model       string          `json:"model"`
-	Messages    []OpenAIMessage `json:"messages"`
-	Stream      bool            `json:"stream"`
-	Temperature float64         `json:"temperature,omitempty"`
-	MaxTokens   int             `json:"max_tokens,omitempty"`
+	Model             string                   `json:"model"`
+	Messages          []OpenAIMessage          `json:"messages"`
+	Stream            bool                     `json:"stream"`
+	Temperature       float64                  `json:"temperature,omitempty"`
+	MaxTokens         int                      `json:"max_tokens,omitempty"`
+	Tools             []toolify.ToolDefinition `json:"tools,omitempty"`
+	ToolChoice        interface{}              `json:"tool_choice,omitempty"` // 可以是 string 或 {"type":"function",...}
+	ParallelToolCalls *bool                    `json:"parallel_tool_calls,omitempty"`
+	StreamOptions     *StreamOptions           `json:"stream_options,omitempty"`
+	ReasoningEffort   string                   `json:"reasoning_effort,omitempty"` // 非空且不为 none 时使用模型的思考版本
+	Stop              interface{}              `json:"stop,omitempty"`             // 可以是 string 或 []string
+}
+
+// stopSequences 返回请求的停止序列
+func (r ChatCompletionRequest) stopSequences() []string {
+	switch v := r.Stop.(type) {
+	case string:
+		return []string{v}
+	case []interface{}:
+		var stops []string
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				stops = append(stops, s)
+			}
+		}
+		return stops
+	default:
+		return nil
+	}
+}
+
+// StreamOptions 流式响应选项
+type StreamOptions struct {
+	IncludeUsage bool `json:"include_usage"` // 在 [DONE] 前发送一个带 usage 的块
 }
 
 // OpenAIMessage OpenAI 消息格式
 type OpenAIMessage struct {
-	Role    string `json:"role"`
-	Content string `json:"content"`
+	Role             string           `json:"role"`
+	Content          interface{}      `json:"content"`                     // 可以是 string、内容块数组或 null
+	ReasoningContent string           `json:"reasoning_content,omitempty"` // 仅响应，上游的推理内容
+	Name             string           `json:"name,omitempty"`
+	ToolCalls        []OpenAIToolCall `json:"tool_calls,omitempty"`   // assistant
+	ToolCallID       string           `json:"tool_call_id,omitempty"` // tool
+}
+
+// OpenAIToolCall 工具调用
+type OpenAIToolCall struct {
+	Index    *int               `json:"index,omitempty"` // 仅流式响应
+	ID       string             `json:"id,omitempty"`
+	Type     string             `json:"type,omitempty"`
+	Function OpenAIFunctionCall `json:"function"`
+}
+
+// OpenAIFunctionCall 工具调用的函数名和 JSON 参数
+type OpenAIFunctionCall struct {
+	Name      string `json:"name,omitempty"`
+	Arguments string `json:"arguments"`
 }
 
 // ChatCompletionResponse OpenAI Chat Completion 响应格式
@@ -64,6 +114,7 @@ type ChatCompletionChunk struct {
 	Created int64         `json:"created"`
 	Model   string        `json:"model"`
 	Choices []ChunkChoice `json:"choices"`
+	Usage   *OpenAIUsage  `json:"usage,omitempty"` // 仅 include_usage 的最后一块
 }
 
 // ChunkChoice 流式选项
@@ -74,33 +125,83 @@ type ChunkChoice struct {
 }
 
 // ChatCompletions 处理 OpenAI Chat Completions API 请求
-func ChatCompletions(c *gin.Context) {
+func (h *Handler) ChatCompletions(c *gin.Context) {
 	var req ChatCompletionRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
 
-	log.Info("[OpenAI] 请求: 模型=%s, 消息数=%d, 流式=%v", req.Model, len(req.Messages), req.Stream)
+	log.Info("[OpenAI] 请求: 模型=%s, 消息数=%d, 流式=%v, 工具数=%d", req.Model, len(req.Messages), req.Stream, len(req.Tools))
+
+	needs := modelNeeds{maxTokens: req.MaxTokens, tools: len(req.Tools) > 0}
+	model, merr := h.resolveModel(req.Model, needs)
+	if merr != nil {
+		errBody := gin.H{"message": merr.message, "type": "invalid_request_error", "param": merr.param}
+		if merr.status == http.StatusNotFound {
+			errBody["code"] = "model_not_found"
+		}
+		c.JSON(merr.status, gin.H{"error": errBody})
+		return
+	}
+
+	choice := toolify.ParseToolChoice(req.ToolChoice)
+	if req.ParallelToolCalls != nil && !*req.ParallelToolCalls {
+		choice.DisableParallel = true
+	}
+	if err := choice.Resolve(req.Tools); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": gin.H{"message": err.Error(), "type": "invalid_request_error", "param": "tool_choice"}})
+		return
+	}
+
+	// reasoning_effort 只用来选择思考版本，不支持扩展思考的模型忽略它
+	thinking := req.ReasoningEffort != "" && req.ReasoningEffort != "none"
+
+	// 按回退链依次尝试，每个模型单独转换为 Cursor 请求格式
+	route := &modelRoute{
+		chain: h.modelChain(model, needs),
+		prepare: func(m config.ModelConfig) (toolSetup, client.CursorChatRequest) {
+			ts := h.newToolSetup(m, req.Tools, choice, req.stopSequences())
+			return ts, h.convertOpenAIToCursor(req, ts, m.UpstreamFor(thinking && m.Thinking))
+		},
+	}
 
-	cursorReq := convertOpenAIToCursor(req)
+	clientIP := getClientIP(c)
+	log.Debug("[OpenAI] 客户端 IP: %s", clientIP)
 
 	if req.Stream {
-		handleOpenAIStream(c, cursorReq, req.Model)
+		includeUsage := req.StreamOptions != nil && req.StreamOptions.IncludeUsage
+		h.handleOpenAIStream(c, route, req.Model, includeUsage, clientIP)
 	} else {
-		handleOpenAINonStream(c, cursorReq, req.Model)
+		h.handleOpenAINonStream(c, route, req.Model, clientIP)
 	}
 }
 
 // convertOpenAIToCursor 将 OpenAI 请求转换为 Cursor 格式
-func convertOpenAIToCursor(req ChatCompletionRequest) client.CursorChatRequest {
-	messages := make([]client.CursorMessage, len(req.Messages))
-	for i, msg := range req.Messages {
-		messages[i] = client.CursorMessage{
-			Parts: []client.CursorPart{{Type: "text", Text: msg.Content}},
-			ID:    generateID(),
-			Role:  msg.Role,
+func (h *Handler) convertOpenAIToCursor(req ChatCompletionRequest, ts toolSetup, cursorModel string) client.CursorChatRequest {
+	toolPrompt := ""
+	if len(ts.tools) > 0 {
+		toolPrompt = toolify.GenerateToolPrompt(ts.dialect, ts.tools, ts.choice)
+		log.Info("[OpenAI] 注入工具提示词, 格式: %s, 长度: %d, 工具数: %d", ts.dialect.Name(), len(toolPrompt), len(ts.tools))
+	}
+
+	toolNames := h.toolCallNames(req.Messages)
+	messages := make([]client.CursorMessage, 0, len(req.Messages))
+	for _, msg := range req.Messages {
+		role, text := convertOpenAIMessage(msg, toolNames, ts.dialect)
+		if text == "" {
+			continue
+		}
+		// 把工具提示放在第一条用户消息前面
+		if role == "user" && toolPrompt != "" {
+			text = toolPrompt + "\n\n" + text
+			toolPrompt = ""
 		}
+		messages = append(messages, client.CursorMessage{
+			Parts: []client.CursorPart{{Type: "text", Text: text}},
+			ID:    generateID(),
+			Role:  role,
+		})
 	}
 
 	return client.CursorChatRequest{
@@ -109,73 +210,261 @@ func convertOpenAIToCursor(req ChatCompletionRequest) client.CursorChatRequest {
 			Content:  "",
 			FilePath: "/docs/",
 		}},
-		Model:    mapModelName(req.Model),
+		Model:    cursorModel,
 		ID:       generateID(),
 		Messages: messages,
 		Trigger:  "submit-message",
 	}
 }
 
-// handleOpenAIStream 处理 OpenAI 流式请求
-func handleOpenAIStream(c *gin.Context, cursorReq client.CursorChatRequest, model string) {
-	c.Header("Content-Type", "text/event-stream")
-	c.Header("Cache-Control", "no-cache")
-	c.Header("Connection", "keep-alive")
+// toolCallNames 收集历史中所有 tool_calls 的 id -> 函数名，用于 tool 消息配对
+// 历史中找不到的调用按代理之前发出的记录补全
+func (h *Handler) toolCallNames(messages []OpenAIMessage) map[string]string {
+	names := make(map[string]string)
+	var resultIDs []string
+	for _, msg := range messages {
+		for _, call := range msg.ToolCalls {
+			names[call.ID] = call.Function.Name
+		}
+		if msg.Role == "tool" {
+			resultIDs = append(resultIDs, msg.ToolCallID)
+		}
+	}
+	h.calls.resolve(names, resultIDs)
+	return names
+}
+
+// convertOpenAIMessage 将一条 OpenAI 消息转换为 Cursor 能理解的角色和文本
+// Cursor 只认识 system/user/assistant，其余角色需要折叠，工具调用和结果按 dialect 的格式还原
+func convertOpenAIMessage(msg OpenAIMessage, toolNames map[string]string, dialect toolify.Dialect) (role, text string) {
+	text = getTextContent(msg.Content)
+	switch msg.Role {
+	case "system", "developer":
+		return "system", text
+	case "tool":
+		return "user", dialect.RenderResult(msg.ToolCallID, toolNames[msg.ToolCallID], text, false)
+	case "function":
+		// 旧版 function calling 的结果
+		return "user", dialect.RenderResult("", msg.Name, text, false)
+	case "assistant":
+		// 工具调用消息的 content 通常为 null，按工具提示中的格式还原调用
+		var parts []string
+		if text != "" {
+			parts = append(parts, text)
+		}
+		for _, call := range msg.ToolCalls {
+			parts = append(parts, dialect.RenderCall(call.ID, call.Function.Name, call.Function.Arguments))
+		}
+		return "assistant", strings.Join(parts, "\n")
+	default:
+		return "user", text
+	}
+}
 
+// handleOpenAIStream 处理 OpenAI 流式请求
+func (h *Handler) handleOpenAIStream(c *gin.Context, route *modelRoute, model string, includeUsage bool, clientIP string) {
 	id := "chatcmpl-" + generateID()
 	created := time.Now().Unix()
 	flusher, _ := c.Writer.(http.Flusher)
 
-	var buffer strings.Builder
+	var (
+		ts        toolSetup
+		cursorReq client.CursorChatRequest
+		result    *cursorResult
+		filter    *outputFilter
+		served    config.ModelConfig
+		started   bool
+	)
+
+	// 写出响应头，之后不能再回退到其他模型
+	start := func() {
+		if started {
+			return
+		}
+		started = true
+		c.Header(servedModelHeader, served.ID)
+		c.Header("Content-Type", "text/event-stream")
+		c.Header("Cache-Control", "no-cache")
+		c.Header("Connection", "keep-alive")
+		c.Writer.WriteHeaderNow()
+	}
+	toolCount := 0
+
+	writeChunk := func(delta OpenAIMessage) {
+		chunk := ChatCompletionChunk{
+			ID:      id,
+			Object:  "chat.completion.chunk",
+			Created: created,
+			Model:   model,
+			Choices: []ChunkChoice{{
+				Index: 0,
+				Delta: delta,
+			}},
+		}
+		chunkJSON, _ := json.Marshal(chunk)
+		_, _ = fmt.Fprintf(c.Writer, "data: %s\n\n", chunkJSON)
+	}
 
-	svc := client.GetService()
-	_ = svc.SendStreamRequest(cursorReq, func(chunk string) {
-		buffer.WriteString(chunk)
-		content := buffer.String()
-		lines := strings.Split(content, "\n")
+	// 当前的工具调用，调用块未闭合时就已开始输出
+	var (
+		toolIndex int
+		toolArgs  *toolify.ArgumentStream // 非 nil 表示调用已开始
+		skipTool  bool                    // parallel_tool_calls=false 时丢弃当前调用
+	)
 
-		if !strings.HasSuffix(content, "\n") && len(lines) > 0 {
-			buffer.Reset()
-			buffer.WriteString(lines[len(lines)-1])
-			lines = lines[:len(lines)-1]
-		} else {
-			buffer.Reset()
+	// 开始工具调用：首块带 id 和函数名，parallel_tool_calls=false 时只允许一个调用
+	startToolCall := func(name string) bool {
+		if ts.choice.DisableParallel && toolCount > 0 {
+			log.Debug("[OpenAI] parallel_tool_calls=false, 丢弃工具调用 %s", name)
+			return false
+		}
+		toolIndex = toolCount
+		toolCount++
+		callID := newToolCallID()
+		h.calls.record(callID, name)
+		toolArgs = &toolify.ArgumentStream{}
+
+		writeChunk(OpenAIMessage{ToolCalls: []OpenAIToolCall{{
+			Index:    &toolIndex,
+			ID:       callID,
+			Type:     "function",
+			Function: OpenAIFunctionCall{Name: name},
+		}}})
+		return true
+	}
+
+	sendArguments := func(chunks []string) {
+		for _, chunk := range chunks {
+			writeChunk(OpenAIMessage{ToolCalls: []OpenAIToolCall{{
+				Index:    &toolIndex,
+				Function: OpenAIFunctionCall{Arguments: chunk},
+			}}})
+		}
+	}
+
+	// 调用块未闭合时提前开始工具调用，并输出已写完的参数
+	sendProgress := func(progress toolify.CallProgress) {
+		if skipTool {
+			return
+		}
+		if toolArgs == nil && !startToolCall(progress.Name) {
+			skipTool = true
+			return
+		}
+		sendArguments(toolArgs.Next(progress.Arguments))
+	}
+
+	// 发送工具调用，参数按字段分片发送；已提前开始的调用只补齐剩余参数
+	sendToolCall := func(call toolify.ToolCall) {
+		if skipTool {
+			skipTool = false
+			return
 		}
+		if toolArgs == nil && !startToolCall(call.Function.Name) {
+			return
+		}
+		sendArguments(toolArgs.Finish(call.Function.Arguments))
+		toolArgs = nil
+	}
 
-		for _, line := range lines {
-			if !strings.HasPrefix(line, "data: ") {
+	// 参数需要修正的工具调用及其后的内容先暂存，流结束修正后再按原顺序输出
+	var deferred []toolify.StreamEvent
+	emitEvent := func(ev toolify.StreamEvent) {
+		switch {
+		case ev.ToolCall != nil:
+			sendToolCall(*ev.ToolCall)
+		case ev.Progress != nil:
+			sendProgress(*ev.Progress)
+		default:
+			writeChunk(OpenAIMessage{Content: ev.Text})
+		}
+	}
+	sendEvents := func(events []toolify.StreamEvent) {
+		for _, ev := range events {
+			if !acceptStreamEvent(ev, ts.choice) {
 				continue
 			}
-			data := strings.TrimPrefix(line, "data: ")
-			if data == "" || data == "[DONE]" {
-				continue
+			if len(deferred) > 0 || (ev.ToolCall != nil && h.needsRepair(*ev.ToolCall)) {
+				deferred = append(deferred, ev)
+			} else {
+				emitEvent(ev)
 			}
+		}
+		if len(events) > 0 {
+			flusher.Flush()
+		}
+	}
 
-			var event CursorSSEEvent
-			if err := json.Unmarshal([]byte(data), &event); err != nil {
-				continue
-			}
+	// 收到第一段内容前失败时回退到下一个模型
+	err := h.routeModels(requestContext(c), route.chain, func(m config.ModelConfig) (bool, error) {
+		ts, cursorReq = route.prepare(m)
+		result = &cursorResult{}
+		filter = newOutputFilter(ts)
+		served = m
+
+		// 匹配到停止序列时 finish_reason 仍为 stop
+		err := h.streamWithStops(requestContext(c), cursorReq, filter, func(event sse.Event) {
+			result.apply(event)
 
-			if event.Type == "text-delta" && event.Delta != "" {
-				chunk := ChatCompletionChunk{
-					ID:      id,
-					Object:  "chat.completion.chunk",
-					Created: created,
-					Model:   model,
-					Choices: []ChunkChoice{{
-						Index: 0,
-						Delta: OpenAIMessage{Content: event.Delta},
-					}},
-				}
-				chunkJSON, _ := json.Marshal(chunk)
-				_, _ = fmt.Fprintf(c.Writer, "data: %s\n\n", chunkJSON)
+			switch {
+			case event.Type == sse.TypeReasoningDelta && event.Delta != "":
+				start()
+				writeChunk(OpenAIMessage{ReasoningContent: event.Delta})
 				flusher.Flush()
+			case event.Type == sse.TypeTextDelta && event.Delta != "":
+				start()
 			}
+		}, sendEvents, clientIP)
+		if err == nil {
+			// 上游返回了错误事件
+			err = result.err
 		}
+		return started, err
 	})
 
+	if err != nil {
+		if c.Request.Context().Err() != nil {
+			log.Info("[OpenAI] 客户端已断开，中止上游请求")
+			return
+		}
+		log.Error("[OpenAI] 流式请求失败: %v", err)
+		start()
+		writeOpenAIStreamError(c, flusher, err)
+		return
+	}
+	start()
+
+	sendEvents(filter.flush())
+	filter.truncate(result)
+	if len(deferred) > 0 {
+		events := h.repairStreamEvents(requestContext(c), cursorReq, ts, deferred, clientIP)
+		deferred = nil
+		// 修正后仍不合法的调用也照常输出，不能再次暂存
+		for _, ev := range events {
+			emitEvent(ev)
+		}
+		flusher.Flush()
+	}
+
+	// tool_choice 要求调用工具但模型没有调用
+	if ts.choice.Required() && toolCount == 0 {
+		calls, err := h.forceToolCall(requestContext(c), cursorReq, ts, result.Text(), clientIP)
+		if err != nil {
+			writeOpenAIStreamError(c, flusher, err)
+			return
+		}
+		for _, call := range calls {
+			sendToolCall(call)
+		}
+		flusher.Flush()
+	}
+
+	reason := openAIFinishReason(result.finishReason)
+	if toolCount > 0 {
+		reason = "tool_calls"
+	}
+
 	// 发送结束标记
-	reason := "stop"
 	endChunk := ChatCompletionChunk{
 		ID:      id,
 		Object:  "chat.completion.chunk",
@@ -189,42 +478,80 @@ func handleOpenAIStream(c *gin.Context, cursorReq client.CursorChatRequest, mode
 	}
 	endJSON, _ := json.Marshal(endChunk)
 	_, _ = fmt.Fprintf(c.Writer, "data: %s\n\n", endJSON)
+
+	if includeUsage {
+		usageChunk := ChatCompletionChunk{
+			ID:      id,
+			Object:  "chat.completion.chunk",
+			Created: created,
+			Model:   model,
+			Choices: []ChunkChoice{},
+			Usage:   openAIUsage(countUsage(served, cursorReq, result)),
+		}
+		usageJSON, _ := json.Marshal(usageChunk)
+		_, _ = fmt.Fprintf(c.Writer, "data: %s\n\n", usageJSON)
+	}
 	_, _ = c.Writer.WriteString("data: [DONE]\n\n")
 	flusher.Flush()
 }
 
 // handleOpenAINonStream 处理 OpenAI 非流式请求
-func handleOpenAINonStream(c *gin.Context, cursorReq client.CursorChatRequest, model string) {
-	svc := client.GetService()
-	result, err := svc.SendRequest(cursorReq)
+func (h *Handler) handleOpenAINonStream(c *gin.Context, route *modelRoute, model string, clientIP string) {
+	var (
+		ts        toolSetup
+		cursorReq client.CursorChatRequest
+		result    *cursorResult
+		served    config.ModelConfig
+	)
+	err := h.routeModels(requestContext(c), route.chain, func(m config.ModelConfig) (bool, error) {
+		ts, cursorReq = route.prepare(m)
+		served = m
+		var err error
+		result, err = h.completeRequest(requestContext(c), cursorReq, newOutputFilter(ts), clientIP)
+		if err != nil {
+			return false, err
+		}
+		if result.err != nil {
+			return false, result.err
+		}
+		c.Header(servedModelHeader, m.ID)
+		return false, nil
+	})
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		if result != nil {
+			c.JSON(http.StatusBadGateway, gin.H{"error": gin.H{"message": err.Error(), "type": "upstream_error"}})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		}
 		return
 	}
 
-	// 解析响应
-	var fullContent strings.Builder
-	lines := strings.Split(result, "\n")
-	for _, line := range lines {
-		if !strings.HasPrefix(line, "data: ") {
-			continue
-		}
-		data := strings.TrimPrefix(line, "data: ")
-		if data == "" || data == "[DONE]" {
-			continue
-		}
-
-		var event CursorSSEEvent
-		if err := json.Unmarshal([]byte(data), &event); err != nil {
-			continue
+	message := &OpenAIMessage{Role: "assistant", Content: result.Text(), ReasoningContent: result.Reasoning()}
+	reason := openAIFinishReason(result.finishReason)
+	segments, err := h.toolSegments(requestContext(c), cursorReq, ts, result.Text(), clientIP)
+	if err != nil {
+		c.JSON(http.StatusBadGateway, gin.H{"error": gin.H{"message": err.Error(), "type": "upstream_error"}})
+		return
+	}
+	if segments != nil {
+		// content 只能是一段文本，文本段按顺序拼接，tool_calls 保持模型输出的顺序
+		var text strings.Builder
+		var parsed []toolify.ToolCall
+		for _, seg := range segments {
+			if seg.ToolCall != nil {
+				parsed = append(parsed, *seg.ToolCall)
+			} else {
+				text.WriteString(seg.Text)
+			}
 		}
-
-		if event.Type == "text-delta" {
-			fullContent.WriteString(event.Delta)
+		message.Content = nil
+		if cleanText := strings.TrimSpace(text.String()); cleanText != "" {
+			message.Content = cleanText
 		}
+		message.ToolCalls = h.openAIToolCalls(parsed)
+		reason = "tool_calls"
 	}
 
-	reason := "stop"
 	c.JSON(http.StatusOK, ChatCompletionResponse{
 		ID:      "chatcmpl-" + generateID(),
 		Object:  "chat.completion",
@@ -232,13 +559,43 @@ func handleOpenAINonStream(c *gin.Context, cursorReq client.CursorChatRequest, m
 		Model:   model,
 		Choices: []Choice{{
 			Index:        0,
-			Message:      &OpenAIMessage{Role: "assistant", Content: fullContent.String()},
+			Message:      message,
 			FinishReason: &reason,
 		}},
-		Usage: &OpenAIUsage{
-			PromptTokens:     100,
-			CompletionTokens: 100,
-			TotalTokens:      200,
-		},
+		Usage: openAIUsage(countUsage(served, cursorReq, result)),
 	})
 }
+
+// openAIToolCalls 转换为 OpenAI 格式的工具调用，并记录 ID 供之后的 tool 消息配对
+func (h *Handler) openAIToolCalls(parsed []toolify.ToolCall) []OpenAIToolCall {
+	calls := make([]OpenAIToolCall, 0, len(parsed))
+	for _, call := range parsed {
+		id := newToolCallID()
+		h.calls.record(id, call.Function.Name)
+		calls = append(calls, OpenAIToolCall{
+			ID:   id,
+			Type: "function",
+			Function: OpenAIFunctionCall{
+				Name:      call.Function.Name,
+				Arguments: call.Function.Arguments,
+			},
+		})
+	}
+	return calls
+}
+
+// openAIUsage 转换为 OpenAI 格式的用量
+func openAIUsage(usage tokenUsage) *OpenAIUsage {
+	return &OpenAIUsage{
+		PromptTokens:     usage.input,
+		CompletionTokens: usage.output,
+		TotalTokens:      usage.input + usage.output,
+	}
+}
+
+// writeOpenAIStreamError 发送 OpenAI 流式错误块
+func writeOpenAIStreamError(c *gin.Context, flusher http.Flusher, err error) {
+	errJSON, _ := json.Marshal(gin.H{"error": gin.H{"message": err.Error(), "type": "upstream_error"}})
+	_, _ = fmt.Fprintf(c.Writer, "data: %s\n\n", errJSON)
+	flusher.Flush()
+}
@@ -0,0 +1,219 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"cursor2api/internal/client"
+	"cursor2api/internal/config"
+	"cursor2api/internal/toolify"
+)
+
+// toolSetup 一次请求的工具调用设置
+type toolSetup struct {
+	tools   []toolify.ToolDefinition // 可调用的工具，tool_choice 为 none 时为空
+	choice  toolify.ToolChoice
+	dialect toolify.Dialect
+	stops   []string // 停止序列，重新请求（强制调用、参数修正）时同样生效
+	// progress 调用块未闭合时是否提前输出工具名和参数
+	// 开启参数修正时关闭：已输出的参数无法撤回，修正后的值到不了客户端
+	progress bool
+}
+
+// newToolSetup 整理请求的工具和 tool_choice，并按模型选择工具调用格式
+func (h *Handler) newToolSetup(model config.ModelConfig, tools []toolify.ToolDefinition, choice toolify.ToolChoice, stops []string) toolSetup {
+	return toolSetup{
+		tools:    choice.Tools(tools),
+		choice:   choice,
+		dialect:  h.toolDialect(model),
+		stops:    stops,
+		progress: h.cfg.ToolRepairRetries == 0,
+	}
+}
+
+// toolDialect 返回模型使用的工具调用格式
+// 优先级：注册表中模型的 tool_dialect > tool_dialects > tool_dialect，名称无效时使用默认格式
+func (h *Handler) toolDialect(model config.ModelConfig) toolify.Dialect {
+	name := h.cfg.ToolDialect
+	if override, ok := h.cfg.ToolDialects[model.ID]; ok {
+		name = override
+	}
+	if model.ToolDialect != "" {
+		name = model.ToolDialect
+	}
+	d, ok := toolify.GetDialect(name)
+	if !ok {
+		log.Warn("未知的工具调用格式 %q (模型 %s)，使用 %s，可选: %s", name, model.ID, toolify.DefaultDialect, strings.Join(toolify.DialectNames(), ", "))
+		d, _ = toolify.GetDialect(toolify.DefaultDialect)
+	}
+	return d
+}
+
+// reprompt 在原对话后追加模型的上一次回复和新的要求，以非流式方式重新请求，返回截断到停止序列之前的回复正文
+func (h *Handler) reprompt(ctx context.Context, cursorReq client.CursorChatRequest, ts toolSetup, assistantText, userText, clientIP string) (string, error) {
+	req := cursorReq
+	req.ID = generateID()
+	req.Messages = append([]client.CursorMessage(nil), cursorReq.Messages...)
+	if strings.TrimSpace(assistantText) != "" {
+		req.Messages = append(req.Messages, client.CursorMessage{
+			Parts: []client.CursorPart{{Type: "text", Text: assistantText}},
+			ID:    generateID(),
+			Role:  "assistant",
+		})
+	}
+	req.Messages = append(req.Messages, client.CursorMessage{
+		Parts: []client.CursorPart{{Type: "text", Text: userText}},
+		ID:    generateID(),
+		Role:  "user",
+	})
+
+	result, err := h.completeRequest(ctx, req, newOutputFilter(ts), clientIP)
+	if err != nil {
+		return "", err
+	}
+	if result.err != nil {
+		return "", result.err
+	}
+	return result.Text(), nil
+}
+
+// forceToolCall 模型没有按 tool_choice 调用工具时重试一次，仍然没有则返回错误
+func (h *Handler) forceToolCall(ctx context.Context, cursorReq client.CursorChatRequest, ts toolSetup, responseText, clientIP string) ([]toolify.ToolCall, error) {
+	log.Warn("模型未按 tool_choice=%s 调用工具，重试一次", choiceName(ts.choice))
+	text, err := h.reprompt(ctx, cursorReq, ts, responseText, ts.choice.RetryPrompt(), clientIP)
+	if err != nil {
+		return nil, err
+	}
+	calls, _ := toolify.ParseToolCalls(ts.dialect, text, ts.tools)
+	if calls = ts.choice.Filter(calls); len(calls) == 0 {
+		return nil, fmt.Errorf("model did not call a tool as required by tool_choice %s", choiceName(ts.choice))
+	}
+	return calls, nil
+}
+
+// toolSegments 把完整回复解析为按模型输出顺序排列的文本段和工具调用
+// 依次应用 tool_choice 过滤、强制调用和参数修正；没有工具调用时返回 nil
+func (h *Handler) toolSegments(ctx context.Context, cursorReq client.CursorChatRequest, ts toolSetup, responseText, clientIP string) ([]toolify.StreamEvent, error) {
+	var segments []toolify.StreamEvent
+	calls := 0
+	for _, ev := range toolify.ParseSegments(ts.dialect, responseText, ts.tools) {
+		if !acceptStreamEvent(ev, ts.choice) {
+			continue
+		}
+		if ev.ToolCall != nil {
+			if ts.choice.DisableParallel && calls > 0 {
+				continue
+			}
+			calls++
+		}
+		segments = append(segments, ev)
+	}
+
+	if calls == 0 {
+		if !ts.choice.Required() {
+			return nil, nil
+		}
+		forced, err := h.forceToolCall(ctx, cursorReq, ts, responseText, clientIP)
+		if err != nil {
+			return nil, err
+		}
+		segments = make([]toolify.StreamEvent, len(forced))
+		for i := range forced {
+			segments[i] = toolify.StreamEvent{ToolCall: &forced[i]}
+		}
+	}
+	return h.repairStreamEvents(ctx, cursorReq, ts, segments, clientIP), nil
+}
+
+// choiceName 用于日志和错误信息的 tool_choice 描述
+func choiceName(choice toolify.ToolChoice) string {
+	if choice.Mode == toolify.ChoiceTool {
+		return fmt.Sprintf("%s(%s)", choice.Mode, choice.Name)
+	}
+	return choice.Mode
+}
+
+// acceptStreamEvent 按 tool_choice 过滤流式事件
+// 强制调用工具时不输出文本，和 Anthropic 原生行为一致
+func acceptStreamEvent(ev toolify.StreamEvent, choice toolify.ToolChoice) bool {
+	switch {
+	case ev.ToolCall != nil:
+		return choice.Allows(*ev.ToolCall)
+	case ev.Progress != nil:
+		return choice.Allows(toolify.ToolCall{Function: toolify.ToolCallFunction{Name: ev.Progress.Name}})
+	}
+	return !choice.Required()
+}
+
+// needsRepair 工具调用参数校验失败且允许重试时返回 true
+func (h *Handler) needsRepair(call toolify.ToolCall) bool {
+	return len(call.ValidationErrors) > 0 && h.cfg.ToolRepairRetries > 0
+}
+
+// repairToolCalls 把参数校验失败的工具调用发回模型修正，最多重试 ToolRepairRetries 次
+// 修正后的调用保留原来的 ID 和位置；重试用完仍不合法时返回最后一次的结果
+func (h *Handler) repairToolCalls(ctx context.Context, cursorReq client.CursorChatRequest, ts toolSetup, calls []toolify.ToolCall, clientIP string) []toolify.ToolCall {
+	for attempt := 1; attempt <= h.cfg.ToolRepairRetries; attempt++ {
+		var invalid []int
+		for i, call := range calls {
+			if len(call.ValidationErrors) > 0 {
+				invalid = append(invalid, i)
+			}
+		}
+		if len(invalid) == 0 {
+			return calls
+		}
+
+		broken := make([]toolify.ToolCall, len(invalid))
+		rendered := make([]string, len(invalid))
+		for j, i := range invalid {
+			broken[j] = calls[i]
+			rendered[j] = ts.dialect.RenderCall(calls[i].ID, calls[i].Function.Name, calls[i].Function.Arguments)
+			log.Warn("工具调用 %s 参数不合法 (第 %d 次修正): %s", calls[i].Function.Name, attempt, strings.Join(calls[i].ValidationErrors, "; "))
+		}
+
+		text, err := h.reprompt(ctx, cursorReq, ts, strings.Join(rendered, "\n"), toolify.RepairPrompt(broken), clientIP)
+		if err != nil {
+			log.Error("工具调用修正请求失败: %v", err)
+			return calls
+		}
+
+		// 按顺序替换同名的调用
+		repaired, _ := toolify.ParseToolCalls(ts.dialect, text, ts.tools)
+		for j, i := range invalid {
+			if j >= len(repaired) || repaired[j].Function.Name != calls[i].Function.Name {
+				continue
+			}
+			repaired[j].ID = calls[i].ID
+			calls[i] = repaired[j]
+		}
+	}
+
+	for _, call := range calls {
+		if len(call.ValidationErrors) > 0 {
+			log.Warn("工具调用 %s 修正后仍不合法: %s", call.Function.Name, strings.Join(call.ValidationErrors, "; "))
+		}
+	}
+	return calls
+}
+
+// repairStreamEvents 修正一组事件中的工具调用，文本保持原位置
+func (h *Handler) repairStreamEvents(ctx context.Context, cursorReq client.CursorChatRequest, ts toolSetup, events []toolify.StreamEvent, clientIP string) []toolify.StreamEvent {
+	var calls []toolify.ToolCall
+	for _, ev := range events {
+		if ev.ToolCall != nil {
+			calls = append(calls, *ev.ToolCall)
+		}
+	}
+	calls = h.repairToolCalls(ctx, cursorReq, ts, calls, clientIP)
+
+	n := 0
+	for i := range events {
+		if events[i].ToolCall != nil {
+			events[i].ToolCall = &calls[n]
+			n++
+		}
+	}
+	return events
+}
@@ -0,0 +1,157 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+
+	"cursor2api/internal/client"
+	"cursor2api/internal/config"
+	"cursor2api/internal/toolify"
+)
+
+const bashTool = `{"name":"Bash","description":"run a command","input_schema":{"type":"object","properties":{"command":{"type":"string"},"timeout":{"type":"integer"}},"required":["command"]}}`
+
+// invalidBashCall 缺少必填参数 command 的调用
+const invalidBashCall = "<tool_use name=\"Bash\">\n<parameter name=\"timeout\">5</parameter>\n</tool_use>"
+
+// anthropicStreamBlocks 解析 Anthropic 流式响应中的 content_block_start 类型和最终 stop_reason
+func anthropicStreamBlocks(t *testing.T, body string) (blocks []string, stopReason string) {
+	t.Helper()
+	for _, d := range sseData(body) {
+		var ev struct {
+			Type         string `json:"type"`
+			ContentBlock struct {
+				Type string `json:"type"`
+				Name string `json:"name"`
+			} `json:"content_block"`
+			Delta struct {
+				StopReason string `json:"stop_reason"`
+			} `json:"delta"`
+		}
+		if err := json.Unmarshal([]byte(d), &ev); err != nil {
+			t.Fatalf("bad event %s: %v", d, err)
+		}
+		switch ev.Type {
+		case "content_block_start":
+			blocks = append(blocks, ev.ContentBlock.Type)
+		case "message_delta":
+			stopReason = ev.Delta.StopReason
+		}
+	}
+	return blocks, stopReason
+}
+
+func TestStreamRepairFailureStillEmitsCall(t *testing.T) {
+	cases := []struct {
+		name   string
+		repair fakeReply
+	}{
+		{"retries exhausted", fakeReply{deltas: []string{invalidBashCall}}},
+		{"reprompt fails", fakeReply{err: errors.New("upstream 503")}},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			up := &fakeUpstream{replies: []fakeReply{
+				{deltas: []string{"Running it.\n", invalidBashCall[:20], invalidBashCall[20:], "\nafter"}},
+				tc.repair,
+			}}
+			h := newTestHandler(up, nil)
+
+			w := serve(h, "/v1/messages", `{"model":"claude-4.5-sonnet","max_tokens":100,"stream":true,"tools":[`+bashTool+`],"messages":[{"role":"user","content":"hi"}]}`)
+			if w.Code != http.StatusOK {
+				t.Fatalf("status = %d, body = %s", w.Code, w.Body)
+			}
+			blocks, stopReason := anthropicStreamBlocks(t, w.Body.String())
+			if strings.Join(blocks, ",") != "text,tool_use,text" {
+				t.Errorf("blocks = %v, body = %s", blocks, w.Body)
+			}
+			if stopReason != "tool_use" {
+				t.Errorf("stop_reason = %q", stopReason)
+			}
+			if !strings.Contains(w.Body.String(), `"text":"\nafter"`) {
+				t.Errorf("text after the call was dropped: %s", w.Body)
+			}
+			if len(up.requests) != 2 {
+				t.Errorf("upstream requests = %d, want original + one repair", len(up.requests))
+			}
+		})
+	}
+}
+
+func TestOpenAIStreamRepairFailureStillEmitsCall(t *testing.T) {
+	up := &fakeUpstream{replies: []fakeReply{
+		{deltas: []string{invalidBashCall}},
+		{deltas: []string{invalidBashCall}},
+	}}
+	h := newTestHandler(up, nil)
+
+	w := serve(h, "/v1/chat/completions", `{"model":"gpt-5.2","stream":true,"tools":[{"type":"function","function":{"name":"Bash","parameters":{"type":"object","properties":{"command":{"type":"string"}},"required":["command"]}}}],"messages":[{"role":"user","content":"hi"}]}`)
+	body := w.Body.String()
+	if !strings.Contains(body, `"name":"Bash"`) || !strings.Contains(body, `"finish_reason":"tool_calls"`) {
+		t.Fatalf("tool call missing from stream: %s", body)
+	}
+}
+
+func TestNonStreamRepair(t *testing.T) {
+	fixed := "<tool_use name=\"Bash\">\n<parameter name=\"command\">ls</parameter>\n</tool_use>"
+	up := &fakeUpstream{replies: []fakeReply{{deltas: []string{invalidBashCall}}, {deltas: []string{fixed}}}}
+	h := newTestHandler(up, nil)
+
+	w := serve(h, "/v1/messages", `{"model":"claude-4.5-sonnet","max_tokens":100,"tools":[`+bashTool+`],"messages":[{"role":"user","content":"hi"}]}`)
+	var resp MessagesResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Content) != 1 || resp.Content[0].Type != "tool_use" || string(resp.Content[0].Input) != `{"command":"ls"}` {
+		t.Fatalf("unexpected response: %s", w.Body)
+	}
+	if !strings.Contains(up.requests[1].Messages[len(up.requests[1].Messages)-1].Parts[0].Text, "command") {
+		t.Errorf("repair prompt does not mention the missing parameter")
+	}
+}
+
+func TestRepairToolCalls(t *testing.T) {
+	fixed := "<tool_use name=\"Bash\">\n<parameter name=\"command\">ls</parameter>\n</tool_use>"
+	other := "<tool_use name=\"Other\">\n<parameter name=\"command\">ls</parameter>\n</tool_use>"
+	cases := []struct {
+		name     string
+		retries  int
+		input    string
+		replies  []fakeReply
+		want     string // 修正后的参数，参数仍不合法时以 ! 结尾
+		requests int
+	}{
+		{"valid call untouched", 2, fixed, nil, `{"command":"ls"}`, 0},
+		{"fixed on first retry", 2, invalidBashCall, []fakeReply{{deltas: []string{fixed}}}, `{"command":"ls"}`, 1},
+		{"fixed on second retry", 2, invalidBashCall, []fakeReply{{deltas: []string{invalidBashCall}}, {deltas: []string{fixed}}}, `{"command":"ls"}`, 2},
+		{"retries exhausted", 2, invalidBashCall, []fakeReply{{deltas: []string{invalidBashCall}}}, `{"timeout":5}!`, 2},
+		{"other tool ignored", 1, invalidBashCall, []fakeReply{{deltas: []string{other}}}, `{"timeout":5}!`, 1},
+		{"reprompt fails", 2, invalidBashCall, []fakeReply{{err: errors.New("upstream 503")}}, `{"timeout":5}!`, 1},
+		{"repair disabled", 0, invalidBashCall, nil, `{"timeout":5}!`, 0},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			up := &fakeUpstream{replies: tc.replies}
+			h := newTestHandler(up, func(cfg *config.Config) { cfg.ToolRepairRetries = tc.retries })
+			ts := stopToolSetup(t)
+			calls, _ := toolify.ParseToolCalls(ts.dialect, tc.input, ts.tools)
+			calls[0].ID = "call_7"
+
+			calls = h.repairToolCalls(context.Background(), client.CursorChatRequest{}, ts, calls, "")
+			got := calls[0].Function.Arguments
+			if len(calls[0].ValidationErrors) > 0 {
+				got += "!"
+			}
+			if got != tc.want || calls[0].ID != "call_7" {
+				t.Errorf("call = %s %s, want %s", calls[0].ID, got, tc.want)
+			}
+			if len(up.requests) != tc.requests {
+				t.Errorf("upstream requests = %d, want %d", len(up.requests), tc.requests)
+			}
+		})
+	}
+}
@@ -0,0 +1,221 @@
+package handler
+
+import (
+	"context"
+	"strings"
+
+	"cursor2api/internal/client"
+	"cursor2api/internal/sse"
+	"cursor2api/internal/toolify"
+)
+
+// stopMatcher 在流式文本中查找停止序列
+// 末尾可能是停止序列开头的部分先暂存，因此停止序列被拆到多个 delta 中也能匹配
+type stopMatcher struct {
+	stops []string
+	buf   string // 尚未输出的文本
+}
+
+// newStopMatcher 没有停止序列时返回 nil
+func newStopMatcher(stops []string) *stopMatcher {
+	var kept []string
+	for _, s := range stops {
+		if s != "" {
+			kept = append(kept, s)
+		}
+	}
+	if len(kept) == 0 {
+		return nil
+	}
+	return &stopMatcher{stops: kept}
+}
+
+// feed 追加一段文本，返回可以输出的部分
+// 匹配到停止序列时返回序列之前的文本和匹配到的序列
+func (m *stopMatcher) feed(delta string) (text, matched string) {
+	m.buf += delta
+
+	// 取最早出现的停止序列
+	at := -1
+	for _, s := range m.stops {
+		if i := strings.Index(m.buf, s); i >= 0 && (at < 0 || i < at) {
+			at, matched = i, s
+		}
+	}
+	if at >= 0 {
+		text = m.buf[:at]
+		m.buf = ""
+		return text, matched
+	}
+
+	// 末尾可能是停止序列的开头，先留着
+	keep := 0
+	for _, s := range m.stops {
+		for n := min(len(s)-1, len(m.buf)); n > keep; n-- {
+			if strings.HasSuffix(m.buf, s[:n]) {
+				keep = n
+				break
+			}
+		}
+	}
+	text = m.buf[:len(m.buf)-keep]
+	m.buf = m.buf[len(m.buf)-keep:]
+	return text, ""
+}
+
+// flush 上游结束时返回暂存的文本
+func (m *stopMatcher) flush() string {
+	text := m.buf
+	m.buf = ""
+	return text
+}
+
+// outputFilter 把模型正文交给工具调用解析器，只在解析出的文本段上匹配停止序列
+// 工具调用块内的内容不参与匹配；同时记录已输出部分对应的正文原文，匹配后据此截断
+// 开启进度输出时，调用块未闭合就会产生工具名和已写完参数的事件
+type outputFilter struct {
+	parser  *toolify.StreamParser
+	matcher *stopMatcher // 没有停止序列时为 nil
+	matched string
+	raw     strings.Builder
+}
+
+func newOutputFilter(ts toolSetup) *outputFilter {
+	parser := toolify.NewStreamParser(ts.dialect, ts.tools)
+	if ts.progress {
+		parser.EnableProgress()
+	}
+	return &outputFilter{parser: parser, matcher: newStopMatcher(ts.stops)}
+}
+
+// feed 写入一段正文，返回可以输出的文本段和工具调用；匹配到停止序列后不再输出
+func (f *outputFilter) feed(delta string) []toolify.StreamEvent {
+	if f.matched != "" {
+		return nil
+	}
+	return f.match(f.parser.Feed(delta))
+}
+
+// flush 流结束时输出解析器和停止序列匹配中暂存的内容
+func (f *outputFilter) flush() []toolify.StreamEvent {
+	if f.matched != "" {
+		return nil
+	}
+	events := f.match(f.parser.Flush())
+	if f.matched == "" && f.matcher != nil {
+		events = f.appendText(events, f.matcher.flush())
+	}
+	return events
+}
+
+// interrupt 正文被推理打断时输出解析器和停止序列匹配中暂存的文本，使两者按原顺序输出
+// 未闭合的调用块仍留在解析器中
+func (f *outputFilter) interrupt() []toolify.StreamEvent {
+	if f.matched != "" {
+		return nil
+	}
+	events := f.match(f.parser.Interrupt())
+	if f.matched == "" && f.matcher != nil {
+		events = f.appendText(events, f.matcher.flush())
+	}
+	return events
+}
+
+// match 在文本段上匹配停止序列，匹配后丢弃之后的所有事件
+func (f *outputFilter) match(events []toolify.StreamEvent) []toolify.StreamEvent {
+	var out []toolify.StreamEvent
+	for _, ev := range events {
+		if !ev.IsText() {
+			if f.matcher != nil {
+				// 停止序列不会跨过工具调用，暂存的文本先输出
+				out = f.appendText(out, f.matcher.flush())
+			}
+			f.raw.WriteString(ev.Raw)
+			out = append(out, ev)
+			continue
+		}
+		if f.matcher == nil {
+			out = f.appendText(out, ev.Text)
+			continue
+		}
+		text, matched := f.matcher.feed(ev.Text)
+		out = f.appendText(out, text)
+		if matched != "" {
+			f.matched = matched
+			return out
+		}
+	}
+	return out
+}
+
+// appendText 追加文本段并记录原文，与前一个文本段合并
+func (f *outputFilter) appendText(events []toolify.StreamEvent, text string) []toolify.StreamEvent {
+	if text == "" {
+		return events
+	}
+	f.raw.WriteString(text)
+	if n := len(events); n > 0 && events[n-1].IsText() {
+		events[n-1].Text += text
+		return events
+	}
+	return append(events, toolify.StreamEvent{Text: text})
+}
+
+// truncate 匹配到停止序列时把 result 的正文截断到停止序列之前
+func (f *outputFilter) truncate(result *cursorResult) {
+	if f.matched == "" {
+		return
+	}
+	result.text.Reset()
+	result.text.WriteString(f.raw.String())
+}
+
+// streamWithStops 发送流式请求，所有事件交给 onEvent，正文经 filter 解析出的文本段和工具调用交给 onSegments
+// 匹配到停止序列后中止上游读取；流结束后由调用方 flush filter
+func (h *Handler) streamWithStops(ctx context.Context, req client.CursorChatRequest, filter *outputFilter, onEvent func(event sse.Event), onSegments func(events []toolify.StreamEvent), clientIP string) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	err := h.upstream.SendStreamRequestWithIP(ctx, req, func(event sse.Event) {
+		if filter.matched != "" {
+			// 中止后仍可能收到已缓冲的事件
+			return
+		}
+		onEvent(event)
+		if event.Type != sse.TypeTextDelta {
+			return
+		}
+		if events := filter.feed(event.Delta); len(events) > 0 {
+			onSegments(events)
+		}
+		if filter.matched != "" {
+			log.Debug("匹配到停止序列 %q，中止上游请求", filter.matched)
+			cancel()
+		}
+	}, clientIP)
+	if filter.matched != "" {
+		// 主动中止导致的读取错误不算失败
+		return nil
+	}
+	return err
+}
+
+// completeRequest 发送非流式请求并解析响应，匹配到的停止序列记录在 filter.matched
+// 有停止序列时改为流式读取，匹配后即可中止上游，不必等完整响应；正文截断到停止序列之前
+func (h *Handler) completeRequest(ctx context.Context, req client.CursorChatRequest, filter *outputFilter, clientIP string) (*cursorResult, error) {
+	if filter.matcher == nil {
+		body, err := h.upstream.SendRequestWithIP(ctx, req, clientIP)
+		if err != nil {
+			return nil, err
+		}
+		return parseCursorResponse(body), nil
+	}
+
+	result := &cursorResult{}
+	if err := h.streamWithStops(ctx, req, filter, result.apply, func([]toolify.StreamEvent) {}, clientIP); err != nil {
+		return nil, err
+	}
+	filter.flush()
+	filter.truncate(result)
+	return result, nil
+}
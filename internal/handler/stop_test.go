@@ -0,0 +1,190 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"cursor2api/internal/client"
+	"cursor2api/internal/toolify"
+)
+
+func TestStopMatcher(t *testing.T) {
+	cases := []struct {
+		name    string
+		stops   []string
+		deltas  []string
+		want    string
+		matched string
+	}{
+		{"no match", []string{"END"}, []string{"hello ", "world"}, "hello world", ""},
+		{"single delta", []string{"END"}, []string{"fooENDbar"}, "foo", "END"},
+		{"split across deltas", []string{"END"}, []string{"foo E", "N", "Dbar"}, "foo ", "END"},
+		{"partial prefix released", []string{"END"}, []string{"foo EN", "X"}, "foo ENX", ""},
+		{"earliest stop wins", []string{"b", "a"}, []string{"xab"}, "x", "a"},
+		{"empty stops ignored", []string{"", "Z"}, []string{"aZ"}, "a", "Z"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			m := newStopMatcher(tc.stops)
+			var got strings.Builder
+			matched := ""
+			for _, d := range tc.deltas {
+				text, mt := m.feed(d)
+				got.WriteString(text)
+				if mt != "" {
+					matched = mt
+					break
+				}
+			}
+			if matched == "" {
+				got.WriteString(m.flush())
+			}
+			if got.String() != tc.want || matched != tc.matched {
+				t.Fatalf("got %q (matched %q), want %q (matched %q)", got.String(), matched, tc.want, tc.matched)
+			}
+		})
+	}
+	if newStopMatcher([]string{""}) != nil {
+		t.Error("matcher without stop sequences should be nil")
+	}
+}
+
+// stopToolSetup 返回使用 xml 格式、只有 Bash 工具的设置
+func stopToolSetup(t *testing.T, stops ...string) toolSetup {
+	t.Helper()
+	d, _ := toolify.GetDialect("xml")
+	var tool toolify.ToolDefinition
+	if err := json.Unmarshal([]byte(bashTool), &tool); err != nil {
+		t.Fatal(err)
+	}
+	return toolSetup{tools: []toolify.ToolDefinition{tool}, dialect: d, stops: stops, progress: true}
+}
+
+func TestStreamWithStops(t *testing.T) {
+	call := "<tool_use name=\"Bash\">\n<parameter name=\"command\">echo END</parameter>\n</tool_use>"
+	cases := []struct {
+		name    string
+		stops   []string
+		deltas  []string
+		want    []string // 文本段原样，工具调用写成 call:<command>
+		matched string
+		text    string // 截断后的正文
+		aborted bool
+	}{
+		{
+			name:   "no stops",
+			deltas: []string{"a", call, "b"},
+			want:   []string{"a", "call:echo END", "b"},
+			text:   "a" + call + "b",
+		},
+		{
+			name:   "stop inside tool call is ignored",
+			stops:  []string{"END"},
+			deltas: []string{"run ", call[:40], call[40:], " done"},
+			want:   []string{"run ", "call:echo END", " done"},
+			text:   "run " + call + " done",
+		},
+		{
+			name:    "stop after tool call",
+			stops:   []string{"END"},
+			deltas:  []string{call, "ok E", "ND", "never"},
+			want:    []string{"call:echo END", "ok "},
+			matched: "END",
+			text:    call + "ok ",
+			aborted: true,
+		},
+		{
+			name:   "stop prefix overlapping an open tag",
+			stops:  []string{"<tool_x"},
+			deltas: []string{"a <tool", "_use name=\"Bash\">\n<parameter name=\"command\">ls</parameter>\n</tool_use>"},
+			want:   []string{"a ", "call:ls"},
+			text:   "a <tool_use name=\"Bash\">\n<parameter name=\"command\">ls</parameter>\n</tool_use>",
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			up := &fakeUpstream{replies: []fakeReply{{deltas: tc.deltas}}}
+			h := newTestHandler(up, nil)
+			filter := newOutputFilter(stopToolSetup(t, tc.stops...))
+			result := &cursorResult{}
+
+			var got []string
+			collect := func(events []toolify.StreamEvent) {
+				for _, ev := range events {
+					if ev.Progress != nil {
+						continue
+					}
+					if ev.ToolCall != nil {
+						var args struct{ Command string }
+						_ = json.Unmarshal([]byte(ev.ToolCall.Function.Arguments), &args)
+						got = append(got, "call:"+args.Command)
+					} else if n := len(got); n > 0 && !strings.HasPrefix(got[n-1], "call:") {
+						got[n-1] += ev.Text
+					} else {
+						got = append(got, ev.Text)
+					}
+				}
+			}
+			err := h.streamWithStops(context.Background(), client.CursorChatRequest{}, filter, result.apply, collect, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			collect(filter.flush())
+			filter.truncate(result)
+
+			if strings.Join(got, "|") != strings.Join(tc.want, "|") {
+				t.Errorf("segments = %q, want %q", got, tc.want)
+			}
+			if filter.matched != tc.matched {
+				t.Errorf("matched = %q, want %q", filter.matched, tc.matched)
+			}
+			if result.Text() != tc.text {
+				t.Errorf("text = %q, want %q", result.Text(), tc.text)
+			}
+			if up.aborted != tc.aborted {
+				t.Errorf("aborted = %v, want %v", up.aborted, tc.aborted)
+			}
+		})
+	}
+}
+
+func TestMessagesStopSequence(t *testing.T) {
+	up := &fakeUpstream{replies: []fakeReply{{deltas: []string{"one two ", "STOP three"}}}}
+	h := newTestHandler(up, nil)
+
+	w := serve(h, "/v1/messages", `{"model":"claude-4.5-sonnet","max_tokens":100,"stop_sequences":["STOP"],"messages":[{"role":"user","content":"hi"}]}`)
+	var resp MessagesResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Content) != 1 || resp.Content[0].Text != "one two " {
+		t.Fatalf("unexpected content: %s", w.Body)
+	}
+	if resp.StopReason != "stop_sequence" || resp.StopSequence == nil || *resp.StopSequence != "STOP" {
+		t.Fatalf("stop_reason = %q, stop_sequence = %v", resp.StopReason, resp.StopSequence)
+	}
+}
+
+func TestForceToolCallAppliesStops(t *testing.T) {
+	first := "<tool_use name=\"Bash\">\n<parameter name=\"command\">ls</parameter>\n</tool_use>"
+	second := "<tool_use name=\"Bash\">\n<parameter name=\"command\">rm -rf /</parameter>\n</tool_use>"
+	up := &fakeUpstream{replies: []fakeReply{
+		{deltas: []string{"I would rather chat."}},
+		{deltas: []string{first, "\nSTOP\n", second}},
+	}}
+	h := newTestHandler(up, nil)
+
+	w := serve(h, "/v1/messages", `{"model":"claude-4.5-sonnet","max_tokens":100,"stream":true,"stop_sequences":["STOP"],"tool_choice":{"type":"any"},"tools":[`+bashTool+`],"messages":[{"role":"user","content":"hi"}]}`)
+	blocks, stopReason := anthropicStreamBlocks(t, w.Body.String())
+	if strings.Join(blocks, ",") != "tool_use" || stopReason != "tool_use" {
+		t.Fatalf("blocks = %v, stop_reason = %q, body = %s", blocks, stopReason, w.Body)
+	}
+	if strings.Contains(w.Body.String(), "rm -rf") {
+		t.Errorf("tool call after the stop sequence was emitted: %s", w.Body)
+	}
+	if len(up.requests) != 2 {
+		t.Errorf("upstream requests = %d, want 2", len(up.requests))
+	}
+}
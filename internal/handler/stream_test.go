@@ -0,0 +1,222 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+
+	"cursor2api/internal/client"
+	"cursor2api/internal/config"
+	"cursor2api/internal/sse"
+	"cursor2api/internal/toolify"
+)
+
+// anthropicToolInputs 拼接 Anthropic 流式响应中每个 tool_use 块的 input_json_delta
+func anthropicToolInputs(t *testing.T, body string) []string {
+	t.Helper()
+	var inputs []string
+	tool := -1
+	for _, d := range sseData(body) {
+		var ev struct {
+			Type         string `json:"type"`
+			Index        int    `json:"index"`
+			ContentBlock struct {
+				Type string `json:"type"`
+			} `json:"content_block"`
+			Delta struct {
+				PartialJSON string `json:"partial_json"`
+			} `json:"delta"`
+		}
+		if err := json.Unmarshal([]byte(d), &ev); err != nil {
+			t.Fatalf("bad event %s: %v", d, err)
+		}
+		switch {
+		case ev.Type == "content_block_start" && ev.ContentBlock.Type == "tool_use":
+			tool = ev.Index
+			inputs = append(inputs, "")
+		case ev.Type == "content_block_delta" && ev.Index == tool:
+			inputs[len(inputs)-1] += ev.Delta.PartialJSON
+		}
+	}
+	return inputs
+}
+
+// withoutRepair 关闭参数修正，调用块未闭合时才会提前输出参数
+func withoutRepair(cfg *config.Config) {
+	cfg.ToolRepairRetries = 0
+}
+
+func TestStreamToolCallProgress(t *testing.T) {
+	first := "Running.\n<tool_use name=\"Bash\">\n<parameter name=\"command\">ls</parameter>\n"
+	second := "<parameter name=\"timeout\">5</parameter>\n</tool_use>"
+
+	// 第一段到达时工具名和 command 已经输出，不等结束标签
+	up := &fakeUpstream{replies: []fakeReply{{deltas: []string{first, second}}}}
+	h := newTestHandler(up, withoutRepair)
+	var batches [][]toolify.StreamEvent
+	filter := newOutputFilter(stopToolSetup(t))
+	err := h.streamWithStops(context.Background(), client.CursorChatRequest{}, filter, (&cursorResult{}).apply, func(events []toolify.StreamEvent) {
+		batches = append(batches, events)
+	}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(batches) != 2 {
+		t.Fatalf("batches = %d, want one per delta", len(batches))
+	}
+	if last := batches[0][len(batches[0])-1]; last.Progress == nil || last.Progress.Name != "Bash" ||
+		len(last.Progress.Arguments) != 1 || last.Progress.Arguments[0].Name != "command" {
+		t.Fatalf("first batch = %+v, want progress with the command", batches[0])
+	}
+
+	w := serve(h, "/v1/messages", `{"model":"claude-4.5-sonnet","max_tokens":100,"stream":true,"tools":[`+bashTool+`],"messages":[{"role":"user","content":"hi"}]}`)
+	blocks, stopReason := anthropicStreamBlocks(t, w.Body.String())
+	if strings.Join(blocks, ",") != "text,tool_use" || stopReason != "tool_use" {
+		t.Fatalf("blocks = %v, stop_reason = %q", blocks, stopReason)
+	}
+	if inputs := anthropicToolInputs(t, w.Body.String()); len(inputs) != 1 || inputs[0] != `{"command":"ls","timeout":5}` {
+		t.Errorf("tool inputs = %q", inputs)
+	}
+}
+
+func TestStreamUnclosedToolCall(t *testing.T) {
+	unclosed := "<tool_use name=\"Bash\">\n<parameter name=\"command\">ls</parameter>\n<parameter name=\"timeout\">"
+	fixed := "<tool_use name=\"Bash\">\n<parameter name=\"command\">ls -la</parameter>\n<parameter name=\"timeout\">5</parameter>\n</tool_use>"
+	up := &fakeUpstream{replies: []fakeReply{{deltas: []string{unclosed}}, {deltas: []string{fixed}}}}
+	h := newTestHandler(up, nil)
+
+	w := serve(h, "/v1/messages", `{"model":"claude-4.5-sonnet","max_tokens":100,"stream":true,"tools":[`+bashTool+`],"messages":[{"role":"user","content":"hi"}]}`)
+	body := w.Body.String()
+	blocks, stopReason := anthropicStreamBlocks(t, body)
+	if strings.Join(blocks, ",") != "tool_use" || stopReason != "tool_use" {
+		t.Fatalf("blocks = %v, stop_reason = %q, body = %s", blocks, stopReason, body)
+	}
+	if strings.Contains(body, "tool_use name") {
+		t.Errorf("unclosed block leaked as text: %s", body)
+	}
+	// 开启修正时不提前输出参数，客户端收到的是修正后的 command
+	if inputs := anthropicToolInputs(t, body); len(inputs) != 1 || inputs[0] != `{"command":"ls -la","timeout":5}` {
+		t.Errorf("tool inputs = %q", inputs)
+	}
+	if len(up.requests) != 2 || !strings.Contains(up.requests[1].Messages[len(up.requests[1].Messages)-1].Parts[0].Text, "not closed") {
+		t.Errorf("unclosed block was not sent back for repair")
+	}
+}
+
+func TestOpenAIStreamToolCallProgress(t *testing.T) {
+	up := &fakeUpstream{replies: []fakeReply{{deltas: []string{
+		"<tool_use name=\"Bash\">\n<parameter name=\"command\">ls</parameter>\n",
+		"<parameter name=\"timeout\">5</parameter>\n</tool_use>",
+	}}}}
+	h := newTestHandler(up, withoutRepair)
+
+	w := serve(h, "/v1/chat/completions", `{"model":"gpt-5.2","stream":true,"tools":[{"type":"function","function":{"name":"Bash","parameters":{"type":"object","properties":{"command":{"type":"string"},"timeout":{"type":"integer"}}}}}],"messages":[{"role":"user","content":"hi"}]}`)
+	data := sseData(w.Body.String())
+	var names, args strings.Builder
+	for _, d := range data[:len(data)-1] {
+		var chunk ChatCompletionChunk
+		if err := json.Unmarshal([]byte(d), &chunk); err != nil {
+			t.Fatal(err)
+		}
+		for _, ch := range chunk.Choices {
+			for _, call := range ch.Delta.ToolCalls {
+				names.WriteString(call.Function.Name)
+				args.WriteString(call.Function.Arguments)
+			}
+		}
+	}
+	if names.String() != "Bash" || args.String() != `{"command":"ls","timeout":5}` {
+		t.Errorf("name = %q, arguments = %q", names.String(), args.String())
+	}
+}
+
+// anthropicBlock 流式响应中的一个内容块
+type anthropicBlock struct {
+	Type    string
+	Content string
+}
+
+// anthropicStreamContent 按顺序还原流式响应的内容块，并检查块的 index 连续且不重叠
+func anthropicStreamContent(t *testing.T, body string) []anthropicBlock {
+	t.Helper()
+	var blocks []anthropicBlock
+	open := -1
+	for _, d := range sseData(body) {
+		var ev struct {
+			Type         string `json:"type"`
+			Index        int    `json:"index"`
+			ContentBlock struct {
+				Type string `json:"type"`
+			} `json:"content_block"`
+			Delta struct {
+				Text        string `json:"text"`
+				Thinking    string `json:"thinking"`
+				PartialJSON string `json:"partial_json"`
+			} `json:"delta"`
+		}
+		if err := json.Unmarshal([]byte(d), &ev); err != nil {
+			t.Fatalf("bad event %s: %v", d, err)
+		}
+		switch ev.Type {
+		case "content_block_start":
+			if open >= 0 || ev.Index != len(blocks) {
+				t.Fatalf("block %d started at index %d while block %d is open", len(blocks), ev.Index, open)
+			}
+			open = ev.Index
+			blocks = append(blocks, anthropicBlock{Type: ev.ContentBlock.Type})
+		case "content_block_delta":
+			if ev.Index != open {
+				t.Fatalf("delta for index %d, open block is %d", ev.Index, open)
+			}
+			blocks[open].Content += ev.Delta.Text + ev.Delta.Thinking + ev.Delta.PartialJSON
+		case "content_block_stop":
+			if ev.Index != open {
+				t.Fatalf("stop for index %d, open block is %d", ev.Index, open)
+			}
+			open = -1
+		}
+	}
+	if open >= 0 {
+		t.Fatalf("block %d was never stopped", open)
+	}
+	return blocks
+}
+
+func TestStreamThinkingBetweenText(t *testing.T) {
+	text := func(s string) sse.Event { return sse.Event{Type: sse.TypeTextDelta, Delta: s} }
+	reasoning := func(s string) sse.Event { return sse.Event{Type: sse.TypeReasoningDelta, Delta: s} }
+	cases := []struct {
+		name   string
+		events []sse.Event
+		want   []anthropicBlock
+	}{
+		{
+			"text then reasoning then text",
+			// "ST" 可能是停止序列的开头，"<tool" 可能是调用块的开头，都应在推理之前输出
+			[]sse.Event{reasoning("plan"), text("First. ST"), text(" <tool"), reasoning("more"), text("Second.")},
+			[]anthropicBlock{{"thinking", "plan"}, {"text", "First. ST <tool"}, {"thinking", "more"}, {"text", "Second."}},
+		},
+		{
+			"reasoning inside a tool call",
+			[]sse.Event{
+				text("Run.\n<tool_use name=\"Bash\">\n<parameter name=\"command\">ls</parameter>\n"),
+				reasoning("wait"),
+				text("</tool_use>"),
+			},
+			[]anthropicBlock{{"text", "Run.\n"}, {"tool_use", `{"command":"ls"}`}, {"thinking", "wait"}},
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			up := &fakeUpstream{replies: []fakeReply{{events: tc.events}}}
+			h := newTestHandler(up, withoutRepair)
+			w := serve(h, "/v1/messages", `{"model":"claude-4.5-sonnet","max_tokens":4096,"stream":true,"stop_sequences":["STOP"],"thinking":{"type":"enabled","budget_tokens":1024},"tools":[`+bashTool+`],"messages":[{"role":"user","content":"hi"}]}`)
+			blocks := anthropicStreamContent(t, w.Body.String())
+			if !reflect.DeepEqual(blocks, tc.want) {
+				t.Errorf("blocks = %q, want %q", blocks, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,92 @@
+package handler
+
+import (
+	"crypto/rand"
+	"math/big"
+	"sync"
+	"time"
+)
+
+const (
+	toolCallTTL        = 24 * time.Hour // 发出的工具调用保留多久，用于之后的 tool_result 配对
+	maxToolCallRecords = 100000         // 最多保留的工具调用数
+)
+
+const idAlphabet = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+// randomID 生成 n 位随机 base62 字符串
+func randomID(n int) string {
+	b := make([]byte, n)
+	max := big.NewInt(int64(len(idAlphabet)))
+	for i := range b {
+		v, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			panic(err)
+		}
+		b[i] = idAlphabet[v.Int64()]
+	}
+	return string(b)
+}
+
+// newToolUseID 生成 Anthropic 格式的工具调用 ID，如 toolu_01AbC...
+func newToolUseID() string {
+	return "toolu_01" + randomID(22)
+}
+
+// newToolCallID 生成 OpenAI 格式的工具调用 ID，如 call_AbC...
+func newToolCallID() string {
+	return "call_" + randomID(24)
+}
+
+// toolCallLog 记录代理发出的工具调用 ID -> 工具名
+// 客户端只带回 tool_result 而历史中没有对应 tool_use 时（如裁剪过上下文），据此还原工具名
+type toolCallLog struct {
+	mu    sync.Mutex
+	names map[string]string
+	queue []toolCallRecord // 按记录时间排列，用于过期清理
+}
+
+type toolCallRecord struct {
+	id      string
+	expires time.Time
+}
+
+func newToolCallLog() *toolCallLog {
+	return &toolCallLog{names: make(map[string]string)}
+}
+
+// record 记录一个发给客户端的工具调用
+func (l *toolCallLog) record(id, name string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	for len(l.queue) > 0 && (now.After(l.queue[0].expires) || len(l.queue) >= maxToolCallRecords) {
+		delete(l.names, l.queue[0].id)
+		l.queue = l.queue[1:]
+	}
+	l.names[id] = name
+	l.queue = append(l.queue, toolCallRecord{id: id, expires: now.Add(toolCallTTL)})
+}
+
+// name 返回工具调用 ID 对应的工具名
+func (l *toolCallLog) name(id string) (string, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	name, ok := l.names[id]
+	return name, ok
+}
+
+// resolve 补全 names 中缺少的工具调用，ids 为历史中 tool_result 引用的 ID
+func (l *toolCallLog) resolve(names map[string]string, ids []string) {
+	for _, id := range ids {
+		if _, ok := names[id]; ok || id == "" {
+			continue
+		}
+		if name, ok := l.name(id); ok {
+			names[id] = name
+			continue
+		}
+		log.Warn("tool_result 引用了未知的工具调用 %s", id)
+	}
+}
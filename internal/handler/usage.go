@@ -0,0 +1,53 @@
+package handler
+
+import (
+	"cursor2api/internal/client"
+	"cursor2api/internal/config"
+	"cursor2api/internal/tokenizer"
+)
+
+// 每条消息的格式开销，以及回复前缀的开销（与 OpenAI chat 格式的计算方式一致）
+const (
+	tokensPerMessage = 3
+	tokensPerReply   = 3
+)
+
+// tokenUsage 一次请求的 token 用量
+type tokenUsage struct {
+	input  int
+	output int
+}
+
+// promptTokens 计算实际发给 Cursor 的提示的 token 数
+// 包括注入的工具提示和按 dialect 还原的工具调用历史，按模型配置的 tokenizer 计算
+func promptTokens(model config.ModelConfig, req client.CursorChatRequest) int {
+	n := tokensPerReply
+	for _, msg := range req.Messages {
+		n += tokensPerMessage + tokenizer.Count(model.Tokenizer, msg.Role)
+		for _, part := range msg.Parts {
+			n += tokenizer.Count(model.Tokenizer, part.Text)
+		}
+	}
+	return n
+}
+
+// completionTokens 计算模型实际输出的 token 数
+// 工具调用按模型输出的原文计算，推理内容也计入
+func completionTokens(model config.ModelConfig, result *cursorResult) int {
+	return tokenizer.Count(model.Tokenizer, result.Text()) + tokenizer.Count(model.Tokenizer, result.Reasoning())
+}
+
+// countUsage 返回请求的用量，上游报告了用量时优先使用上游数据
+func countUsage(model config.ModelConfig, req client.CursorChatRequest, result *cursorResult) tokenUsage {
+	var usage tokenUsage
+	if result.usage != nil {
+		usage = tokenUsage{input: result.usage.InputTokens, output: result.usage.OutputTokens}
+	}
+	if usage.input == 0 {
+		usage.input = promptTokens(model, req)
+	}
+	if usage.output == 0 {
+		usage.output = completionTokens(model, result)
+	}
+	return usage
+}
@@ -0,0 +1,147 @@
+// Package sse 提供 Cursor SSE 响应的增量解码
+// 基于 bufio 逐行读取，支持多行 data 字段、CRLF 换行以及跨多次读取的事件
+package sse
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"iter"
+)
+
+// Cursor SSE 事件类型（AI SDK UI message stream 协议）
+const (
+	TypeTextDelta       = "text-delta"
+	TypeReasoningDelta  = "reasoning-delta"
+	TypeFinish          = "finish"
+	TypeFinishStep      = "finish-step"
+	TypeError           = "error"
+	TypeMessageMetadata = "message-metadata"
+)
+
+// Event Cursor SSE 事件
+type Event struct {
+	Type            string                 `json:"type"`
+	ID              string                 `json:"id,omitempty"`
+	Delta           string                 `json:"delta,omitempty"`
+	FinishReason    string                 `json:"finishReason,omitempty"`
+	ErrorText       string                 `json:"errorText,omitempty"`
+	MessageMetadata map[string]interface{} `json:"messageMetadata,omitempty"`
+	Usage           *Usage                 `json:"usage,omitempty"`
+}
+
+// Usage 上游返回的 token 用量
+type Usage struct {
+	InputTokens  int `json:"inputTokens"`
+	OutputTokens int `json:"outputTokens"`
+}
+
+// Decoder 增量 SSE 解码器
+type Decoder struct {
+	r       *bufio.Reader
+	data    bytes.Buffer // 当前事件的 data 字段
+	err     error
+	skipped int // 无法解析的事件数
+}
+
+// NewDecoder 创建解码器
+func NewDecoder(r io.Reader) *Decoder {
+	br, ok := r.(*bufio.Reader)
+	if !ok {
+		br = bufio.NewReader(r)
+	}
+	return &Decoder{r: br}
+}
+
+// Next 读取下一个事件，流结束时返回 io.EOF
+// data 为空、[DONE] 或不是合法 JSON 的事件会被跳过
+func (d *Decoder) Next() (Event, error) {
+	for {
+		data, err := d.nextData()
+		if err != nil {
+			return Event{}, err
+		}
+		if len(data) == 0 || string(data) == "[DONE]" {
+			continue
+		}
+		var event Event
+		if err := json.Unmarshal(data, &event); err != nil {
+			d.skipped++
+			continue
+		}
+		return event, nil
+	}
+}
+
+// Events 以迭代器形式返回所有事件，读取错误通过 Err 获取
+func (d *Decoder) Events() iter.Seq[Event] {
+	return func(yield func(Event) bool) {
+		for {
+			event, err := d.Next()
+			if err != nil {
+				if err != io.EOF {
+					d.err = err
+				}
+				return
+			}
+			if !yield(event) {
+				return
+			}
+		}
+	}
+}
+
+// Err 返回 Events 迭代过程中遇到的读取错误（io.EOF 不算错误）
+func (d *Decoder) Err() error {
+	return d.err
+}
+
+// Skipped 返回因无法解析而跳过的事件数
+func (d *Decoder) Skipped() int {
+	return d.skipped
+}
+
+// nextData 读取到下一个空行（事件结束），返回拼接后的 data 字段
+func (d *Decoder) nextData() ([]byte, error) {
+	d.data.Reset()
+	hasData := false
+
+	for {
+		line, err := d.r.ReadBytes('\n')
+		if len(line) > 0 {
+			line = bytes.TrimRight(line, "\r\n")
+			if len(line) == 0 {
+				if hasData {
+					return d.data.Bytes(), nil
+				}
+			} else if d.appendField(line, hasData) {
+				hasData = true
+			}
+		}
+		if err != nil {
+			// 流结束时最后一个事件可能没有结尾空行
+			if err == io.EOF && hasData {
+				return d.data.Bytes(), nil
+			}
+			return nil, err
+		}
+	}
+}
+
+// appendField 处理一行字段，只关心 data 字段，多行 data 用换行拼接
+func (d *Decoder) appendField(line []byte, hasData bool) bool {
+	if line[0] == ':' {
+		return false // 注释行
+	}
+	name, value, found := bytes.Cut(line, []byte(":"))
+	if !found || string(name) != "data" {
+		return false
+	}
+	value = bytes.TrimPrefix(value, []byte(" "))
+	if hasData {
+		d.data.WriteByte('\n')
+	}
+	d.data.Write(value)
+	return true
+}
@@ -0,0 +1,140 @@
+package sse
+
+import (
+	"errors"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+// chunkReader 每次 Read 最多返回 n 字节，模拟事件被拆到多次网络读取中
+type chunkReader struct {
+	s string
+	n int
+}
+
+func (r *chunkReader) Read(p []byte) (int, error) {
+	if r.s == "" {
+		return 0, io.EOF
+	}
+	n := copy(p[:min(len(p), r.n)], r.s)
+	r.s = r.s[n:]
+	return n, nil
+}
+
+func TestDecoder(t *testing.T) {
+	cases := []struct {
+		name    string
+		stream  string
+		want    []Event
+		skipped int
+	}{
+		{
+			"single event",
+			"data: {\"type\":\"text-delta\",\"delta\":\"hi\"}\n\n",
+			[]Event{{Type: TypeTextDelta, Delta: "hi"}},
+			0,
+		},
+		{
+			"multi-line data",
+			"data: {\"type\":\"text-delta\",\ndata: \"delta\":\"hi\"}\n\n",
+			[]Event{{Type: TypeTextDelta, Delta: "hi"}},
+			0,
+		},
+		{
+			"crlf line endings",
+			"data: {\"type\":\"text-delta\",\"delta\":\"a\"}\r\n\r\ndata: {\"type\":\"finish\",\"finishReason\":\"stop\"}\r\n\r\n",
+			[]Event{{Type: TypeTextDelta, Delta: "a"}, {Type: TypeFinish, FinishReason: "stop"}},
+			0,
+		},
+		{
+			"missing trailing blank line",
+			"data: {\"type\":\"text-delta\",\"delta\":\"a\"}\n\ndata: {\"type\":\"finish\"}",
+			[]Event{{Type: TypeTextDelta, Delta: "a"}, {Type: TypeFinish}},
+			0,
+		},
+		{
+			"comment lines",
+			": keep-alive\n\ndata: {\"type\":\"text-delta\",\"delta\":\"a\"}\n: inside an event\n\n",
+			[]Event{{Type: TypeTextDelta, Delta: "a"}},
+			0,
+		},
+		{
+			"event and id fields",
+			"event: message\nid: 7\ndata: {\"type\":\"text-delta\",\"id\":\"t1\",\"delta\":\"a\"}\nretry: 100\n\n",
+			[]Event{{Type: TypeTextDelta, ID: "t1", Delta: "a"}},
+			0,
+		},
+		{
+			"data without a space",
+			"data:{\"type\":\"finish\"}\n\n",
+			[]Event{{Type: TypeFinish}},
+			0,
+		},
+		{
+			"done, empty and invalid data",
+			"data: [DONE]\n\ndata:\n\ndata: {oops\n\ndata: {\"type\":\"finish\"}\n\n",
+			[]Event{{Type: TypeFinish}},
+			1,
+		},
+		{
+			"blank lines between events",
+			"\n\ndata: {\"type\":\"finish\"}\n\n\n",
+			[]Event{{Type: TypeFinish}},
+			0,
+		},
+		{
+			"error and usage",
+			"data: {\"type\":\"error\",\"errorText\":\"rate limited\"}\n\ndata: {\"type\":\"finish-step\",\"usage\":{\"inputTokens\":3,\"outputTokens\":5}}\n\n",
+			[]Event{{Type: TypeError, ErrorText: "rate limited"}, {Type: TypeFinishStep, Usage: &Usage{InputTokens: 3, OutputTokens: 5}}},
+			0,
+		},
+	}
+
+	readers := []struct {
+		name string
+		wrap func(s string) io.Reader
+	}{
+		{"whole", func(s string) io.Reader { return strings.NewReader(s) }},
+		{"one byte", func(s string) io.Reader { return iotest.OneByteReader(strings.NewReader(s)) }},
+		{"split mid-line", func(s string) io.Reader { return &chunkReader{s: s, n: 7} }},
+	}
+
+	for _, tc := range cases {
+		for _, r := range readers {
+			t.Run(tc.name+"/"+r.name, func(t *testing.T) {
+				d := NewDecoder(r.wrap(tc.stream))
+				var got []Event
+				for event := range d.Events() {
+					got = append(got, event)
+				}
+				if err := d.Err(); err != nil {
+					t.Fatalf("Err() = %v", err)
+				}
+				if !reflect.DeepEqual(got, tc.want) {
+					t.Errorf("events = %+v, want %+v", got, tc.want)
+				}
+				if d.Skipped() != tc.skipped {
+					t.Errorf("skipped = %d, want %d", d.Skipped(), tc.skipped)
+				}
+			})
+		}
+	}
+}
+
+func TestDecoderReadError(t *testing.T) {
+	boom := errors.New("connection reset")
+	r := io.MultiReader(strings.NewReader("data: {\"type\":\"text-delta\",\"delta\":\"a\"}\n\ndata: {\"type\""), iotest.ErrReader(boom))
+	d := NewDecoder(r)
+
+	event, err := d.Next()
+	if err != nil || event.Delta != "a" {
+		t.Fatalf("first event = %+v, %v", event, err)
+	}
+	// 读到一半的事件不输出，返回读取错误
+	if _, err := d.Next(); !errors.Is(err, boom) {
+		t.Fatalf("err = %v, want %v", err, boom)
+	}
+}
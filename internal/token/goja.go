@@ -0,0 +1,142 @@
+package token
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/dop251/goja"
+	"github.com/dop251/goja_nodejs/eventloop"
+)
+
+// gojaProvider 使用内嵌的 goja 引擎执行 buildJSCode 生成的脚本，无需安装 Node.js
+type gojaProvider struct {
+	pool *Pool
+}
+
+// gojaResult 脚本执行结果
+type gojaResult struct {
+	token string
+	err   error
+}
+
+// Name 后端名称
+func (j *gojaProvider) Name() string {
+	return ProviderGoja
+}
+
+// Generate 在 goja 中执行与 node 后端相同的 JS 代码生成 token
+func (j *gojaProvider) Generate(ctx context.Context) (string, error) {
+	p := j.pool
+	if p.cfg.ScriptURL == "" {
+		return "", fmt.Errorf("script_url not configured")
+	}
+
+	cursorJS, err := p.fetchCursorScript(ctx)
+	if err != nil {
+		return "", fmt.Errorf("fetch cursor script: %w", err)
+	}
+	return runGoja(ctx, p.buildJSCode(cursorJS))
+}
+
+// runGoja 执行 main.js 模板生成的代码，返回其通过 console.log 输出的第一行
+func runGoja(ctx context.Context, code string) (string, error) {
+	result := make(chan gojaResult, 1)
+	interrupt := make(chan func() bool, 1)
+	send := func(r gojaResult) {
+		select {
+		case result <- r:
+		default:
+		}
+	}
+
+	loop := eventloop.NewEventLoop(eventloop.EnableConsole(false))
+	loop.Start()
+	defer func() {
+		loop.Terminate()
+		select {
+		case stop := <-interrupt:
+			stop()
+		default:
+		}
+	}()
+
+	loop.RunOnLoop(func(vm *goja.Runtime) {
+		// 脚本开始前注册中断：ctx 结束时中断正在执行的脚本，避免 Terminate 一直等待；
+		// ctx 已经结束时脚本一开始就会被中断
+		interrupt <- context.AfterFunc(ctx, func() {
+			vm.Interrupt(context.Cause(ctx))
+		})
+
+		// 与 node 一样，被拒绝的 promise 在当前任务的微任务执行完后仍没有处理函数才算未处理
+		// 否则 main.js 末尾的 then 链被拒绝时不会有任何输出，只能等到超时
+		unhandled := make(map[*goja.Promise]struct{})
+		vm.SetPromiseRejectionTracker(func(p *goja.Promise, op goja.PromiseRejectionOperation) {
+			switch op {
+			case goja.PromiseRejectionReject:
+				unhandled[p] = struct{}{}
+				loop.RunOnLoop(func(*goja.Runtime) {
+					if _, ok := unhandled[p]; ok {
+						send(gojaResult{err: fmt.Errorf("goja unhandled rejection: %s", rejectionReason(p.Result()))})
+					}
+				})
+			case goja.PromiseRejectionHandle:
+				delete(unhandled, p)
+			}
+		})
+
+		setupGojaGlobals(vm, func(line string) {
+			send(gojaResult{token: strings.TrimSpace(line)})
+		})
+		if _, err := vm.RunScript("cursor_token.js", code); err != nil {
+			send(gojaResult{err: fmt.Errorf("goja error: %w", err)})
+		}
+	})
+
+	select {
+	case r := <-result:
+		return r.token, r.err
+	case <-ctx.Done():
+		return "", fmt.Errorf("goja interrupted: %w", context.Cause(ctx))
+	}
+}
+
+// rejectionReason 返回 promise 被拒绝的原因，Error 对象优先使用调用栈
+func rejectionReason(reason goja.Value) string {
+	if obj, ok := reason.(*goja.Object); ok {
+		if stack := obj.Get("stack"); stack != nil && !goja.IsUndefined(stack) {
+			return stack.String()
+		}
+	}
+	if reason == nil {
+		return "undefined"
+	}
+	return reason.String()
+}
+
+// setupGojaGlobals 补齐 main.js/env.js 依赖的 Node.js 全局对象
+func setupGojaGlobals(vm *goja.Runtime, onLog func(line string)) {
+	_ = vm.Set("global", vm.GlobalObject())
+
+	console := vm.NewObject()
+	_ = console.Set("log", func(call goja.FunctionCall) goja.Value {
+		args := make([]string, len(call.Arguments))
+		for i, arg := range call.Arguments {
+			args[i] = arg.String()
+		}
+		onLog(strings.Join(args, " "))
+		return goja.Undefined()
+	})
+	for _, name := range []string{"info", "warn", "error", "debug"} {
+		_ = console.Set(name, func(goja.FunctionCall) goja.Value { return goja.Undefined() })
+	}
+	_ = vm.Set("console", console)
+}
+
+// Health goja 内嵌在进程中，只需检查内嵌的 JS 模板是否为空
+func (j *gojaProvider) Health(ctx context.Context) error {
+	if j.pool.envJS == "" || j.pool.mainJS == "" {
+		return fmt.Errorf("embedded env.js or main.js is empty")
+	}
+	return nil
+}
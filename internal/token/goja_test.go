@@ -0,0 +1,153 @@
+package token
+
+import (
+	"context"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+
+	"cursor2api/internal/config"
+	"cursor2api/jscode"
+)
+
+func TestRunGoja(t *testing.T) {
+	cases := []struct {
+		name    string
+		code    string
+		want    string
+		wantErr string
+	}{
+		{"resolved", `Promise.resolve(1).then(v => console.log("token-" + v))`, "token-1", ""},
+		{"handled rejection", `const p = Promise.reject(new Error("boom")); p.catch(() => console.log("recovered"))`, "recovered", ""},
+		{"unhandled rejection", `Promise.reject(new Error("boom")).then(v => console.log(v))`, "", "boom"},
+		{"async rejection", `setTimeout(() => Promise.reject("late"), 10)`, "", "late"},
+		{"syntax error", `{`, "", "goja error"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			got, err := runGoja(ctx, tc.code)
+			if ctx.Err() != nil {
+				t.Fatalf("runGoja waited for the timeout: %v", err)
+			}
+			if tc.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+					t.Fatalf("err = %v, want %q", err, tc.wantErr)
+				}
+				return
+			}
+			if err != nil || got != tc.want {
+				t.Fatalf("got %q, %v, want %q", got, err, tc.want)
+			}
+		})
+	}
+}
+
+// parityScript 代替 Cursor 验证脚本，输出依赖 env.js 模拟的浏览器环境和指纹
+const parityScript = `window.V_C = [async function () {
+	const canvas = document.createElement("canvas");
+	return {
+		ua: window.navigator.userAgent,
+		script: cursor_config.currentScriptSrc,
+		vendor: cursor_config.fp.UNMASKED_VENDOR_WEBGL,
+		renderer: cursor_config.fp.UNMASKED_RENDERER_WEBGL,
+		types: [typeof window, typeof document, typeof window.navigator, typeof canvas.getContext, typeof window.location],
+	};
+}];`
+
+// newParityPool 返回使用内嵌模板、脚本缓存已命中 parityScript 的 Pool
+func newParityPool() *Pool {
+	cfg := &config.Config{
+		ScriptURL: "https://cursor.com/test/c.js",
+		Fingerprint: config.FingerprintConfig{
+			UnmaskedVendorWebGL:   "Google Inc. (Intel)",
+			UnmaskedRendererWebGL: "ANGLE (Intel)",
+			UserAgent:             "Mozilla/5.0 (Windows NT 10.0; Win64; x64) Chrome/140.0.0.0",
+		},
+	}
+	scripts := &scriptCache{url: cfg.ScriptURL, ttl: time.Hour, content: parityScript}
+	scripts.meta.FetchedAt = time.Now()
+	return &Pool{cfg: cfg, scripts: scripts, envJS: jscode.Env, mainJS: jscode.Main}
+}
+
+func TestGojaNodeParity(t *testing.T) {
+	if _, err := exec.LookPath("node"); err != nil {
+		t.Skip("node not installed")
+	}
+	p := newParityPool()
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	want, err := (&nodeProvider{pool: p}).Generate(ctx)
+	if err != nil {
+		t.Fatalf("node: %v", err)
+	}
+	got, err := (&gojaProvider{pool: p}).Generate(ctx)
+	if err != nil {
+		t.Fatalf("goja: %v", err)
+	}
+	if got != want {
+		t.Fatalf("goja output differs from node\ngoja: %s\nnode: %s", got, want)
+	}
+	if !strings.Contains(want, p.cfg.Fingerprint.UserAgent) {
+		t.Errorf("fingerprint not applied: %s", want)
+	}
+}
+
+func TestNewProviderGoja(t *testing.T) {
+	cases := []struct {
+		name      string
+		provider  string
+		templates bool
+		want      string
+	}{
+		{"templates loaded", "", true, "node -> goja"},
+		{"templates missing", "", false, "node"},
+		{"configured", ProviderGoja, false, "goja -> node"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			p := &Pool{cfg: &config.Config{TokenProvider: tc.provider}}
+			if tc.templates {
+				p.envJS, p.mainJS = jscode.Env, jscode.Main
+			}
+			if got := p.newProvider().Name(); got != tc.want {
+				t.Errorf("providers = %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestRunGojaInterrupt(t *testing.T) {
+	cases := []struct {
+		name   string
+		cancel func(cancel context.CancelFunc)
+	}{
+		// ctx 在脚本开始前就已结束，脚本开始时即被中断
+		{"cancelled before start", func(cancel context.CancelFunc) { cancel() }},
+		{"cancelled while running", func(cancel context.CancelFunc) { time.AfterFunc(50*time.Millisecond, cancel) }},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			tc.cancel(cancel)
+
+			done := make(chan error, 1)
+			go func() {
+				_, err := runGoja(ctx, `for (;;) {}`)
+				done <- err
+			}()
+			select {
+			case err := <-done:
+				if err == nil || !strings.Contains(err.Error(), "interrupted") {
+					t.Fatalf("err = %v, want the script interrupted", err)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("runGoja did not return after ctx was cancelled")
+			}
+		})
+	}
+}
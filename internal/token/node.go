@@ -0,0 +1,86 @@
+package token
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// nodeProvider 使用本地 Node.js 执行 Cursor 脚本生成 token
+// workers 不为空时使用常驻 worker 池，否则每个 token 启动一个 node 进程
+type nodeProvider struct {
+	pool    *Pool
+	workers *workerPool
+}
+
+// Name 后端名称
+func (n *nodeProvider) Name() string {
+	return ProviderNode
+}
+
+// Generate 使用 Node.js 生成 token
+func (n *nodeProvider) Generate(ctx context.Context) (string, error) {
+	p := n.pool
+	if p.cfg.ScriptURL == "" {
+		return "", fmt.Errorf("script_url not configured")
+	}
+
+	// 获取 Cursor 脚本
+	cursorJS, err := p.fetchCursorScript(ctx)
+	if err != nil {
+		return "", fmt.Errorf("fetch cursor script: %w", err)
+	}
+
+	if n.workers != nil {
+		return n.workers.run(ctx, workerJob{
+			Script:      cursorJS,
+			ScriptURL:   p.cfg.ScriptURL,
+			Fingerprint: newJSFingerprint(p.cfg.Fingerprint),
+		})
+	}
+
+	// 构建 JS 代码
+	code := p.buildJSCode(cursorJS)
+
+	// 写入临时文件执行（避免 argument list too long）
+	tmpFile, err := os.CreateTemp("", "cursor_token_*.js")
+	if err != nil {
+		return "", fmt.Errorf("create temp file: %w", err)
+	}
+	tmpPath := tmpFile.Name()
+	defer os.Remove(tmpPath)
+
+	if _, err := tmpFile.WriteString(code); err != nil {
+		tmpFile.Close()
+		return "", fmt.Errorf("write temp file: %w", err)
+	}
+	tmpFile.Close()
+
+	// 使用 Node.js 执行临时文件，ctx 结束时杀掉进程
+	cmd := exec.CommandContext(ctx, "node", tmpPath)
+	output, err := cmd.Output()
+	if err != nil {
+		if ctx.Err() != nil {
+			return "", fmt.Errorf("node killed: %w", context.Cause(ctx))
+		}
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			return "", fmt.Errorf("node error: %s", string(exitErr.Stderr))
+		}
+		return "", fmt.Errorf("execute node: %w", err)
+	}
+
+	return strings.TrimSpace(string(output)), nil
+}
+
+// Health 检查 node 是否可执行以及 JS 模板是否已加载
+func (n *nodeProvider) Health(ctx context.Context) error {
+	if n.pool.envJS == "" || n.pool.mainJS == "" {
+		return fmt.Errorf("embedded env.js or main.js is empty")
+	}
+	if err := exec.CommandContext(ctx, "node", "--version").Run(); err != nil {
+		return fmt.Errorf("node not available: %w", err)
+	}
+	return nil
+}
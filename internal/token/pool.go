@@ -2,9 +2,10 @@
 package token
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
-	"os"
-	"os/exec"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -12,8 +13,8 @@ import (
 
 	"cursor2api/internal/config"
 	"cursor2api/internal/logger"
+	"cursor2api/jscode"
 
-	"github.com/enetx/g"
 	"github.com/enetx/surf"
 )
 
@@ -21,34 +22,52 @@ var log = logger.Get().WithPrefix("TokenPool")
 
 // Pool Token 池管理器
 type Pool struct {
-	tokens     map[string]*TokenEntry // name -> token
-	nameMap    map[string]string      // apiKey -> name (用于显示)
+	tokens     map[string]*TokenEntry // API Key 的 SHA-256 -> token（per_key），不保存 Key 原文
 	roundRobin []*TokenEntry          // 轮询 token 池
 	rrIndex    int32                  // 轮询索引
 	client     *surf.Client
+	scripts    *scriptCache // Cursor 验证脚本缓存
 	cfg        *config.Config
 	mu         sync.RWMutex
 	envJS      string
 	mainJS     string
+	provider   *fallbackProvider // token 生成后端
+	health     map[string]string // 后台定期检查的各后端健康状态
+	healthMu   sync.RWMutex
 	stopChan   chan struct{}
-	nextID     int32 // 用于生成 token 名称
-	hitCount   int64 // 缓存命中次数
-	missCount  int64 // 缓存未命中次数
-	poolSize   int   // 轮询池大小
+	nextID     int32  // 用于生成 token 名称
+	hitCount   int64  // 缓存命中次数
+	missCount  int64  // 缓存未命中次数
+	poolSize   int    // 轮询池大小
+	maxKeys    int    // per_key 最多缓存的 token 数
+	strategy   string // token 使用策略
 }
 
 // TokenEntry Token 条目
 type TokenEntry struct {
 	Name      string // token 名称，如 "Token-1", "Token-2"
+	Key       string // 用于显示的截断 API Key（per_key）
 	Token     string
 	CreatedAt time.Time
-	UseCount  int64 // 使用次数
+	UseCount  int64        // 使用次数
+	lastUsed  atomic.Int64 // 最近一次使用的时间（UnixNano），per_key 缓存满时据此淘汰
 	mu        sync.Mutex
 }
 
+// Token 使用策略
+const (
+	StrategyFresh      = "fresh"       // 每次请求生成新 token
+	StrategyRoundRobin = "round_robin" // 从预热的轮询池中取 token
+	StrategyPerKey     = "per_key"     // 每个 API Key 缓存一个 token
+)
+
 const (
 	tokenExpiry     = 25 * time.Minute // token 有效期
 	refreshInterval = 20 * time.Minute // 刷新间隔（提前5分钟刷新）
+	generateTimeout = 30 * time.Second // 后台生成 token 的超时
+	healthInterval  = time.Minute      // 后台检查 token 后端健康状态的间隔
+	maxPerKeyTokens = 1000             // per_key 最多缓存的 token 数，超出时淘汰最久未使用的
+	sweepInterval   = 5 * time.Minute  // 清理过期 per_key token 的间隔
 )
 
 var (
@@ -64,12 +83,22 @@ func GetPool() *Pool {
 		if poolSize <= 0 {
 			poolSize = 3 // 默认 3 个 token 轮询
 		}
+		strategy := cfg.TokenStrategy
+		switch strategy {
+		case StrategyFresh, StrategyRoundRobin, StrategyPerKey:
+		default:
+			if strategy != "" {
+				log.Warn("未知的 token_strategy: %s，使用 %s", strategy, StrategyFresh)
+			}
+			strategy = StrategyFresh
+		}
 		instance = &Pool{
 			tokens:     make(map[string]*TokenEntry),
-			nameMap:    make(map[string]string),
 			roundRobin: make([]*TokenEntry, 0, poolSize),
 			cfg:        cfg,
 			poolSize:   poolSize,
+			maxKeys:    maxPerKeyTokens,
+			strategy:   strategy,
 		}
 		instance.init()
 	})
@@ -81,59 +110,73 @@ func (p *Pool) init() {
 	p.client = surf.NewClient().Builder().Impersonate().Chrome().Build()
 	p.stopChan = make(chan struct{})
 
-	// 加载 JS 模板
-	envJS, err := os.ReadFile("jscode/env.js")
-	if err != nil {
-		log.Warn("failed to load env.js: %v", err)
-	}
-	p.envJS = string(envJS)
+	// 初始化脚本缓存
+	scriptTTL := time.Duration(p.cfg.ScriptCacheTTL) * time.Second
+	p.scripts = newScriptCache(p.client, p.cfg.ScriptURL, p.cfg.ScriptCacheDir, scriptTTL)
 
-	mainJS, err := os.ReadFile("jscode/main.js")
-	if err != nil {
-		log.Warn("failed to load main.js: %v", err)
+	// JS 模板编译时内嵌
+	p.envJS = jscode.Env
+	p.mainJS = jscode.Main
+
+	// 初始化 token 后端并检查可用性
+	p.provider = p.newProvider()
+	log.Info("token 后端: %s", p.provider.Name())
+	p.checkHealth()
+	go p.backgroundHealth()
+
+	log.Info("token 策略: %s", p.strategy)
+
+	// 只有轮询策略需要预热和后台刷新
+	if p.strategy == StrategyRoundRobin {
+		p.warmRoundRobin()
+		go p.backgroundRefresh()
+	}
+	// per_key 按需生成，只需定期清理过期条目
+	if p.strategy == StrategyPerKey {
+		go p.sweepPerKey()
 	}
-	p.mainJS = string(mainJS)
 
-	// 预生成轮询 token 池
+	log.Info("Initialized (轮询池: %d)", len(p.roundRobin))
+}
+
+// warmRoundRobin 预生成轮询 token 池
+// 预热失败的条目保留为空，首次使用时再生成
+func (p *Pool) warmRoundRobin() {
 	log.Info("预热 %d 个 token...", p.poolSize)
 	for i := 0; i < p.poolSize; i++ {
-		tokenStr, err := p.generateToken()
+		entry := &TokenEntry{Name: p.generateName()}
+		p.roundRobin = append(p.roundRobin, entry)
+
+		tokenStr, err := p.generateTokenWithTimeout()
 		if err != nil {
 			log.Error("预热 token %d 失败: %v", i+1, err)
 			continue
 		}
-		name := p.generateName()
-		entry := &TokenEntry{
-			Name:      name,
-			Token:     tokenStr,
-			CreatedAt: time.Now(),
-		}
-		p.roundRobin = append(p.roundRobin, entry)
-		log.Info("预热 %s 完成 (%d/%d)", name, i+1, p.poolSize)
+		entry.Token = tokenStr
+		entry.CreatedAt = time.Now()
+		log.Info("预热 %s 完成 (%d/%d)", entry.Name, i+1, p.poolSize)
 	}
-
-	// 启动后台刷新协程
-	go p.backgroundRefresh()
-
-	log.Info("Initialized (轮询池: %d)", len(p.roundRobin))
 }
 
 // preWarmToken 预热 token
 func (p *Pool) preWarmToken(apiKey string) {
-	tokenStr, err := p.generateToken()
+	tokenStr, err := p.generateTokenWithTimeout()
 	if err != nil {
 		log.Error("Pre-warm failed: %v", err)
 		return
 	}
 
 	name := p.generateName()
-	p.mu.Lock()
-	p.tokens[apiKey] = &TokenEntry{
+	entry := &TokenEntry{
 		Name:      name,
+		Key:       truncateKey(apiKey),
 		Token:     tokenStr,
 		CreatedAt: time.Now(),
 	}
-	p.nameMap[apiKey] = name
+	entry.touch()
+	p.mu.Lock()
+	p.evictPerKey()
+	p.tokens[hashKey(apiKey)] = entry
 	p.mu.Unlock()
 
 	log.Info("Pre-warmed %s for key: %s", name, truncateKey(apiKey))
@@ -173,20 +216,104 @@ func (p *Pool) refreshAllTokens() {
 	log.Info("后台刷新完成 (轮询池: %d)", poolLen)
 }
 
-// GetToken 获取 Token（每次生成新 token）
-func (p *Pool) GetToken(apiKey string) (string, error) {
-	// 每次请求生成新 token，避免被 Cursor 检测到重复使用
+// GetToken 按配置的策略获取 Token
+// ctx 取消或超时会终止正在运行的 node 进程
+func (p *Pool) GetToken(ctx context.Context, apiKey string) (string, error) {
+	switch p.strategy {
+	case StrategyRoundRobin:
+		return p.getRoundRobinToken(ctx)
+	case StrategyPerKey:
+		return p.getPerKeyToken(ctx, apiKey)
+	default:
+		return p.getFreshToken(ctx)
+	}
+}
+
+// getFreshToken 每次请求生成新 token，避免被 Cursor 检测到重复使用
+func (p *Pool) getFreshToken(ctx context.Context) (string, error) {
 	log.Debug("生成新 token...")
-	tokenStr, err := p.generateToken()
+	atomic.AddInt64(&p.missCount, 1)
+	tokenStr, err := p.generateToken(ctx)
 	if err != nil {
 		log.Error("生成 token 失败: %v", err)
 		return "", err
 	}
-	atomic.AddInt64(&p.hitCount, 1)
 	log.Debug("新 token 生成成功")
 	return tokenStr, nil
 }
 
+// getRoundRobinToken 按 rrIndex 轮流使用预热的 token，过期或为空时当场刷新
+func (p *Pool) getRoundRobinToken(ctx context.Context) (string, error) {
+	p.mu.RLock()
+	poolLen := len(p.roundRobin)
+	if poolLen == 0 {
+		p.mu.RUnlock()
+		return p.getFreshToken(ctx)
+	}
+	idx := int(uint32(atomic.AddInt32(&p.rrIndex, 1)-1) % uint32(poolLen))
+	entry := p.roundRobin[idx]
+	p.mu.RUnlock()
+
+	entry.mu.Lock()
+	defer entry.mu.Unlock()
+
+	if entry.valid() {
+		atomic.AddInt64(&p.hitCount, 1)
+		entry.UseCount++
+		log.Debug("使用 %s (第 %d 次)", entry.Name, entry.UseCount)
+		return entry.Token, nil
+	}
+
+	atomic.AddInt64(&p.missCount, 1)
+	tokenStr, err := p.generateToken(ctx)
+	if err != nil {
+		log.Error("刷新 %s 失败: %v", entry.Name, err)
+		return "", err
+	}
+	entry.Token = tokenStr
+	entry.CreatedAt = time.Now()
+	entry.UseCount = 1
+	log.Info("按需刷新 %s 完成", entry.Name)
+	return tokenStr, nil
+}
+
+// getPerKeyToken 每个 API Key 使用独立缓存的 token
+func (p *Pool) getPerKeyToken(ctx context.Context, apiKey string) (string, error) {
+	if apiKey == "" {
+		apiKey = "default"
+	}
+
+	p.mu.RLock()
+	entry, exists := p.tokens[hashKey(apiKey)]
+	p.mu.RUnlock()
+
+	if exists {
+		entry.touch()
+		entry.mu.Lock()
+		if entry.valid() {
+			entry.UseCount++
+			tokenStr := entry.Token
+			entry.mu.Unlock()
+			atomic.AddInt64(&p.hitCount, 1)
+			return tokenStr, nil
+		}
+		entry.mu.Unlock()
+	}
+
+	atomic.AddInt64(&p.missCount, 1)
+	return p.refreshToken(ctx, apiKey)
+}
+
+// valid token 非空且未过期（调用方需持有 entry.mu）
+func (e *TokenEntry) valid() bool {
+	return e.Token != "" && time.Since(e.CreatedAt) < tokenExpiry
+}
+
+// touch 记录最近一次使用时间
+func (e *TokenEntry) touch() {
+	e.lastUsed.Store(time.Now().UnixNano())
+}
+
 // refreshRoundRobinToken 刷新轮询池中指定索引的 token
 func (p *Pool) refreshRoundRobinToken(idx int) {
 	p.mu.RLock()
@@ -200,12 +327,12 @@ func (p *Pool) refreshRoundRobinToken(idx int) {
 	entry.mu.Lock()
 	defer entry.mu.Unlock()
 
-	// 双重检查
-	if time.Since(entry.CreatedAt) < tokenExpiry {
+	// 双重检查：刚被按需刷新过的 token 撑得到下一轮刷新，跳过
+	if entry.Token != "" && time.Since(entry.CreatedAt) < tokenExpiry-refreshInterval {
 		return
 	}
 
-	tokenStr, err := p.generateToken()
+	tokenStr, err := p.generateTokenWithTimeout()
 	if err != nil {
 		log.Error("刷新 %s 失败: %v", entry.Name, err)
 		return
@@ -217,37 +344,93 @@ func (p *Pool) refreshRoundRobinToken(idx int) {
 }
 
 // refreshToken 刷新指定 API Key 的 Token
-func (p *Pool) refreshToken(apiKey string) (string, error) {
+func (p *Pool) refreshToken(ctx context.Context, apiKey string) (string, error) {
+	key := hashKey(apiKey)
 	p.mu.Lock()
-	entry, exists := p.tokens[apiKey]
+	entry, exists := p.tokens[key]
 	if !exists {
-		name := p.generateName()
-		entry = &TokenEntry{Name: name}
-		p.tokens[apiKey] = entry
-		p.nameMap[apiKey] = name
+		p.evictPerKey()
+		entry = &TokenEntry{Name: p.generateName(), Key: truncateKey(apiKey)}
+		entry.touch()
+		p.tokens[key] = entry
 	}
 	p.mu.Unlock()
 
 	entry.mu.Lock()
 	defer entry.mu.Unlock()
 
-	// 双重检查
-	if time.Since(entry.CreatedAt) < tokenExpiry && entry.Token != "" {
+	// 双重检查（并发请求可能已刷新）
+	if entry.valid() {
+		entry.UseCount++
 		return entry.Token, nil
 	}
 
-	tokenStr, err := p.generateToken()
+	tokenStr, err := p.generateToken(ctx)
 	if err != nil {
 		return "", err
 	}
 
 	entry.Token = tokenStr
 	entry.CreatedAt = time.Now()
+	entry.UseCount = 1
 
 	log.Info("Created %s for key: %s (total: %d)", entry.Name, truncateKey(apiKey), p.Count())
 	return tokenStr, nil
 }
 
+// evictPerKey 缓存已满时淘汰最久未使用的 per_key 条目，调用方需持有 p.mu
+func (p *Pool) evictPerKey() {
+	for len(p.tokens) > 0 && len(p.tokens) >= p.maxKeys {
+		var oldestKey string
+		var oldest int64
+		for key, entry := range p.tokens {
+			if used := entry.lastUsed.Load(); oldestKey == "" || used < oldest {
+				oldestKey, oldest = key, used
+			}
+		}
+		log.Debug("per_key token 数达到上限 %d，淘汰 %s", p.maxKeys, p.tokens[oldestKey].Name)
+		delete(p.tokens, oldestKey)
+	}
+}
+
+// sweepPerKey 定期删除过期的 per_key token
+func (p *Pool) sweepPerKey() {
+	ticker := time.NewTicker(sweepInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			p.removeExpired()
+		case <-p.stopChan:
+			return
+		}
+	}
+}
+
+// removeExpired 删除过期或生成失败的 per_key token，正在生成的条目跳过，返回删除的数量
+func (p *Pool) removeExpired() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	removed := 0
+	for key, entry := range p.tokens {
+		if !entry.mu.TryLock() {
+			continue
+		}
+		expired := !entry.valid()
+		entry.mu.Unlock()
+		if expired {
+			delete(p.tokens, key)
+			removed++
+		}
+	}
+	if removed > 0 {
+		log.Info("清理 %d 个过期 token (剩余: %d)", removed, len(p.tokens))
+	}
+	return removed
+}
+
 // Count 返回 token 总数
 func (p *Pool) Count() int {
 	p.mu.RLock()
@@ -256,9 +439,10 @@ func (p *Pool) Count() int {
 }
 
 // Stats 返回统计信息
+// total 为当前缓存的 token 数（per_key 条目 + 轮询池条目）
 func (p *Pool) Stats() (total int, hits, misses int64) {
 	p.mu.RLock()
-	total = len(p.tokens)
+	total = len(p.tokens) + len(p.roundRobin)
 	p.mu.RUnlock()
 	hits = atomic.LoadInt64(&p.hitCount)
 	misses = atomic.LoadInt64(&p.missCount)
@@ -270,83 +454,109 @@ func (p *Pool) List() []map[string]any {
 	p.mu.RLock()
 	defer p.mu.RUnlock()
 
-	result := make([]map[string]any, 0, len(p.tokens))
-	for key, entry := range p.tokens {
-		result = append(result, map[string]any{
-			"name":    entry.Name,
-			"key":     truncateKey(key),
-			"uses":    entry.UseCount,
-			"age":     time.Since(entry.CreatedAt).Round(time.Second).String(),
-			"expires": (tokenExpiry - time.Since(entry.CreatedAt)).Round(time.Second).String(),
-		})
+	result := make([]map[string]any, 0, len(p.tokens)+len(p.roundRobin))
+	for _, entry := range p.tokens {
+		result = append(result, entry.info(entry.Key))
+	}
+	for _, entry := range p.roundRobin {
+		result = append(result, entry.info(StrategyRoundRobin))
 	}
 	return result
 }
 
-// generateToken 使用 Node.js 生成 token
-func (p *Pool) generateToken() (string, error) {
-	if p.cfg.ScriptURL == "" {
-		return "", fmt.Errorf("script_url not configured")
+// info 返回 token 条目的展示信息
+func (e *TokenEntry) info(key string) map[string]any {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return map[string]any{
+		"name":    e.Name,
+		"key":     key,
+		"uses":    e.UseCount,
+		"age":     time.Since(e.CreatedAt).Round(time.Second).String(),
+		"expires": (tokenExpiry - time.Since(e.CreatedAt)).Round(time.Second).String(),
 	}
+}
 
-	// 获取 Cursor 脚本
-	cursorJS, err := p.fetchCursorScript()
-	if err != nil {
-		return "", fmt.Errorf("fetch cursor script: %w", err)
-	}
+// generateTokenWithTimeout 在后台任务中生成 token（预热、定时刷新）
+func (p *Pool) generateTokenWithTimeout() (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), generateTimeout)
+	defer cancel()
+	return p.generateToken(ctx)
+}
 
-	// 构建 JS 代码
-	code := p.buildJSCode(cursorJS)
+// generateToken 通过配置的后端生成 token
+func (p *Pool) generateToken(ctx context.Context) (string, error) {
+	return p.provider.Generate(ctx)
+}
 
-	// 写入临时文件执行（避免 argument list too long）
-	tmpFile, err := os.CreateTemp("", "cursor_token_*.js")
-	if err != nil {
-		return "", fmt.Errorf("create temp file: %w", err)
+// Health 返回最近一次后台检查的各 token 后端健康状态，不会触发检查
+func (p *Pool) Health() map[string]string {
+	p.healthMu.RLock()
+	defer p.healthMu.RUnlock()
+	result := make(map[string]string, len(p.health))
+	for name, status := range p.health {
+		result[name] = status
 	}
-	tmpPath := tmpFile.Name()
-	defer os.Remove(tmpPath)
+	return result
+}
 
-	if _, err := tmpFile.WriteString(code); err != nil {
-		tmpFile.Close()
-		return "", fmt.Errorf("write temp file: %w", err)
+// Healthy 最近一次检查时是否有可用的 token 后端
+func (p *Pool) Healthy() bool {
+	for _, status := range p.Health() {
+		if status == "ok" {
+			return true
+		}
 	}
-	tmpFile.Close()
+	return false
+}
 
-	// 使用 Node.js 执行临时文件
-	cmd := exec.Command("node", tmpPath)
-	output, err := cmd.Output()
-	if err != nil {
-		if exitErr, ok := err.(*exec.ExitError); ok {
-			return "", fmt.Errorf("node error: %s", string(exitErr.Stderr))
+// backgroundHealth 定期检查 token 后端健康状态
+// 检查会启动 node 进程、请求外部服务，不能放在 /status 等请求路径上
+func (p *Pool) backgroundHealth() {
+	ticker := time.NewTicker(healthInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			p.checkHealth()
+		case <-p.stopChan:
+			return
 		}
-		return "", fmt.Errorf("execute node: %w", err)
 	}
-
-	return strings.TrimSpace(string(output)), nil
 }
 
-// fetchCursorScript 获取 Cursor 验证脚本
-func (p *Pool) fetchCursorScript() (string, error) {
-	headers := map[string]string{
-		"sec-ch-ua-arch":             `"x86"`,
-		"sec-ch-ua-platform":         `"Windows"`,
-		"sec-ch-ua":                  `"Chromium";v="140", "Not=A?Brand";v="24", "Google Chrome";v="140"`,
-		"sec-ch-ua-bitness":          `"64"`,
-		"sec-ch-ua-mobile":           "?0",
-		"sec-ch-ua-platform-version": `"19.0.0"`,
-		"sec-fetch-site":             "same-origin",
-		"sec-fetch-mode":             "no-cors",
-		"sec-fetch-dest":             "script",
-		"referer":                    "https://cursor.com/",
-		"accept-language":            "zh-CN,zh;q=0.9,en;q=0.8",
-	}
+// checkHealth 检查所有后端并保存结果，状态变为不可用时记录日志
+func (p *Pool) checkHealth() {
+	ctx, cancel := context.WithTimeout(context.Background(), generateTimeout)
+	defer cancel()
+	health := p.provider.HealthAll(ctx)
+
+	p.healthMu.Lock()
+	prev := p.health
+	p.health = health
+	p.healthMu.Unlock()
 
-	resp := p.client.Get(g.String(p.cfg.ScriptURL)).SetHeaders(headers).Do()
-	if resp.IsErr() {
-		return "", fmt.Errorf("fetch script: %w", resp.Err())
+	for name, status := range health {
+		if status == prev[name] {
+			continue
+		}
+		if status != "ok" {
+			log.Warn("token 后端 %s 不可用: %s", name, status)
+		} else if prev != nil {
+			log.Info("token 后端 %s 已恢复", name)
+		}
 	}
+}
 
-	return string(resp.Ok().Body.String()), nil
+// fetchCursorScript 获取 Cursor 验证脚本（带缓存）
+func (p *Pool) fetchCursorScript(ctx context.Context) (string, error) {
+	return p.scripts.Get(ctx)
+}
+
+// ScriptVersions 返回已见过的 Cursor 脚本版本
+func (p *Pool) ScriptVersions() []ScriptVersion {
+	return p.scripts.Versions()
 }
 
 // buildJSCode 构建 JavaScript 代码
@@ -366,6 +576,13 @@ func (p *Pool) buildJSCode(cursorJS string) string {
 // Close 关闭 Token 池
 func (p *Pool) Close() {
 	close(p.stopChan)
+	p.provider.close()
+}
+
+// hashKey 返回 API Key 的 SHA-256，用作 per_key 缓存的键
+func hashKey(apiKey string) string {
+	sum := sha256.Sum256([]byte(apiKey))
+	return hex.EncodeToString(sum[:])
 }
 
 func truncateKey(s string) string {
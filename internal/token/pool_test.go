@@ -0,0 +1,131 @@
+package token
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// countingProvider 每次生成一个新 token 的假后端
+type countingProvider struct {
+	n atomic.Int32
+}
+
+func (c *countingProvider) Name() string { return "fake" }
+
+func (c *countingProvider) Generate(ctx context.Context) (string, error) {
+	return fmt.Sprintf("tok-%d", c.n.Add(1)), nil
+}
+
+func (c *countingProvider) Health(ctx context.Context) error { return nil }
+
+func newPerKeyPool(maxKeys int) (*Pool, *countingProvider) {
+	gen := &countingProvider{}
+	return &Pool{
+		tokens:   make(map[string]*TokenEntry),
+		provider: &fallbackProvider{providers: []TokenProvider{gen}},
+		maxKeys:  maxKeys,
+		strategy: StrategyPerKey,
+	}, gen
+}
+
+func TestPerKeyHashedKeys(t *testing.T) {
+	p, gen := newPerKeyPool(10)
+	ctx := context.Background()
+
+	first, _ := p.GetToken(ctx, "sk-secret-key-1")
+	again, _ := p.GetToken(ctx, "sk-secret-key-1")
+	other, _ := p.GetToken(ctx, "sk-secret-key-2")
+	if first != again || first == other || gen.n.Load() != 2 {
+		t.Fatalf("tokens = %q %q %q, generated %d", first, again, other, gen.n.Load())
+	}
+	for key, entry := range p.tokens {
+		if strings.Contains(key, "secret") || strings.Contains(entry.Key, "key-1") {
+			t.Errorf("raw API key kept in cache: %q / %q", key, entry.Key)
+		}
+	}
+}
+
+func TestPerKeyEvictsLeastRecentlyUsed(t *testing.T) {
+	p, _ := newPerKeyPool(3)
+	ctx := context.Background()
+
+	for _, key := range []string{"a", "b", "c"} {
+		_, _ = p.GetToken(ctx, key)
+		time.Sleep(time.Millisecond)
+	}
+	// a 最近被使用过，淘汰的应该是 b
+	_, _ = p.GetToken(ctx, "a")
+	_, _ = p.GetToken(ctx, "d")
+
+	if p.Count() != 3 {
+		t.Fatalf("count = %d, want 3", p.Count())
+	}
+	for key, want := range map[string]bool{"a": true, "b": false, "c": true, "d": true} {
+		if _, ok := p.tokens[hashKey(key)]; ok != want {
+			t.Errorf("key %s cached = %v, want %v", key, ok, want)
+		}
+	}
+}
+
+func TestRemoveExpired(t *testing.T) {
+	p, _ := newPerKeyPool(10)
+	ctx := context.Background()
+	for _, key := range []string{"fresh", "stale", "busy"} {
+		_, _ = p.GetToken(ctx, key)
+	}
+	p.tokens[hashKey("stale")].CreatedAt = time.Now().Add(-tokenExpiry)
+
+	// 正在生成的条目不会被清理
+	busy := p.tokens[hashKey("busy")]
+	busy.CreatedAt = time.Now().Add(-tokenExpiry)
+	busy.mu.Lock()
+	removed := p.removeExpired()
+	busy.mu.Unlock()
+
+	if removed != 1 || p.Count() != 2 {
+		t.Fatalf("removed = %d, count = %d", removed, p.Count())
+	}
+	if _, ok := p.tokens[hashKey("stale")]; ok {
+		t.Error("expired entry not removed")
+	}
+}
+
+// probeProvider 记录健康检查次数的假后端
+type probeProvider struct {
+	countingProvider
+	probes atomic.Int32
+	err    atomic.Value // error
+}
+
+func (p *probeProvider) Health(ctx context.Context) error {
+	p.probes.Add(1)
+	if err, _ := p.err.Load().(error); err != nil {
+		return err
+	}
+	return nil
+}
+
+func TestHealthIsCached(t *testing.T) {
+	probe := &probeProvider{}
+	p := &Pool{provider: &fallbackProvider{providers: []TokenProvider{probe}}}
+	p.checkHealth()
+
+	for i := 0; i < 5; i++ {
+		if !p.Healthy() || p.Health()["fake"] != "ok" {
+			t.Fatalf("health = %v", p.Health())
+		}
+	}
+	if n := probe.probes.Load(); n != 1 {
+		t.Fatalf("probes = %d, want 1", n)
+	}
+
+	probe.err.Store(fmt.Errorf("node not available"))
+	p.checkHealth()
+	if p.Healthy() || p.Health()["fake"] != "node not available" {
+		t.Fatalf("health = %v", p.Health())
+	}
+}
@@ -0,0 +1,164 @@
+package token
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"cursor2api/jscode"
+)
+
+// TokenProvider x-is-human token 生成后端
+type TokenProvider interface {
+	// Name 后端名称，用于日志和状态展示
+	Name() string
+	// Generate 生成一个新的 token
+	Generate(ctx context.Context) (string, error)
+	// Health 检查后端是否可用
+	Health(ctx context.Context) error
+}
+
+// 后端名称
+const (
+	ProviderNode = "node"
+	ProviderHTTP = "http"
+	ProviderGoja = "goja"
+)
+
+// fallbackProvider 按顺序尝试多个后端，前一个失败时回退到下一个
+type fallbackProvider struct {
+	providers []TokenProvider
+	timeout   time.Duration // 单个后端的超时
+}
+
+// Name 返回所有后端名称
+func (f *fallbackProvider) Name() string {
+	name := ""
+	for i, p := range f.providers {
+		if i > 0 {
+			name += " -> "
+		}
+		name += p.Name()
+	}
+	return name
+}
+
+// Generate 依次调用各后端，返回第一个成功的结果
+func (f *fallbackProvider) Generate(ctx context.Context) (string, error) {
+	var errs []error
+	for _, p := range f.providers {
+		tokenStr, err := f.generate(ctx, p)
+		if err == nil {
+			return tokenStr, nil
+		}
+		errs = append(errs, fmt.Errorf("%s: %w", p.Name(), err))
+
+		// 请求已取消或超时，不再回退
+		if ctx.Err() != nil {
+			break
+		}
+		log.Warn("token 后端 %s 失败，尝试下一个: %v", p.Name(), err)
+	}
+	return "", errors.Join(errs...)
+}
+
+// generate 在单个后端超时内生成 token
+func (f *fallbackProvider) generate(ctx context.Context, p TokenProvider) (string, error) {
+	if f.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, f.timeout)
+		defer cancel()
+	}
+	tokenStr, err := p.Generate(ctx)
+	if err != nil {
+		return "", err
+	}
+	if tokenStr == "" {
+		return "", fmt.Errorf("empty token")
+	}
+	return tokenStr, nil
+}
+
+// Health 只要有一个后端可用即视为健康
+func (f *fallbackProvider) Health(ctx context.Context) error {
+	var errs []error
+	for _, p := range f.providers {
+		err := p.Health(ctx)
+		if err == nil {
+			return nil
+		}
+		errs = append(errs, fmt.Errorf("%s: %w", p.Name(), err))
+	}
+	return errors.Join(errs...)
+}
+
+// HealthAll 返回每个后端的健康状态
+func (f *fallbackProvider) HealthAll(ctx context.Context) map[string]string {
+	result := make(map[string]string, len(f.providers))
+	for _, p := range f.providers {
+		if err := p.Health(ctx); err != nil {
+			result[p.Name()] = err.Error()
+		} else {
+			result[p.Name()] = "ok"
+		}
+	}
+	return result
+}
+
+// close 释放后端占用的资源（常驻 node worker）
+func (f *fallbackProvider) close() {
+	for _, p := range f.providers {
+		if n, ok := p.(*nodeProvider); ok && n.workers != nil {
+			n.workers.close()
+		}
+	}
+}
+
+// newProvider 根据配置创建 token 后端
+// 配置的首选后端排在前面，其余可用后端按 http -> node -> goja 的顺序作为回退
+func (p *Pool) newProvider() *fallbackProvider {
+	node := &nodeProvider{pool: p}
+	if p.cfg.NodeWorkers > 0 {
+		node.workers = newWorkerPool(p.cfg.NodeWorkers, jscode.Worker, p.envJS)
+	}
+
+	available := map[string]TokenProvider{
+		ProviderNode: node,
+	}
+	// goja 只在显式配置或 JS 模板可用时加入，不作为无条件的兜底
+	if p.cfg.TokenProvider == ProviderGoja || (p.envJS != "" && p.mainJS != "") {
+		available[ProviderGoja] = &gojaProvider{pool: p}
+	}
+	if p.cfg.XIsHumanServerURL != "" {
+		available[ProviderHTTP] = newHTTPProvider(p.cfg)
+	}
+
+	primary := p.cfg.TokenProvider
+	if primary == "" {
+		primary = ProviderNode
+		if _, ok := available[ProviderHTTP]; ok {
+			primary = ProviderHTTP
+		}
+	}
+	if _, ok := available[primary]; !ok {
+		log.Warn("token_provider=%s 不可用（http 需要配置 x_is_human_server_url），使用 node", primary)
+		primary = ProviderNode
+	}
+
+	providers := []TokenProvider{available[primary]}
+	for _, name := range []string{ProviderHTTP, ProviderNode, ProviderGoja} {
+		if provider, ok := available[name]; ok && name != primary {
+			providers = append(providers, provider)
+		}
+	}
+
+	// 首选 node 时预先启动常驻 worker，作为回退时按需启动
+	if primary == ProviderNode && node.workers != nil {
+		node.workers.start()
+		log.Info("已启动 %d 个常驻 node worker", p.cfg.NodeWorkers)
+	}
+
+	timeout := time.Duration(p.cfg.TokenTimeout) * time.Second
+	return &fallbackProvider{providers: providers, timeout: timeout}
+}
@@ -0,0 +1,124 @@
+package token
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"cursor2api/internal/config"
+
+	"github.com/enetx/g"
+	"github.com/enetx/surf"
+)
+
+// httpProvider 调用外部 x-is-human 服务生成 token（x_is_human_server_url）
+type httpProvider struct {
+	cfg    *config.Config
+	client *surf.Client
+}
+
+// remoteTokenRequest 外部服务请求体
+type remoteTokenRequest struct {
+	ScriptURL   string        `json:"script_url"`
+	Fingerprint jsFingerprint `json:"fp"`
+}
+
+// jsFingerprint 浏览器指纹，字段名与 main.js 中 cursor_config.fp 保持一致
+type jsFingerprint struct {
+	UnmaskedVendorWebGL   string `json:"UNMASKED_VENDOR_WEBGL"`
+	UnmaskedRendererWebGL string `json:"UNMASKED_RENDERER_WEBGL"`
+	UserAgent             string `json:"userAgent"`
+}
+
+func newJSFingerprint(fp config.FingerprintConfig) jsFingerprint {
+	return jsFingerprint{
+		UnmaskedVendorWebGL:   fp.UnmaskedVendorWebGL,
+		UnmaskedRendererWebGL: fp.UnmaskedRendererWebGL,
+		UserAgent:             fp.UserAgent,
+	}
+}
+
+// remoteTokenResponse 外部服务 JSON 响应（也支持直接返回纯文本 token）
+type remoteTokenResponse struct {
+	Token    string `json:"token"`
+	XIsHuman string `json:"x_is_human"`
+}
+
+func newHTTPProvider(cfg *config.Config) *httpProvider {
+	return &httpProvider{
+		cfg:    cfg,
+		client: surf.NewClient(),
+	}
+}
+
+// Name 后端名称
+func (h *httpProvider) Name() string {
+	return ProviderHTTP
+}
+
+// Generate 请求外部服务生成 token
+func (h *httpProvider) Generate(ctx context.Context) (string, error) {
+	body := remoteTokenRequest{
+		ScriptURL:   h.cfg.ScriptURL,
+		Fingerprint: newJSFingerprint(h.cfg.Fingerprint),
+	}
+
+	resp := h.client.Post(g.String(h.cfg.XIsHumanServerURL), body).
+		SetHeaders(map[string]string{"Content-Type": "application/json"}).
+		WithContext(ctx).
+		Do()
+	if resp.IsErr() {
+		return "", fmt.Errorf("request x-is-human server: %w", resp.Err())
+	}
+
+	r := resp.Ok()
+	text := strings.TrimSpace(string(r.Body.String()))
+	if r.StatusCode != 200 {
+		return "", fmt.Errorf("x-is-human server HTTP %d: %s", r.StatusCode, text)
+	}
+
+	return parseRemoteToken(text)
+}
+
+// parseRemoteToken 解析外部服务响应
+func parseRemoteToken(text string) (string, error) {
+	if strings.HasPrefix(text, "{") {
+		var result remoteTokenResponse
+		if err := json.Unmarshal([]byte(text), &result); err != nil {
+			return "", fmt.Errorf("decode x-is-human response: %w", err)
+		}
+		if result.Token != "" {
+			return result.Token, nil
+		}
+		if result.XIsHuman != "" {
+			return result.XIsHuman, nil
+		}
+		return "", fmt.Errorf("x-is-human response has no token field")
+	}
+	if text == "" {
+		return "", fmt.Errorf("empty x-is-human response")
+	}
+	return text, nil
+}
+
+// Health 检查外部服务是否可达（请求服务根地址，5xx 视为不可用）
+func (h *httpProvider) Health(ctx context.Context) error {
+	u, err := url.Parse(h.cfg.XIsHumanServerURL)
+	if err != nil {
+		return fmt.Errorf("invalid x_is_human_server_url: %w", err)
+	}
+	base := u.Scheme + "://" + u.Host + "/"
+
+	resp := h.client.Get(g.String(base)).WithContext(ctx).Do()
+	if resp.IsErr() {
+		return fmt.Errorf("x-is-human server unreachable: %w", resp.Err())
+	}
+	r := resp.Ok()
+	_ = r.Body.Close()
+	if r.StatusCode >= 500 {
+		return fmt.Errorf("x-is-human server HTTP %d", r.StatusCode)
+	}
+	return nil
+}
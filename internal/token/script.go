@@ -0,0 +1,306 @@
+package token
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/enetx/g"
+	"github.com/enetx/surf"
+	"golang.org/x/sync/singleflight"
+)
+
+// scriptMetaFile 磁盘缓存元数据文件名
+const scriptMetaFile = "meta.json"
+
+const (
+	scriptFetchTimeout = 30 * time.Second // 共用的脚本请求超时
+	scriptRetryBackoff = time.Minute      // 获取失败后继续使用旧版本、不再请求的时间
+)
+
+// scriptFetchHeaders 获取 Cursor 脚本时模拟的 Chrome 请求头
+var scriptFetchHeaders = map[string]string{
+	"sec-ch-ua-arch":             `"x86"`,
+	"sec-ch-ua-platform":         `"Windows"`,
+	"sec-ch-ua":                  `"Chromium";v="140", "Not=A?Brand";v="24", "Google Chrome";v="140"`,
+	"sec-ch-ua-bitness":          `"64"`,
+	"sec-ch-ua-mobile":           "?0",
+	"sec-ch-ua-platform-version": `"19.0.0"`,
+	"sec-fetch-site":             "same-origin",
+	"sec-fetch-mode":             "no-cors",
+	"sec-fetch-dest":             "script",
+	"referer":                    "https://cursor.com/",
+	"accept-language":            "zh-CN,zh;q=0.9,en;q=0.8",
+}
+
+// ScriptVersion 脚本版本信息
+type ScriptVersion struct {
+	Hash      string    `json:"hash"`
+	FirstSeen time.Time `json:"first_seen"`
+	Size      int       `json:"size"`
+}
+
+// scriptMeta 磁盘缓存元数据
+type scriptMeta struct {
+	URL          string          `json:"url"`
+	Hash         string          `json:"hash"`
+	ETag         string          `json:"etag,omitempty"`
+	LastModified string          `json:"last_modified,omitempty"`
+	FetchedAt    time.Time       `json:"fetched_at"`
+	Versions     []ScriptVersion `json:"versions"`
+}
+
+// scriptCache Cursor 验证脚本缓存
+// 内存 + 磁盘两级缓存，TTL 过期后用 ETag/If-Modified-Since 重新验证，获取失败时继续使用旧版本并退避一段时间
+type scriptCache struct {
+	client  *surf.Client
+	url     string
+	dir     string
+	ttl     time.Duration
+	mu      sync.Mutex
+	meta    scriptMeta
+	content string
+	retryAt time.Time          // 获取失败后的退避截止时间
+	group   singleflight.Group // 合并并发的获取
+}
+
+func newScriptCache(client *surf.Client, url, dir string, ttl time.Duration) *scriptCache {
+	c := &scriptCache{client: client, url: url, dir: dir, ttl: ttl}
+	c.load()
+	return c
+}
+
+// load 从磁盘恢复缓存（脚本 URL 变化时丢弃）
+func (c *scriptCache) load() {
+	if c.dir == "" {
+		return
+	}
+	data, err := os.ReadFile(filepath.Join(c.dir, scriptMetaFile))
+	if err != nil {
+		return
+	}
+	var meta scriptMeta
+	if err := json.Unmarshal(data, &meta); err != nil {
+		log.Warn("解析脚本缓存元数据失败: %v", err)
+		return
+	}
+	if meta.URL != c.url {
+		log.Info("script_url 已变化，忽略磁盘缓存")
+		return
+	}
+	content, err := os.ReadFile(filepath.Join(c.dir, meta.Hash+".js"))
+	if err != nil || hashScript(string(content)) != meta.Hash {
+		log.Warn("脚本缓存文件缺失或已损坏: %s", meta.Hash)
+		return
+	}
+	c.meta = meta
+	c.content = string(content)
+	log.Info("已加载缓存的 Cursor 脚本 %s (%d 字节, 获取于 %s)", shortHash(meta.Hash), len(content), meta.FetchedAt.Format(time.DateTime))
+}
+
+// Get 获取脚本内容，缓存未过期时直接返回
+// 并发的请求共用一次获取，获取期间不持有 c.mu
+func (c *scriptCache) Get(ctx context.Context) (string, error) {
+	if content, ok := c.cached(); ok {
+		return content, nil
+	}
+
+	ch := c.group.DoChan("fetch", func() (interface{}, error) {
+		// 共用的请求不随某个调用方取消
+		fetchCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), scriptFetchTimeout)
+		defer cancel()
+		return c.refresh(fetchCtx)
+	})
+	select {
+	case r := <-ch:
+		if r.Err != nil {
+			return "", r.Err
+		}
+		return r.Val.(string), nil
+	case <-ctx.Done():
+		return "", fmt.Errorf("fetch script: %w", context.Cause(ctx))
+	}
+}
+
+// cached 返回未过期的缓存；获取失败后的退避期内旧版本也视为可用
+func (c *scriptCache) cached() (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.content == "" {
+		return "", false
+	}
+	if time.Since(c.meta.FetchedAt) < c.ttl || time.Now().Before(c.retryAt) {
+		return c.content, true
+	}
+	return "", false
+}
+
+// Versions 返回已见过的脚本版本
+func (c *scriptCache) Versions() []ScriptVersion {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]ScriptVersion(nil), c.meta.Versions...)
+}
+
+// refresh 重新获取脚本并更新缓存
+// 获取失败但有旧版本时返回旧版本，并在 scriptRetryBackoff 内不再请求
+func (c *scriptCache) refresh(ctx context.Context) (string, error) {
+	c.mu.Lock()
+	cached := c.content != ""
+	etag, lastModified := c.meta.ETag, c.meta.LastModified
+	c.mu.Unlock()
+
+	resp, err := c.fetch(ctx, cached, etag, lastModified)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err != nil {
+		if c.content == "" {
+			return "", err
+		}
+		c.retryAt = time.Now().Add(scriptRetryBackoff)
+		log.Warn("获取 Cursor 脚本失败，%s 内使用缓存版本 %s: %v", scriptRetryBackoff, shortHash(c.meta.Hash), err)
+		return c.content, nil
+	}
+	c.retryAt = time.Time{}
+	c.update(resp)
+	return c.content, nil
+}
+
+// scriptResponse 一次脚本请求的结果
+type scriptResponse struct {
+	notModified  bool
+	body         string
+	etag         string
+	lastModified string
+}
+
+// fetch 请求脚本，cached 为 true 时带上条件请求头
+func (c *scriptCache) fetch(ctx context.Context, cached bool, etag, lastModified string) (*scriptResponse, error) {
+	headers := make(map[string]string, len(scriptFetchHeaders)+2)
+	for k, v := range scriptFetchHeaders {
+		headers[k] = v
+	}
+	if cached {
+		if etag != "" {
+			headers["If-None-Match"] = etag
+		}
+		if lastModified != "" {
+			headers["If-Modified-Since"] = lastModified
+		}
+	}
+
+	resp := c.client.Get(g.String(c.url)).SetHeaders(headers).WithContext(ctx).Do()
+	if resp.IsErr() {
+		return nil, fmt.Errorf("fetch script: %w", resp.Err())
+	}
+	r := resp.Ok()
+
+	if r.StatusCode == 304 && cached {
+		_ = r.Body.Close()
+		return &scriptResponse{notModified: true}, nil
+	}
+
+	body := string(r.Body.String())
+	if r.StatusCode != 200 {
+		return nil, fmt.Errorf("fetch script: HTTP %d", r.StatusCode)
+	}
+	contentType := string(r.Headers.Get("Content-Type"))
+	if !isJavaScript(contentType) {
+		return nil, fmt.Errorf("fetch script: unexpected content type %q", contentType)
+	}
+	if strings.TrimSpace(body) == "" {
+		return nil, fmt.Errorf("fetch script: empty body")
+	}
+	return &scriptResponse{
+		body:         body,
+		etag:         string(r.Headers.Get("ETag")),
+		lastModified: string(r.Headers.Get("Last-Modified")),
+	}, nil
+}
+
+// update 用请求结果更新缓存，调用方需持有 c.mu
+func (c *scriptCache) update(resp *scriptResponse) {
+	if resp.notModified {
+		c.meta.FetchedAt = time.Now()
+		c.save()
+		log.Debug("Cursor 脚本未变化 (304)")
+		return
+	}
+
+	hash := hashScript(resp.body)
+	if c.content != "" && hash != c.meta.Hash {
+		log.Warn("Cursor 验证脚本已变更: %s -> %s (%d -> %d 字节)", shortHash(c.meta.Hash), shortHash(hash), len(c.content), len(resp.body))
+	}
+	if !c.hasVersion(hash) {
+		c.meta.Versions = append(c.meta.Versions, ScriptVersion{Hash: hash, FirstSeen: time.Now(), Size: len(resp.body)})
+	}
+
+	c.content = resp.body
+	c.meta.URL = c.url
+	c.meta.Hash = hash
+	c.meta.ETag = resp.etag
+	c.meta.LastModified = resp.lastModified
+	c.meta.FetchedAt = time.Now()
+	c.save()
+}
+
+// hasVersion 是否已记录该版本
+func (c *scriptCache) hasVersion(hash string) bool {
+	for _, v := range c.meta.Versions {
+		if v.Hash == hash {
+			return true
+		}
+	}
+	return false
+}
+
+// save 写入磁盘缓存：每个版本一个 <hash>.js 文件，外加 meta.json
+func (c *scriptCache) save() {
+	if c.dir == "" {
+		return
+	}
+	if err := os.MkdirAll(c.dir, 0755); err != nil {
+		log.Warn("创建脚本缓存目录失败: %v", err)
+		return
+	}
+	scriptPath := filepath.Join(c.dir, c.meta.Hash+".js")
+	if _, err := os.Stat(scriptPath); err != nil {
+		if err := os.WriteFile(scriptPath, []byte(c.content), 0644); err != nil {
+			log.Warn("写入脚本缓存失败: %v", err)
+			return
+		}
+	}
+	data, _ := json.MarshalIndent(c.meta, "", "  ")
+	if err := os.WriteFile(filepath.Join(c.dir, scriptMetaFile), data, 0644); err != nil {
+		log.Warn("写入脚本缓存元数据失败: %v", err)
+	}
+}
+
+// isJavaScript 检查 Content-Type 是否为脚本（未返回 Content-Type 时放行）
+func isJavaScript(contentType string) bool {
+	if contentType == "" {
+		return true
+	}
+	contentType = strings.ToLower(contentType)
+	return strings.Contains(contentType, "javascript") || strings.Contains(contentType, "ecmascript")
+}
+
+func hashScript(content string) string {
+	sum := sha256.Sum256([]byte(content))
+	return hex.EncodeToString(sum[:])
+}
+
+func shortHash(hash string) string {
+	if len(hash) > 12 {
+		return hash[:12]
+	}
+	return hash
+}
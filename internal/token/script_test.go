@@ -0,0 +1,121 @@
+package token
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/enetx/surf"
+)
+
+// scriptServer 返回计数请求次数的脚本服务，status 为 0 时返回脚本
+type scriptServer struct {
+	*httptest.Server
+	requests atomic.Int32
+	status   atomic.Int32
+	delay    time.Duration
+}
+
+func newScriptServer(t *testing.T, delay time.Duration) *scriptServer {
+	s := &scriptServer{delay: delay}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.requests.Add(1)
+		time.Sleep(s.delay)
+		if code := s.status.Load(); code != 0 {
+			w.WriteHeader(int(code))
+			return
+		}
+		w.Header().Set("Content-Type", "application/javascript")
+		_, _ = w.Write([]byte("window.V_C = [];"))
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func TestScriptCacheConcurrentFetch(t *testing.T) {
+	srv := newScriptServer(t, 100*time.Millisecond)
+	c := newScriptCache(surf.NewClient(), srv.URL, "", time.Hour)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if content, err := c.Get(context.Background()); err != nil || content == "" {
+				t.Errorf("Get = %q, %v", content, err)
+			}
+		}()
+	}
+
+	// 获取期间不持有锁，Versions 不会被阻塞
+	time.Sleep(20 * time.Millisecond)
+	done := make(chan struct{})
+	go func() {
+		c.Versions()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(50 * time.Millisecond):
+		t.Error("Versions blocked by an in-flight fetch")
+	}
+
+	wg.Wait()
+	if n := srv.requests.Load(); n != 1 {
+		t.Errorf("requests = %d, want 1", n)
+	}
+}
+
+func TestScriptCacheStaleBackoff(t *testing.T) {
+	srv := newScriptServer(t, 0)
+	c := newScriptCache(surf.NewClient(), srv.URL, "", 0)
+	want, err := c.Get(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// TTL 为 0，每次都要重新获取；失败后使用旧版本并退避
+	srv.status.Store(http.StatusBadGateway)
+	for i := 0; i < 3; i++ {
+		if got, err := c.Get(context.Background()); err != nil || got != want {
+			t.Fatalf("Get = %q, %v, want stale copy", got, err)
+		}
+	}
+	if n := srv.requests.Load(); n != 2 {
+		t.Errorf("requests = %d, want 2 (initial + one failed refresh)", n)
+	}
+
+	// 退避结束后重新请求
+	c.mu.Lock()
+	c.retryAt = time.Now()
+	c.mu.Unlock()
+	srv.status.Store(0)
+	if _, err := c.Get(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if n := srv.requests.Load(); n != 3 {
+		t.Errorf("requests = %d, want 3", n)
+	}
+}
+
+func TestScriptCacheCallerCancel(t *testing.T) {
+	srv := newScriptServer(t, 200*time.Millisecond)
+	c := newScriptCache(surf.NewClient(), srv.URL, "", time.Hour)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := c.Get(ctx); err == nil {
+		t.Fatal("expected cancelled caller to fail")
+	}
+	// 调用方取消不影响共用的请求，其他调用方仍能拿到结果
+	if content, err := c.Get(context.Background()); err != nil || content == "" {
+		t.Fatalf("Get = %q, %v", content, err)
+	}
+	if n := srv.requests.Load(); n != 1 {
+		t.Errorf("requests = %d, want 1", n)
+	}
+}
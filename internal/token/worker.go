@@ -0,0 +1,243 @@
+package token
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+	"sync/atomic"
+	"time"
+)
+
+// workerStartTimeout worker 启动（编译并执行 env.js）超时
+const workerStartTimeout = 15 * time.Second
+
+// workerJob 发送给 worker 的任务
+type workerJob struct {
+	ID          int64         `json:"id"`
+	Script      string        `json:"script"`
+	ScriptURL   string        `json:"script_url"`
+	Fingerprint jsFingerprint `json:"fp"`
+}
+
+// workerInit 启动后发送给 worker 的第一行
+type workerInit struct {
+	Env string `json:"env"`
+}
+
+// workerResult worker 返回的结果
+type workerResult struct {
+	ID    int64  `json:"id"`
+	Ready bool   `json:"ready,omitempty"`
+	Token string `json:"token,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+// jobError 任务脚本执行失败（worker 进程正常）
+type jobError struct {
+	msg string
+}
+
+func (e *jobError) Error() string {
+	return "node error: " + e.msg
+}
+
+// nodeWorker 单个常驻 node 进程
+type nodeWorker struct {
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	stdout *bufio.Reader
+}
+
+// workerPool 常驻 node worker 池
+// idle 通道容量即最大并发数，nil 表示该槽位的 worker 尚未启动或已崩溃
+// script 和 env 为内嵌的 worker.js 和 env.js，不依赖工作目录
+type workerPool struct {
+	idle   chan *nodeWorker
+	nextID int64
+	script string
+	env    string
+}
+
+func newWorkerPool(size int, script, env string) *workerPool {
+	wp := &workerPool{idle: make(chan *nodeWorker, size), script: script, env: env}
+	for i := 0; i < size; i++ {
+		wp.idle <- nil
+	}
+	return wp
+}
+
+// start 预先启动所有 worker
+func (wp *workerPool) start() {
+	n := cap(wp.idle)
+	for i := 0; i < n; i++ {
+		w := <-wp.idle
+		if w == nil {
+			var err error
+			if w, err = wp.startWorker(); err != nil {
+				log.Warn("启动 node worker 失败: %v", err)
+			}
+		}
+		wp.idle <- w
+	}
+}
+
+// run 在空闲 worker 上执行一次任务，超时或进程异常时杀掉 worker 并在后台重启
+func (wp *workerPool) run(ctx context.Context, job workerJob) (string, error) {
+	var w *nodeWorker
+	select {
+	case w = <-wp.idle:
+	case <-ctx.Done():
+		return "", fmt.Errorf("wait node worker: %w", context.Cause(ctx))
+	}
+
+	if w == nil {
+		var err error
+		if w, err = wp.startWorker(); err != nil {
+			wp.idle <- nil
+			return "", err
+		}
+	}
+
+	job.ID = atomic.AddInt64(&wp.nextID, 1)
+	tokenStr, err := w.do(ctx, job)
+	var jsErr *jobError
+	if errors.As(err, &jsErr) {
+		// 脚本执行出错，worker 本身仍可用
+		wp.idle <- w
+		return "", err
+	}
+	if err != nil {
+		w.kill()
+		go wp.restart()
+		return "", err
+	}
+	wp.idle <- w
+	return tokenStr, nil
+}
+
+// restart 重启一个 worker 并放回池中，失败时放回空槽位
+func (wp *workerPool) restart() {
+	w, err := wp.startWorker()
+	if err != nil {
+		log.Warn("重启 node worker 失败: %v", err)
+	}
+	wp.idle <- w
+}
+
+// close 关闭所有 worker
+func (wp *workerPool) close() {
+	n := cap(wp.idle)
+	for i := 0; i < n; i++ {
+		if w := <-wp.idle; w != nil {
+			w.kill()
+		}
+	}
+}
+
+// startWorker 启动 node worker，通过 stdin 发送 env.js 并等待其执行完成
+func (wp *workerPool) startWorker() (*nodeWorker, error) {
+	cmd := exec.Command("node", "-e", wp.script)
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, fmt.Errorf("worker stdin: %w", err)
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, fmt.Errorf("worker stdout: %w", err)
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("start node worker: %w", err)
+	}
+
+	w := &nodeWorker{cmd: cmd, stdin: stdin, stdout: bufio.NewReader(stdout)}
+	init, err := json.Marshal(workerInit{Env: wp.env})
+	if err != nil {
+		w.kill()
+		return nil, fmt.Errorf("encode env.js: %w", err)
+	}
+	if _, err := stdin.Write(append(init, '\n')); err != nil {
+		w.kill()
+		return nil, fmt.Errorf("send env.js: %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), workerStartTimeout)
+	defer cancel()
+	result, err := w.read(ctx)
+	if err != nil || !result.Ready {
+		w.kill()
+		if err == nil && result.Error != "" {
+			err = errors.New(result.Error)
+		} else if err == nil {
+			err = fmt.Errorf("unexpected message: %+v", result)
+		}
+		return nil, fmt.Errorf("node worker not ready: %w", err)
+	}
+
+	log.Debug("node worker 已启动 (pid=%d)", cmd.Process.Pid)
+	return w, nil
+}
+
+// do 发送任务并等待结果
+func (w *nodeWorker) do(ctx context.Context, job workerJob) (string, error) {
+	line, err := json.Marshal(job)
+	if err != nil {
+		return "", fmt.Errorf("encode job: %w", err)
+	}
+	if _, err := w.stdin.Write(append(line, '\n')); err != nil {
+		return "", fmt.Errorf("write job: %w", err)
+	}
+
+	result, err := w.read(ctx)
+	if err != nil {
+		return "", err
+	}
+	if result.ID != job.ID {
+		return "", fmt.Errorf("worker returned job %d, want %d", result.ID, job.ID)
+	}
+	if result.Error != "" {
+		return "", &jobError{msg: result.Error}
+	}
+	return result.Token, nil
+}
+
+// read 读取一行结果，ctx 结束时杀掉进程以解除阻塞
+func (w *nodeWorker) read(ctx context.Context) (workerResult, error) {
+	type readResult struct {
+		line []byte
+		err  error
+	}
+	done := make(chan readResult, 1)
+	go func() {
+		line, err := w.stdout.ReadBytes('\n')
+		done <- readResult{line, err}
+	}()
+
+	select {
+	case r := <-done:
+		if r.err != nil {
+			return workerResult{}, fmt.Errorf("node worker exited: %w", r.err)
+		}
+		var result workerResult
+		if err := json.Unmarshal(r.line, &result); err != nil {
+			return workerResult{}, fmt.Errorf("decode worker result: %w", err)
+		}
+		return result, nil
+	case <-ctx.Done():
+		w.kill()
+		<-done
+		return workerResult{}, fmt.Errorf("node worker killed: %w", context.Cause(ctx))
+	}
+}
+
+// kill 结束 worker 进程
+func (w *nodeWorker) kill() {
+	_ = w.stdin.Close()
+	if w.cmd.Process != nil {
+		_ = w.cmd.Process.Kill()
+	}
+	_ = w.cmd.Wait()
+}
@@ -0,0 +1,56 @@
+package token
+
+import (
+	"context"
+	"errors"
+	"os/exec"
+	"testing"
+	"time"
+
+	"cursor2api/jscode"
+)
+
+func TestWorkerPool(t *testing.T) {
+	if _, err := exec.LookPath("node"); err != nil {
+		t.Skip("node not installed")
+	}
+	p := newParityPool()
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	want, err := (&nodeProvider{pool: p}).Generate(ctx)
+	if err != nil {
+		t.Fatalf("node: %v", err)
+	}
+
+	// 测试在包目录下运行，worker 不能依赖工作目录下的 jscode/
+	wp := newWorkerPool(1, jscode.Worker, jscode.Env)
+	defer wp.close()
+	job := workerJob{Script: parityScript, ScriptURL: p.cfg.ScriptURL, Fingerprint: newJSFingerprint(p.cfg.Fingerprint)}
+
+	// 同一个 worker 复用 env.js 上下文，之后的任务结果不变；脚本出错后上下文重建
+	jobs := []struct {
+		name    string
+		job     workerJob
+		want    string
+		wantErr bool
+	}{
+		{"first", job, want, false},
+		{"reused context", job, want, false},
+		{"script error", workerJob{Script: `throw new Error("boom")`}, "", true},
+		{"after error", job, want, false},
+	}
+	for _, tc := range jobs {
+		got, err := wp.run(ctx, tc.job)
+		var jsErr *jobError
+		if tc.wantErr {
+			if !errors.As(err, &jsErr) {
+				t.Fatalf("%s: err = %v, want a job error", tc.name, err)
+			}
+			continue
+		}
+		if err != nil || got != tc.want {
+			t.Fatalf("%s: got %q, %v, want %q", tc.name, got, err, tc.want)
+		}
+	}
+}
@@ -0,0 +1,90 @@
+// Package tokenizer 提供基于 BPE 词表的 token 计数
+// 词表内嵌在二进制中（cl100k_base / o200k_base），不需要联网下载
+package tokenizer
+
+import (
+	"fmt"
+	"sync"
+
+	"cursor2api/internal/logger"
+
+	tiktoken "github.com/tiktoken-go/tokenizer"
+)
+
+var log = logger.Get().WithPrefix("Tokenizer")
+
+// 支持的编码
+const (
+	Cl100k = "cl100k_base" // Claude、Gemini 等没有公开词表的模型用它近似
+	O200k  = "o200k_base"  // GPT-4o 之后的 OpenAI 模型
+
+	Default = Cl100k
+)
+
+var (
+	mu     sync.Mutex
+	codecs = make(map[string]tiktoken.Codec)
+	failed = make(map[string]error) // 加载失败的编码，不再重复加载
+
+	// loadCodec 加载内嵌词表，测试中替换以模拟加载失败
+	loadCodec = func(name string) (tiktoken.Codec, error) {
+		return tiktoken.Get(tiktoken.Encoding(name))
+	}
+)
+
+// Valid 是否为支持的编码名，空字符串表示使用默认编码
+func Valid(name string) bool {
+	return name == "" || name == Cl100k || name == O200k
+}
+
+// get 返回编码器，首次使用时加载词表
+func get(name string) (tiktoken.Codec, error) {
+	if !Valid(name) {
+		log.Warn("未知的 tokenizer %s，使用 %s", name, Default)
+		name = ""
+	}
+	if name == "" {
+		name = Default
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if codec, ok := codecs[name]; ok {
+		return codec, nil
+	}
+	if err, ok := failed[name]; ok {
+		return nil, err
+	}
+	codec, err := loadCodec(name)
+	if err != nil {
+		err = fmt.Errorf("load tokenizer %s: %w", name, err)
+		log.Error("%v，token 数按字节估算", err)
+		failed[name] = err
+		return nil, err
+	}
+	codecs[name] = codec
+	return codec, nil
+}
+
+// estimate 无法分词时按字节估算 token 数
+func estimate(text string) int {
+	return len(text) / 4
+}
+
+// Count 返回 text 在指定编码下的 token 数，词表无法加载或分词失败时按字节估算
+func Count(name, text string) int {
+	if text == "" {
+		return 0
+	}
+	codec, err := get(name)
+	if err != nil {
+		return estimate(text)
+	}
+	n, err := codec.Count(text)
+	if err != nil {
+		// 分词正则超时等极端情况，退回按字节估算
+		log.Warn("token 计数失败: %v", err)
+		return estimate(text)
+	}
+	return n
+}
@@ -0,0 +1,65 @@
+package tokenizer
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"cursor2api/internal/config"
+
+	tiktoken "github.com/tiktoken-go/tokenizer"
+)
+
+func TestCount(t *testing.T) {
+	cases := []struct {
+		name     string
+		encoding string
+		text     string
+		want     int
+	}{
+		{"empty", Cl100k, "", 0},
+		{"cl100k", Cl100k, "hello world", 2},
+		{"o200k", O200k, "hello world", 2},
+		{"default", "", "hello world", 2},
+		{"unknown falls back to default", "p50k_base", "hello world", 2},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := Count(tc.encoding, tc.text); got != tc.want {
+				t.Errorf("Count(%q, %q) = %d, want %d", tc.encoding, tc.text, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestCountLoadFailure(t *testing.T) {
+	mu.Lock()
+	saved := loadCodec
+	loadCodec = func(string) (tiktoken.Codec, error) { return nil, errors.New("corrupt vocabulary") }
+	delete(codecs, O200k)
+	mu.Unlock()
+	t.Cleanup(func() {
+		mu.Lock()
+		loadCodec = saved
+		delete(failed, O200k)
+		mu.Unlock()
+	})
+
+	text := strings.Repeat("abcd", 10)
+	for i := 0; i < 2; i++ {
+		if got := Count(O200k, text); got != 10 {
+			t.Fatalf("Count = %d, want the byte estimate 10", got)
+		}
+	}
+	if _, err := get(O200k); err == nil || !strings.Contains(err.Error(), "corrupt vocabulary") {
+		t.Errorf("get error = %v", err)
+	}
+}
+
+func TestConfigTokenizersAreValid(t *testing.T) {
+	for _, name := range config.Tokenizers {
+		if !Valid(name) {
+			t.Errorf("config accepts tokenizer %q but no vocabulary is embedded for it", name)
+		}
+	}
+}
@@ -0,0 +1,141 @@
+package toolify
+
+import "fmt"
+
+// tool_choice 模式
+const (
+	ChoiceAuto = "auto" // 模型自行决定（默认）
+	ChoiceNone = "none" // 禁止调用工具
+	ChoiceAny  = "any"  // 必须调用至少一个工具（OpenAI 的 required）
+	ChoiceTool = "tool" // 必须调用指定的工具
+)
+
+// ToolChoice 解析后的 tool_choice 约束
+type ToolChoice struct {
+	Mode string
+	// Name Mode 为 ChoiceTool 时必须调用的工具
+	Name string
+	// DisableParallel 每次回复最多一个工具调用
+	DisableParallel bool
+}
+
+// ParseToolChoice 解析 Anthropic 或 OpenAI 格式的 tool_choice
+//
+//	Anthropic: {"type":"auto|any|none"} / {"type":"tool","name":"X"}，可带 disable_parallel_tool_use
+//	OpenAI:    "auto" / "none" / "required" / {"type":"function","function":{"name":"X"}}
+func ParseToolChoice(raw interface{}) ToolChoice {
+	switch v := raw.(type) {
+	case string:
+		return ToolChoice{Mode: normalizeChoiceMode(v)}
+	case map[string]interface{}:
+		choice := ToolChoice{Mode: ChoiceAuto}
+		typ, _ := v["type"].(string)
+		switch typ {
+		case "tool":
+			if name, _ := v["name"].(string); name != "" {
+				choice = ToolChoice{Mode: ChoiceTool, Name: name}
+			}
+		case "function":
+			if fn, ok := v["function"].(map[string]interface{}); ok {
+				if name, _ := fn["name"].(string); name != "" {
+					choice = ToolChoice{Mode: ChoiceTool, Name: name}
+				}
+			}
+		default:
+			choice.Mode = normalizeChoiceMode(typ)
+		}
+		choice.DisableParallel, _ = v["disable_parallel_tool_use"].(bool)
+		return choice
+	}
+	return ToolChoice{Mode: ChoiceAuto}
+}
+
+func normalizeChoiceMode(mode string) string {
+	switch mode {
+	case "none":
+		return ChoiceNone
+	case "any", "required":
+		return ChoiceAny
+	default:
+		return ChoiceAuto
+	}
+}
+
+// Resolve 检查指定的工具是否存在，并规范为工具定义中的名称
+func (c *ToolChoice) Resolve(tools []ToolDefinition) error {
+	if c.Required() && len(tools) == 0 {
+		return fmt.Errorf("tool_choice %q requires tools", c.Mode)
+	}
+	if c.Mode != ChoiceTool {
+		return nil
+	}
+	tool, ok := findTool(tools, c.Name)
+	if !ok {
+		return fmt.Errorf("tool_choice names unknown tool %q", c.Name)
+	}
+	c.Name = tool.GetName()
+	return nil
+}
+
+// Required 是否必须调用工具
+func (c ToolChoice) Required() bool {
+	return c.Mode == ChoiceAny || c.Mode == ChoiceTool
+}
+
+// Tools 返回需要在提示中声明的工具，ChoiceNone 时不声明任何工具
+func (c ToolChoice) Tools(tools []ToolDefinition) []ToolDefinition {
+	if c.Mode == ChoiceNone {
+		return nil
+	}
+	return tools
+}
+
+// Allows 该工具调用是否符合约束
+func (c ToolChoice) Allows(call ToolCall) bool {
+	switch c.Mode {
+	case ChoiceNone:
+		return false
+	case ChoiceTool:
+		return call.Function.Name == c.Name
+	default:
+		return true
+	}
+}
+
+// Filter 去掉不符合约束的调用，DisableParallel 时只保留第一个
+func (c ToolChoice) Filter(calls []ToolCall) []ToolCall {
+	var kept []ToolCall
+	for _, call := range calls {
+		if !c.Allows(call) {
+			continue
+		}
+		kept = append(kept, call)
+		if c.DisableParallel {
+			break
+		}
+	}
+	return kept
+}
+
+// constraintPrompt 追加到工具提示末尾的约束说明
+func (c ToolChoice) constraintPrompt() string {
+	var prompt string
+	switch c.Mode {
+	case ChoiceAny:
+		prompt = "\nYou MUST call at least one tool in this reply. Do not answer with text only.\n"
+	case ChoiceTool:
+		prompt = fmt.Sprintf("\nYou MUST call the %s tool in this reply, and no other tool. Start your reply with that call.\n", c.Name)
+	}
+	if c.DisableParallel {
+		prompt += "\nCall at most one tool per reply.\n"
+	}
+	return prompt
+}
+
+// RetryPrompt 模型未按 tool_choice 调用工具时，要求其重新回复的提示
+func (c ToolChoice) RetryPrompt() string {
+	if c.Mode == ChoiceTool {
+		return fmt.Sprintf("Your reply did not call the %s tool, which is required. Reply with only that call, in the format described above.", c.Name)
+	}
+	return "Your reply did not call any tool, which is required. Reply with only the call for the tool you need, in the format described above."
+}
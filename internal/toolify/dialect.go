@@ -0,0 +1,99 @@
+package toolify
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// DefaultDialect 未配置时使用的工具调用格式
+const DefaultDialect = "xml"
+
+// Dialect 一种提示模型调用工具的文本格式
+// 负责调用格式说明、调用块的识别和解析，以及把历史中的调用和结果还原成同样的格式
+type Dialect interface {
+	// Name 配置中使用的名称
+	Name() string
+	// Instructions 生成提示中 "Calling a tool" 一节，tools 为本次声明的工具
+	Instructions(tools []ToolDefinition) string
+	// Delimiters 调用块的起止标记，流式解析据此切分文本和调用块
+	Delimiters() []Delimiter
+	// ParseBlock 解析一个完整的调用块（含起止标记），返回模型写的工具名和参数
+	// name 为空表示不是工具调用，块按文本输出；err 非空表示参数无法解析
+	ParseBlock(block string, tools []ToolDefinition) (name string, args map[string]interface{}, err error)
+	// RenderCall 将历史中的工具调用还原为该格式，arguments 为 JSON 对象
+	RenderCall(id, name, arguments string) string
+	// RenderResult 将工具执行结果渲染为模型能与调用配对的文本
+	RenderResult(id, name, content string, isError bool) string
+}
+
+// PartialDialect 能解析未闭合调用块的格式
+// 流式输出时据此在调用块闭合前输出工具名和已写完的参数，流在调用块中途结束时据此输出已写完的部分
+type PartialDialect interface {
+	Dialect
+	// ParsePartial 解析尚未闭合的调用块（含开始标记），返回工具名和已经完整写出的参数，按写出顺序排列
+	// 工具名还不能确定时返回空字符串；参数值与 ParseBlock 解析完整调用块得到的值一致
+	ParsePartial(block string, tools []ToolDefinition) (name string, args []Argument)
+}
+
+// Delimiter 调用块的开始和结束标记
+type Delimiter struct {
+	Open  string
+	Close string
+}
+
+var dialects = map[string]Dialect{}
+
+// RegisterDialect 注册工具调用格式，同名时覆盖
+func RegisterDialect(d Dialect) {
+	dialects[d.Name()] = d
+}
+
+func init() {
+	RegisterDialect(xmlDialect{})
+	RegisterDialect(vmDialect{})
+	RegisterDialect(hermesDialect{})
+	RegisterDialect(jsonDialect{})
+	RegisterDialect(functionDialect{})
+}
+
+// GetDialect 按名称查找工具调用格式，name 为空时返回默认格式
+func GetDialect(name string) (Dialect, bool) {
+	if name == "" {
+		name = DefaultDialect
+	}
+	d, ok := dialects[strings.ToLower(strings.TrimSpace(name))]
+	return d, ok
+}
+
+// DialectNames 返回所有已注册的格式名称
+func DialectNames() []string {
+	names := make([]string, 0, len(dialects))
+	for name := range dialects {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// HasToolCalls 检查响应中是否出现该格式的调用块开始标记
+func HasToolCalls(d Dialect, response string) bool {
+	for _, delim := range d.Delimiters() {
+		if strings.Contains(response, delim.Open) {
+			return true
+		}
+	}
+	return false
+}
+
+// callRules 各格式共用的调用规则
+func callRules(format string) string {
+	return fmt.Sprintf(`Rules:
+- Only use the tool names listed above, spelled exactly.
+- %s
+- You may write several calls in one reply. They run in the order written.
+- After the last call, stop and wait for the results.
+
+Earlier calls and their results appear in the conversation in the same format.
+`, format)
+}
@@ -0,0 +1,195 @@
+package toolify
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// testTools 往返测试使用的工具，覆盖 vm 的专用标签和有类型、无类型的参数
+var testTools = []ToolDefinition{
+	{Name: "Bash", InputSchema: map[string]interface{}{"type": "object", "properties": map[string]interface{}{
+		"command": map[string]interface{}{"type": "string"},
+	}}},
+	{Name: "Write", InputSchema: map[string]interface{}{"type": "object", "properties": map[string]interface{}{
+		"file_path": map[string]interface{}{"type": "string"},
+		"content":   map[string]interface{}{"type": "string"},
+	}}},
+	{Name: "WebFetch", InputSchema: map[string]interface{}{"type": "object", "properties": map[string]interface{}{
+		"url": map[string]interface{}{"type": "string"},
+	}}},
+	{Name: "Edit", InputSchema: map[string]interface{}{"type": "object", "properties": map[string]interface{}{
+		"file_path": map[string]interface{}{"type": "string"},
+		"old":       map[string]interface{}{"type": "string"},
+		"note":      map[string]interface{}{},
+		"count":     map[string]interface{}{"type": "integer"},
+		"meta":      map[string]interface{}{"type": "object"},
+	}}},
+}
+
+// roundTripCalls 调用及其参数，值中包含各格式的结束标记和会被解析时改写的内容
+var roundTripCalls = []struct {
+	name string
+	tool string
+	args string
+}{
+	{"plain", "Bash", `{"command":"ls -la"}`},
+	{"code fence", "Bash", "{\"command\":\"cat <<EOF\\n```\\ncode\\n```\\nEOF\"}"},
+	{"xml close tags", "Bash", `{"command":"echo '</parameter></tool_use>'"}`},
+	{"vm close tag", "Bash", `{"command":"echo </vm_exec> </vm_call>"}`},
+	{"hermes close tag", "Bash", `{"command":"echo </tool_call>"}`},
+	{"cdata markers", "Bash", `{"command":"echo ']]>' '<![CDATA[x]]>' ']]]'"}`},
+	{"surrounding whitespace", "Bash", `{"command":"\n  indented\n"}`},
+	{"write with close tag", "Write", `{"file_path":"/tmp/a.html","content":"<p>x</p>\n</vm_write>\n"}`},
+	{"windows path", "Write", `{"file_path":"C:\\Users\\a \"b\" &amp; c\\x.txt","content":"hi"}`},
+	{"fetch", "WebFetch", `{"url":"https://example.com/?a=1&b=\"2\""}`},
+	{
+		"mixed types", "Edit",
+		`{"file_path":"/a.go","old":"5","note":"true","count":3,"meta":{"tag":"</parameter>","list":[1,"]]>"]}}`,
+	},
+	{"json-looking strings", "Edit", `{"file_path":"\"quoted\"","old":"[1, 2]","note":"{\"a\":1}"}`},
+}
+
+func TestDialectRoundTrip(t *testing.T) {
+	for _, name := range DialectNames() {
+		d, _ := GetDialect(name)
+		for _, tc := range roundTripCalls {
+			t.Run(name+"/"+tc.name, func(t *testing.T) {
+				rendered := d.RenderCall("call_1", tc.tool, tc.args)
+				response := "before\n" + rendered + "\nafter"
+
+				var want map[string]interface{}
+				if err := json.Unmarshal([]byte(tc.args), &want); err != nil {
+					t.Fatal(err)
+				}
+
+				// 一次性解析和逐字符流式解析的结果应一致
+				parser := NewStreamParser(d, testTools)
+				var streamed []StreamEvent
+				for _, r := range response {
+					streamed = append(streamed, parser.Feed(string(r))...)
+				}
+				streamed = append(streamed, parser.Flush()...)
+
+				for _, segments := range [][]StreamEvent{ParseSegments(d, response, testTools), streamed} {
+					var calls []ToolCall
+					text := ""
+					for _, ev := range segments {
+						if ev.ToolCall != nil {
+							calls = append(calls, *ev.ToolCall)
+						} else {
+							text += ev.Text
+						}
+					}
+					if len(calls) != 1 {
+						t.Fatalf("calls = %d, want 1\nrendered:\n%s", len(calls), rendered)
+					}
+					if text != "before\n\nafter" {
+						t.Errorf("text = %q\nrendered:\n%s", text, rendered)
+					}
+					call := calls[0]
+					if call.Function.Name != tc.tool || len(call.ValidationErrors) != 0 {
+						t.Fatalf("call = %s %v", call.Function.Name, call.ValidationErrors)
+					}
+					var got map[string]interface{}
+					if err := json.Unmarshal([]byte(call.Function.Arguments), &got); err != nil {
+						t.Fatal(err)
+					}
+					if !reflect.DeepEqual(got, want) {
+						t.Errorf("arguments = %s, want %s\nrendered:\n%s", call.Function.Arguments, tc.args, rendered)
+					}
+				}
+			})
+		}
+	}
+}
+
+// 历史中的调用要带上 ID，模型才能把结果与调用配对
+func TestRenderCallCarriesID(t *testing.T) {
+	for _, name := range DialectNames() {
+		d, _ := GetDialect(name)
+		if rendered := d.RenderCall("toolu_42", "Bash", `{"command":"ls"}`); !strings.Contains(rendered, "toolu_42") {
+			t.Errorf("%s: rendered call has no id:\n%s", name, rendered)
+		}
+	}
+}
+
+func TestDecodeCDATA(t *testing.T) {
+	cases := []struct {
+		in   string
+		want string
+		ok   bool
+	}{
+		{"<![CDATA[a]]>", "a", true},
+		{"\n<![CDATA[a]]><![CDATA[b]]>\n", "ab", true},
+		{"<![CDATA[a]]]>", "a]", true},
+		{"<![CDATA[a]]>tail", "", false},
+		{"<![CDATA[a", "", false},
+		{"plain", "", false},
+	}
+	for _, tc := range cases {
+		got, ok := decodeCDATA(tc.in)
+		if got != tc.want || ok != tc.ok {
+			t.Errorf("decodeCDATA(%q) = %q, %v, want %q, %v", tc.in, got, ok, tc.want, tc.ok)
+		}
+	}
+}
+
+func TestParseToolCalls(t *testing.T) {
+	cases := []struct {
+		dialect  string
+		name     string
+		response string
+		calls    []string // 工具名和参数，参数不合法时以 ! 结尾
+		text     string
+	}{
+		{"xml", "parameters", "Listing.\n<tool_use name=\"Bash\">\n<parameter name=\"command\">ls</parameter>\n</tool_use>", []string{`Bash {"command":"ls"}`}, "Listing."},
+		{"xml", "json body", `<tool_use name="Bash">{"command": "ls"}</tool_use>`, []string{`Bash {"command":"ls"}`}, ""},
+		{"xml", "typed parameters", `<tool_use name="Edit"><parameter name="count">3</parameter><parameter name="meta">{"a":1}</parameter></tool_use>`, []string{`Edit {"count":3,"meta":{"a":1}}`}, ""},
+		{"xml", "case-insensitive tool name", `<tool_use name="bash"><parameter name="command">ls</parameter></tool_use>`, []string{`Bash {"command":"ls"}`}, ""},
+		{"xml", "unknown tool stays text", `<tool_use name="Nope"></tool_use>`, nil, `<tool_use name="Nope"></tool_use>`},
+		{"xml", "similar tag is text", `<tool_user name="Bash">`, nil, `<tool_user name="Bash">`},
+		{"xml", "two calls", `<tool_use name="Bash"><parameter name="command">a</parameter></tool_use> then <tool_use name="Bash"><parameter name="command">b</parameter></tool_use>`, []string{`Bash {"command":"a"}`, `Bash {"command":"b"}`}, "then"},
+		{"xml", "wrong type", `<tool_use name="Edit"><parameter name="count">many</parameter></tool_use>`, []string{`Edit {"count":"many"}!`}, ""},
+		{"vm", "exec", "<vm_exec> ls -la </vm_exec>", []string{`Bash {"command":"ls -la"}`}, ""},
+		{"vm", "exec with id", `<vm_exec id="toolu_1">ls</vm_exec>`, []string{`Bash {"command":"ls"}`}, ""},
+		{"vm", "similar tag is text", `<vm_executor>ls</vm_executor>`, nil, `<vm_executor>ls</vm_executor>`},
+		{"vm", "write", `<vm_write path="/a.txt">line 1
+line 2</vm_write>`, []string{`Write {"content":"line 1\nline 2","file_path":"/a.txt"}`}, ""},
+		{"vm", "call", `<vm_call name="Edit">{"file_path": "/a", "count": "3"}</vm_call>`, []string{`Edit {"count":3,"file_path":"/a"}`}, ""},
+		{"vm", "call with bad json", `<vm_call name="Edit">{"file_path": </vm_call>`, []string{`Edit {}!`}, ""},
+		{"hermes", "call", "<tool_call>\n{\"name\": \"Bash\", \"arguments\": {\"command\": \"ls\"}}\n</tool_call>", []string{`Bash {"command":"ls"}`}, ""},
+		{"hermes", "tool field and encoded arguments", `<tool_call>{"tool": "Bash", "arguments": "{\"command\": \"ls\"}"}</tool_call>`, []string{`Bash {"command":"ls"}`}, ""},
+		{"hermes", "not json", `<tool_call>Bash ls</tool_call>`, nil, `<tool_call>Bash ls</tool_call>`},
+		{"json", "call", "Sure.\n```json\n{\"name\": \"Bash\", \"arguments\": {\"command\": \"ls\"}}\n```", []string{`Bash {"command":"ls"}`}, "Sure."},
+		{"json", "other json stays text", "```json\n{\"a\": 1}\n```", nil, "```json\n{\"a\": 1}\n```"},
+		{"function", "keywords", "```function_call\nEdit(file_path=\"/a\", count=3, note=True)\n```", []string{`Edit {"count":3,"file_path":"/a","note":true}`}, ""},
+		{"function", "json object", "```function_call\nBash({\"command\": \"ls\"})\n```", []string{`Bash {"command":"ls"}`}, ""},
+		{"function", "bare word value", "```function_call\nBash(command=ls)\n```", []string{`Bash {}!`}, ""},
+		{"function", "id comment", "```function_call\nBash(command=\"ls\")  # id: toolu_1\n```", []string{`Bash {"command":"ls"}`}, ""},
+		{"function", "id text inside a value", "```function_call\nBash(command=\"echo ) # id: x\")\n```", []string{`Bash {"command":"echo ) # id: x"}`}, ""},
+		{"function", "identifier starting with True", "```function_call\nEdit(note=Trueish)\n```", []string{`Edit {}!`}, ""},
+		{"function", "None before a comma", "```function_call\nEdit(note=None, count=1)\n```", []string{`Edit {"count":1,"note":null}`}, ""},
+	}
+	for _, tc := range cases {
+		t.Run(tc.dialect+"/"+tc.name, func(t *testing.T) {
+			d, _ := GetDialect(tc.dialect)
+			calls, text := ParseToolCalls(d, tc.response, testTools)
+			var got []string
+			for _, call := range calls {
+				s := call.Function.Name + " " + call.Function.Arguments
+				if len(call.ValidationErrors) > 0 {
+					s += "!"
+				}
+				got = append(got, s)
+			}
+			if !reflect.DeepEqual(got, tc.calls) {
+				t.Errorf("calls = %q, want %q", got, tc.calls)
+			}
+			if text != tc.text {
+				t.Errorf("text = %q, want %q", text, tc.text)
+			}
+		})
+	}
+}
@@ -0,0 +1,183 @@
+package toolify
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// functionDialect 调用写成代码块中的函数调用，参数为关键字参数，值用 JSON 字面量：
+//
+//	```function_call
+//	Read(file_path="/tmp/a.txt", limit=20)
+//	```
+//
+// 历史中的调用在右括号后用 # id: 注释标出调用 ID，供模型与结果配对
+type functionDialect struct{}
+
+// 结束标记要求 ``` 在行首：参数值是 JSON 字面量，字符串中不能有换行，值里的 ``` 不会被当成代码块结束
+const (
+	functionFenceOpen  = "```function_call"
+	functionFenceClose = "\n```"
+)
+
+var (
+	functionCallPattern = regexp.MustCompile(`(?s)^([A-Za-z_][\w.-]*)\s*\((.*)\)(?:\s*#\s*id:\s*\S+)?$`)
+	functionCallOpen    = regexp.MustCompile(`^\s*([A-Za-z_][\w.-]*)\s*\(`)
+)
+
+func (functionDialect) Name() string { return "function" }
+
+func (functionDialect) Instructions(tools []ToolDefinition) string {
+	return "## Calling a tool\n\nWrite one fenced code block per call, exactly in this format:\n" +
+		functionFenceOpen + "\nTOOL_NAME(PARAMETER_NAME=value, OTHER_PARAMETER=value)" + functionFenceClose + "\n\n" +
+		callRules("Pass every argument from the input schema by keyword. Values are JSON literals: strings in double quotes with JSON escaping, numbers, true/false/null, arrays and objects. Each result comes back as a \"Tool result\" message carrying the id of its call.")
+}
+
+func (functionDialect) Delimiters() []Delimiter {
+	return []Delimiter{{Open: functionFenceOpen, Close: functionFenceClose}}
+}
+
+func (functionDialect) ParseBlock(block string, tools []ToolDefinition) (string, map[string]interface{}, error) {
+	body := strings.TrimSuffix(strings.TrimPrefix(block, functionFenceOpen), functionFenceClose)
+	match := functionCallPattern.FindStringSubmatch(strings.TrimSpace(body))
+	if match == nil {
+		return "", nil, nil
+	}
+	inner := strings.TrimSpace(match[2])
+	if strings.HasPrefix(inner, "{") {
+		args, err := parseJSONArguments(inner)
+		return match[1], args, err
+	}
+	args, err := parseKeywordArguments(inner)
+	return match[1], args, err
+}
+
+// ParsePartial 写到左括号即可确定工具名，参数值后出现 , 或 ) 才算写完
+func (functionDialect) ParsePartial(block string, tools []ToolDefinition) (string, []Argument) {
+	body := strings.TrimPrefix(block, functionFenceOpen)
+	match := functionCallOpen.FindStringSubmatch(body)
+	if match == nil {
+		return "", nil
+	}
+	inner := strings.TrimSpace(body[len(match[0]):])
+	if strings.HasPrefix(inner, "{") {
+		return match[1], partialObject(inner)
+	}
+
+	var args []Argument
+	for inner != "" {
+		name, value, rest, err := nextKeywordArgument(inner)
+		if err != nil || rest == "" || (rest[0] != ',' && rest[0] != ')') {
+			break
+		}
+		args = append(args, Argument{Name: name, Value: value})
+		if rest[0] == ')' {
+			break
+		}
+		inner = strings.TrimSpace(rest[1:])
+	}
+	return match[1], args
+}
+
+// parseKeywordArguments 解析 a="x", b=1 形式的关键字参数
+// 值按 JSON 解码，同时接受 Python 的 True / False / None
+func parseKeywordArguments(s string) (map[string]interface{}, error) {
+	args := make(map[string]interface{})
+	for s = strings.TrimSpace(s); s != ""; {
+		name, value, rest, err := nextKeywordArgument(s)
+		if err != nil {
+			return nil, err
+		}
+		args[name] = value
+
+		if rest == "" {
+			break
+		}
+		if rest[0] != ',' {
+			return nil, fmt.Errorf("invalid tool arguments: expected ',' after %s", name)
+		}
+		s = strings.TrimSpace(rest[1:])
+	}
+	return args, nil
+}
+
+// nextKeywordArgument 读取 s 开头的一个 name=value，返回去掉首尾空白的剩余内容
+func nextKeywordArgument(s string) (name string, value interface{}, rest string, err error) {
+	eq := strings.IndexByte(s, '=')
+	if eq <= 0 {
+		return "", nil, "", fmt.Errorf("invalid tool arguments: expected name=value near %q", truncate(s, 20))
+	}
+	name = strings.TrimSpace(s[:eq])
+	s = strings.TrimSpace(s[eq+1:])
+
+	if word, literal, ok := pythonLiteral(s); ok {
+		value, s = literal, s[len(word):]
+	} else {
+		dec := json.NewDecoder(strings.NewReader(s))
+		if err := dec.Decode(&value); err != nil {
+			return "", nil, "", fmt.Errorf("invalid tool arguments: value of %s: %w", name, err)
+		}
+		s = s[dec.InputOffset():]
+	}
+	return name, value, strings.TrimSpace(s), nil
+}
+
+// pythonLiterals 关键字参数中接受的 Python 字面量
+var pythonLiterals = []struct {
+	word  string
+	value interface{}
+}{{"True", true}, {"False", false}, {"None", nil}}
+
+// pythonLiteral s 以完整的 Python 字面量开头时返回该字面量，Trueish 这样的标识符不算
+func pythonLiteral(s string) (string, interface{}, bool) {
+	for _, lit := range pythonLiterals {
+		if !strings.HasPrefix(s, lit.word) {
+			continue
+		}
+		if rest := s[len(lit.word):]; rest != "" && isWordByte(rest[0]) {
+			return "", nil, false
+		}
+		return lit.word, lit.value, true
+	}
+	return "", nil, false
+}
+
+func isWordByte(c byte) bool {
+	return c == '_' || c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
+
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	return s[:n] + "..."
+}
+
+func (functionDialect) RenderCall(id, name, arguments string) string {
+	comment := ""
+	if id != "" {
+		comment = "  # id: " + id
+	}
+	var args map[string]interface{}
+	if err := json.Unmarshal([]byte(arguments), &args); err != nil {
+		return fmt.Sprintf("%s\n%s(%s)%s%s", functionFenceOpen, name, arguments, comment, functionFenceClose)
+	}
+	keys := make([]string, 0, len(args))
+	for k := range args {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	parts := make([]string, len(keys))
+	for i, k := range keys {
+		raw, _ := json.Marshal(args[k])
+		parts[i] = fmt.Sprintf("%s=%s", k, raw)
+	}
+	return fmt.Sprintf("%s\n%s(%s)%s%s", functionFenceOpen, name, strings.Join(parts, ", "), comment, functionFenceClose)
+}
+
+func (functionDialect) RenderResult(id, name, content string, isError bool) string {
+	return renderPlainResult(id, name, content, isError)
+}
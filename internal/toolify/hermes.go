@@ -0,0 +1,180 @@
+package toolify
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// hermesDialect Hermes 风格，调用写成 <tool_call> 中的 JSON 对象：
+//
+//	<tool_call>
+//	{"name": "Read", "arguments": {"file_path": "/tmp/a.txt"}}
+//	</tool_call>
+type hermesDialect struct{}
+
+const (
+	hermesOpenTag  = "<tool_call>"
+	hermesCloseTag = "</tool_call>"
+)
+
+func (hermesDialect) Name() string { return "hermes" }
+
+func (hermesDialect) Instructions(tools []ToolDefinition) string {
+	return `## Calling a tool
+
+Write one block per call, exactly in this format:
+<tool_call>
+{"name": "TOOL_NAME", "arguments": {"PARAMETER_NAME": value}}
+</tool_call>
+
+` + callRules("Write the arguments as one JSON object matching the input schema. Each result comes back in a <tool_response> block carrying the id of its call.")
+}
+
+func (hermesDialect) Delimiters() []Delimiter {
+	return []Delimiter{{Open: hermesOpenTag, Close: hermesCloseTag}}
+}
+
+func (hermesDialect) ParseBlock(block string, tools []ToolDefinition) (string, map[string]interface{}, error) {
+	body := strings.TrimSuffix(strings.TrimPrefix(block, hermesOpenTag), hermesCloseTag)
+	return parseNamedCall(body)
+}
+
+func (hermesDialect) ParsePartial(block string, tools []ToolDefinition) (string, []Argument) {
+	return partialNamedCall(strings.TrimPrefix(block, hermesOpenTag))
+}
+
+func (hermesDialect) RenderCall(id, name, arguments string) string {
+	return fmt.Sprintf("%s\n%s\n%s", hermesOpenTag, namedCallJSON(id, name, arguments), hermesCloseTag)
+}
+
+func (hermesDialect) RenderResult(id, name, content string, isError bool) string {
+	result := map[string]interface{}{"id": id, "content": content}
+	if name != "" {
+		result["name"] = name
+	}
+	if isError {
+		result["is_error"] = true
+	}
+	raw, _ := json.Marshal(result)
+	return fmt.Sprintf("<tool_response>\n%s\n</tool_response>", raw)
+}
+
+// namedCall JSON 格式的调用，hermes 和 json 两种格式共用
+// 模型有时把工具名写在 tool 字段、把参数写成 JSON 字符串，解析时都兼容
+type namedCall struct {
+	ID        string          `json:"id,omitempty"`
+	Name      string          `json:"name"`
+	Tool      string          `json:"tool,omitempty"`
+	Arguments json.RawMessage `json:"arguments"`
+}
+
+// parseNamedCall 解析 {"name": ..., "arguments": {...}}，不是这种对象时返回空工具名
+func parseNamedCall(body string) (string, map[string]interface{}, error) {
+	var call namedCall
+	if err := json.Unmarshal([]byte(strings.TrimSpace(body)), &call); err != nil {
+		return "", nil, nil
+	}
+	name := call.Name
+	if name == "" {
+		name = call.Tool
+	}
+	if name == "" {
+		return "", nil, nil
+	}
+
+	raw := strings.TrimSpace(string(call.Arguments))
+	if raw == "" || raw == "null" {
+		return name, nil, nil
+	}
+	var encoded string
+	if err := json.Unmarshal(call.Arguments, &encoded); err == nil {
+		raw = encoded
+	}
+	args, err := parseJSONArguments(raw)
+	return name, args, err
+}
+
+// partialNamedCall 读取未写完的 {"name": ..., "arguments": {...}} 中已经完整的工具名和参数
+func partialNamedCall(body string) (string, []Argument) {
+	dec := json.NewDecoder(strings.NewReader(body))
+	if tok, err := dec.Token(); err != nil || tok != json.Delim('{') {
+		return "", nil
+	}
+	var name, tool string
+	var args []Argument
+fields:
+	for dec.More() {
+		tok, err := dec.Token()
+		key, ok := tok.(string)
+		if err != nil || !ok {
+			break
+		}
+		switch key {
+		case "name", "tool":
+			var value string
+			if err := dec.Decode(&value); err != nil {
+				break fields
+			}
+			if key == "name" {
+				name = value
+			} else {
+				tool = value
+			}
+		case "arguments":
+			var closed bool
+			if args, closed = decodePartialObject(dec, body); !closed {
+				break fields
+			}
+		default:
+			var skip json.RawMessage
+			if err := dec.Decode(&skip); err != nil {
+				break fields
+			}
+		}
+	}
+	if name == "" {
+		name = tool
+	}
+	return name, args
+}
+
+// partialObject 读取未写完的 JSON 对象中已经完整的字段
+func partialObject(s string) []Argument {
+	args, _ := decodePartialObject(json.NewDecoder(strings.NewReader(s)), s)
+	return args
+}
+
+// decodePartialObject 从 dec 当前位置读取 JSON 对象的字段，s 为 dec 的全部输入；closed 表示对象已经结束
+// 值后面还有内容才算写完，避免把写了一半的数字当成完整的值
+func decodePartialObject(dec *json.Decoder, s string) (args []Argument, closed bool) {
+	if tok, err := dec.Token(); err != nil || tok != json.Delim('{') {
+		return nil, false
+	}
+	for dec.More() {
+		tok, err := dec.Token()
+		key, ok := tok.(string)
+		if err != nil || !ok {
+			return args, false
+		}
+		var value interface{}
+		if err := dec.Decode(&value); err != nil || strings.TrimSpace(s[dec.InputOffset():]) == "" {
+			return args, false
+		}
+		args = append(args, Argument{Name: key, Value: value})
+	}
+	tok, err := dec.Token()
+	return args, err == nil && tok == json.Delim('}')
+}
+
+// namedCallJSON 把历史中的调用写回 JSON 对象
+func namedCallJSON(id, name, arguments string) string {
+	args := json.RawMessage(arguments)
+	if strings.TrimSpace(arguments) == "" {
+		args = json.RawMessage("{}")
+	} else if !json.Valid(args) {
+		args, _ = json.Marshal(arguments)
+	}
+	raw, _ := json.Marshal(namedCall{ID: id, Name: name, Arguments: args})
+	return string(raw)
+}
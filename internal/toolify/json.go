@@ -0,0 +1,62 @@
+package toolify
+
+import (
+	"fmt"
+	"strings"
+)
+
+// jsonDialect 调用写成 ```json 代码块中的 JSON 对象：
+//
+//	```json
+//	{"name": "Read", "arguments": {"file_path": "/tmp/a.txt"}}
+//	```
+//
+// 不是调用的 JSON 代码块（没有 name 字段或工具不存在）按文本原样输出
+type jsonDialect struct{}
+
+// 结束标记要求 ``` 在行首：JSON 字符串中不能有换行，参数里的 ``` 不会被当成代码块结束
+const (
+	jsonFenceOpen  = "```json"
+	jsonFenceClose = "\n```"
+)
+
+func (jsonDialect) Name() string { return "json" }
+
+func (jsonDialect) Instructions(tools []ToolDefinition) string {
+	return "## Calling a tool\n\nWrite one fenced code block per call, exactly in this format:\n" +
+		jsonFenceOpen + "\n" + `{"name": "TOOL_NAME", "arguments": {"PARAMETER_NAME": value}}` + jsonFenceClose + "\n\n" +
+		callRules("Write the arguments as one JSON object matching the input schema. Do not use ```json blocks for anything other than tool calls. Each result comes back as a \"Tool result\" message carrying the id of its call.")
+}
+
+func (jsonDialect) Delimiters() []Delimiter {
+	return []Delimiter{{Open: jsonFenceOpen, Close: jsonFenceClose}}
+}
+
+func (jsonDialect) ParseBlock(block string, tools []ToolDefinition) (string, map[string]interface{}, error) {
+	body := strings.TrimSuffix(strings.TrimPrefix(block, jsonFenceOpen), jsonFenceClose)
+	return parseNamedCall(body)
+}
+
+func (jsonDialect) ParsePartial(block string, tools []ToolDefinition) (string, []Argument) {
+	return partialNamedCall(strings.TrimPrefix(block, jsonFenceOpen))
+}
+
+func (jsonDialect) RenderCall(id, name, arguments string) string {
+	return fmt.Sprintf("%s\n%s%s", jsonFenceOpen, namedCallJSON(id, name, arguments), jsonFenceClose)
+}
+
+func (jsonDialect) RenderResult(id, name, content string, isError bool) string {
+	return renderPlainResult(id, name, content, isError)
+}
+
+// renderPlainResult 用纯文本标题渲染工具结果，避免结果内容被当成调用块
+func renderPlainResult(id, name, content string, isError bool) string {
+	status := "Tool result"
+	if isError {
+		status = "Tool error"
+	}
+	if name != "" {
+		return fmt.Sprintf("%s (%s, id %s):\n%s", status, name, id, content)
+	}
+	return fmt.Sprintf("%s (id %s):\n%s", status, id, content)
+}
@@ -0,0 +1,363 @@
+package toolify
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// propertySchema 返回工具参数 name 的 schema，不存在时返回 nil
+func propertySchema(schema map[string]interface{}, name string) map[string]interface{} {
+	props, ok := schema["properties"].(map[string]interface{})
+	if !ok {
+		return nil
+	}
+	prop, _ := props[name].(map[string]interface{})
+	return prop
+}
+
+// schemaTypes 返回 schema 声明的类型，type 可以是 string 或 []string
+func schemaTypes(schema map[string]interface{}) []string {
+	switch t := schema["type"].(type) {
+	case string:
+		return []string{t}
+	case []interface{}:
+		types := make([]string, 0, len(t))
+		for _, v := range t {
+			if s, ok := v.(string); ok {
+				types = append(types, s)
+			}
+		}
+		return types
+	}
+	return nil
+}
+
+// schemaBranches 返回 anyOf / oneOf 的各个分支
+func schemaBranches(schema map[string]interface{}) []map[string]interface{} {
+	var branches []map[string]interface{}
+	for _, key := range []string{"anyOf", "oneOf"} {
+		list, _ := schema[key].([]interface{})
+		for _, v := range list {
+			if branch, ok := v.(map[string]interface{}); ok {
+				branches = append(branches, branch)
+			}
+		}
+	}
+	return branches
+}
+
+// unionTypes 返回 anyOf / oneOf 各分支声明的类型，有分支未声明类型时返回 nil
+func unionTypes(schema map[string]interface{}) []string {
+	var types []string
+	for _, branch := range schemaBranches(schema) {
+		branchTypes := schemaTypes(branch)
+		if len(branchTypes) == 0 {
+			return nil
+		}
+		types = append(types, branchTypes...)
+	}
+	return types
+}
+
+// coerceValue 按 schema 类型把标签中的文本转换为 JSON 值
+// 允许字符串时原样保留文本，否则非字符串类型依次尝试，都不匹配时按字符串处理
+func coerceValue(raw string, schema map[string]interface{}) interface{} {
+	types := schemaTypes(schema)
+	if len(types) == 0 {
+		types = unionTypes(schema)
+	}
+	if len(types) == 0 {
+		// 未声明类型：是合法 JSON 就按 JSON 解析，否则当作字符串
+		var v interface{}
+		if err := json.Unmarshal([]byte(strings.TrimSpace(raw)), &v); err == nil {
+			if _, isString := v.(string); !isString {
+				return v
+			}
+		}
+		return trimString(raw)
+	}
+
+	// 文本本身已经是合法的字符串值，如 ["string", "integer"] 下的 "5" 不转成数字
+	for _, t := range types {
+		if t == "string" {
+			return trimString(raw)
+		}
+	}
+
+	trimmed := strings.TrimSpace(raw)
+	// 模型有时会给数字、布尔值也加上引号
+	if unquoted, err := strconv.Unquote(trimmed); err == nil && strings.HasPrefix(trimmed, `"`) {
+		trimmed = strings.TrimSpace(unquoted)
+	}
+	for _, t := range types {
+		switch t {
+		case "integer":
+			if n, err := strconv.ParseInt(trimmed, 10, 64); err == nil {
+				return n
+			}
+		case "number":
+			if n, err := strconv.ParseFloat(trimmed, 64); err == nil {
+				return n
+			}
+		case "boolean":
+			if b, err := strconv.ParseBool(trimmed); err == nil {
+				return b
+			}
+		case "null":
+			if trimmed == "null" {
+				return nil
+			}
+		case "object":
+			var v map[string]interface{}
+			if err := json.Unmarshal([]byte(trimmed), &v); err == nil {
+				return v
+			}
+		case "array":
+			var v []interface{}
+			if err := json.Unmarshal([]byte(trimmed), &v); err == nil {
+				return v
+			}
+		}
+	}
+	return trimString(raw)
+}
+
+// trimString 去掉模型在标签内侧多写的一个换行
+func trimString(raw string) string {
+	raw = strings.TrimPrefix(raw, "\n")
+	return strings.TrimSuffix(raw, "\n")
+}
+
+// validateValue 按 schema 校验 value，能安全转换的类型会被修复（如 "5" -> 5）
+// 返回修复后的值和无法修复的错误，path 用于错误信息
+// 支持 type、enum、properties、required、additionalProperties、items、anyOf 和 oneOf（不检查是否只匹配一个分支）
+// $ref、allOf 等其他关键字不展开，对应的部分不做约束
+func validateValue(schema map[string]interface{}, value interface{}, path string) (interface{}, []string) {
+	if schema == nil {
+		return value, nil
+	}
+	var errs []string
+
+	if types := schemaTypes(schema); len(types) > 0 && !matchesAnyType(value, types) {
+		fixed, ok := coerceType(value, types)
+		if !ok {
+			return value, []string{fmt.Sprintf("%s: expected %s, got %s", pathName(path), strings.Join(types, " or "), jsonType(value))}
+		}
+		value = fixed
+	}
+
+	if enum, ok := schema["enum"].([]interface{}); ok && len(enum) > 0 {
+		fixed, ok := matchEnum(value, enum)
+		if !ok {
+			allowed, _ := json.Marshal(enum)
+			errs = append(errs, fmt.Sprintf("%s: must be one of %s", pathName(path), allowed))
+		}
+		value = fixed
+	}
+
+	if branches := schemaBranches(schema); len(branches) > 0 {
+		fixed, ok := matchBranch(branches, value, path)
+		if !ok {
+			errs = append(errs, fmt.Sprintf("%s: does not match any of the allowed schemas", pathName(path)))
+		}
+		value = fixed
+	}
+
+	switch v := value.(type) {
+	case map[string]interface{}:
+		props, _ := schema["properties"].(map[string]interface{})
+		if required, ok := schema["required"].([]interface{}); ok {
+			for _, r := range required {
+				if name, ok := r.(string); ok {
+					if _, exists := v[name]; !exists {
+						errs = append(errs, fmt.Sprintf("%s: missing required property %q", pathName(path), name))
+					}
+				}
+			}
+		}
+		names := make([]string, 0, len(v))
+		for name := range v {
+			names = append(names, name)
+		}
+		sort.Strings(names) // 错误信息顺序稳定
+		for _, name := range names {
+			propValue := v[name]
+			prop, ok := props[name].(map[string]interface{})
+			if !ok {
+				if additional, isBool := schema["additionalProperties"].(bool); isBool && !additional {
+					errs = append(errs, fmt.Sprintf("%s: unexpected property %q", pathName(path), name))
+				}
+				continue
+			}
+			fixed, propErrs := validateValue(prop, propValue, path+"."+name)
+			v[name] = fixed
+			errs = append(errs, propErrs...)
+		}
+	case []interface{}:
+		if items, ok := schema["items"].(map[string]interface{}); ok {
+			for i, item := range v {
+				fixed, itemErrs := validateValue(items, item, fmt.Sprintf("%s[%d]", path, i))
+				v[i] = fixed
+				errs = append(errs, itemErrs...)
+			}
+		}
+	}
+	return value, errs
+}
+
+// matchBranch 返回 value 符合的第一个 anyOf / oneOf 分支校验后的值
+// 优先选择不需要修复就符合的分支，避免 "5" 在 [integer, string] 下被转成数字
+func matchBranch(branches []map[string]interface{}, value interface{}, path string) (interface{}, bool) {
+	var repaired interface{}
+	found := false
+	for _, branch := range branches {
+		// 校验会原地修改对象和数组，每个分支使用独立的副本
+		fixed, errs := validateValue(branch, copyValue(value), path)
+		if len(errs) > 0 {
+			continue
+		}
+		if reflect.DeepEqual(fixed, value) {
+			return fixed, true
+		}
+		if !found {
+			repaired, found = fixed, true
+		}
+	}
+	if !found {
+		return value, false
+	}
+	return repaired, true
+}
+
+// copyValue 深拷贝解析出的 JSON 值
+func copyValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for k, item := range v {
+			m[k] = copyValue(item)
+		}
+		return m
+	case []interface{}:
+		list := make([]interface{}, len(v))
+		for i, item := range v {
+			list[i] = copyValue(item)
+		}
+		return list
+	}
+	return value
+}
+
+// matchesAnyType value 是否符合任一 JSON Schema 类型
+func matchesAnyType(value interface{}, types []string) bool {
+	for _, t := range types {
+		switch t {
+		case "string":
+			if _, ok := value.(string); ok {
+				return true
+			}
+		case "integer":
+			switch n := value.(type) {
+			case int64:
+				return true
+			case float64:
+				if n == math.Trunc(n) {
+					return true
+				}
+			}
+		case "number":
+			switch value.(type) {
+			case int64, float64:
+				return true
+			}
+		case "boolean":
+			if _, ok := value.(bool); ok {
+				return true
+			}
+		case "object":
+			if _, ok := value.(map[string]interface{}); ok {
+				return true
+			}
+		case "array":
+			if _, ok := value.([]interface{}); ok {
+				return true
+			}
+		case "null":
+			if value == nil {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// coerceType 尝试把 value 安全地转换为 types 中的某个类型
+func coerceType(value interface{}, types []string) (interface{}, bool) {
+	for _, t := range types {
+		switch v := value.(type) {
+		case string:
+			if t != "string" {
+				if fixed := coerceValue(v, map[string]interface{}{"type": t}); matchesAnyType(fixed, []string{t}) {
+					return fixed, true
+				}
+			}
+		case int64, float64, bool:
+			// 数字和布尔值可以无损转成字符串
+			if t == "string" {
+				raw, _ := json.Marshal(v)
+				return string(raw), true
+			}
+		}
+	}
+	return value, false
+}
+
+// matchEnum 检查 value 是否在 enum 中，字符串忽略大小写匹配时修正为 enum 中的写法
+func matchEnum(value interface{}, enum []interface{}) (interface{}, bool) {
+	raw, _ := json.Marshal(value)
+	for _, e := range enum {
+		if allowed, _ := json.Marshal(e); string(allowed) == string(raw) {
+			return value, true
+		}
+	}
+	if s, ok := value.(string); ok {
+		for _, e := range enum {
+			if allowed, ok := e.(string); ok && strings.EqualFold(allowed, strings.TrimSpace(s)) {
+				return allowed, true
+			}
+		}
+	}
+	return value, false
+}
+
+// jsonType 返回 value 的 JSON 类型名，用于错误信息
+func jsonType(value interface{}) string {
+	switch value.(type) {
+	case nil:
+		return "null"
+	case string:
+		return "string"
+	case int64, float64:
+		return "number"
+	case bool:
+		return "boolean"
+	case map[string]interface{}:
+		return "object"
+	case []interface{}:
+		return "array"
+	default:
+		return fmt.Sprintf("%T", value)
+	}
+}
+
+func pathName(path string) string {
+	if path == "" {
+		return "arguments"
+	}
+	return strings.TrimPrefix(path, ".")
+}
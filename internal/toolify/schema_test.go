@@ -0,0 +1,128 @@
+package toolify
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestCoerceValue(t *testing.T) {
+	cases := []struct {
+		name   string
+		raw    string
+		schema string
+		want   interface{}
+	}{
+		{"string trims one newline", "\nhello\n\n", `{"type":"string"}`, "hello\n"},
+		{"integer", " 42 ", `{"type":"integer"}`, int64(42)},
+		{"quoted integer", `"42"`, `{"type":"integer"}`, int64(42)},
+		{"number", "1.5", `{"type":"number"}`, 1.5},
+		{"boolean", "true", `{"type":"boolean"}`, true},
+		{"null", "null", `{"type":["null","integer"]}`, nil},
+		{"nullable string keeps text", "null", `{"type":["null","string"]}`, "null"},
+		{"object", `{"a":1}`, `{"type":"object"}`, map[string]interface{}{"a": float64(1)}},
+		{"array", `[1,"x"]`, `{"type":"array"}`, []interface{}{float64(1), "x"}},
+		{"first matching type wins", "7", `{"type":["boolean","integer","number"]}`, int64(7)},
+		{"union with string keeps text", "7", `{"type":["integer","string"]}`, "7"},
+		{"anyOf types", "7", `{"anyOf":[{"type":"null"},{"type":"integer"}]}`, int64(7)},
+		{"oneOf with string keeps text", "7", `{"oneOf":[{"type":"integer"},{"type":"string"}]}`, "7"},
+		{"untyped branch", "[1]", `{"anyOf":[{"type":"integer"},{"$ref":"#/$defs/List"}]}`, []interface{}{float64(1)}},
+		{"unparsable falls back to string", "seven", `{"type":"integer"}`, "seven"},
+		{"untyped JSON literal", "[1]", `{}`, []interface{}{float64(1)}},
+		{"untyped JSON string stays raw", `"x"`, `{}`, `"x"`},
+		{"untyped text", "\nls -la\n", `{}`, "ls -la"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			var schema map[string]interface{}
+			if err := json.Unmarshal([]byte(tc.schema), &schema); err != nil {
+				t.Fatal(err)
+			}
+			if got := coerceValue(tc.raw, schema); !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("coerceValue(%q) = %#v, want %#v", tc.raw, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestValidateValue(t *testing.T) {
+	const schema = `{
+		"type": "object",
+		"properties": {
+			"command": {"type": "string"},
+			"timeout": {"type": "integer"},
+			"mode": {"type": "string", "enum": ["fast", "safe"]},
+			"tags": {"type": "array", "items": {"type": "integer"}},
+			"opts": {"type": "object", "properties": {"dry": {"type": "boolean"}}, "additionalProperties": false},
+			"limit": {"anyOf": [{"type": "integer"}, {"type": "string", "enum": ["all"]}]},
+			"id": {"oneOf": [{"type": "integer"}, {"type": "string"}]},
+			"env": {"$ref": "#/$defs/Env"}
+		},
+		"required": ["command"]
+	}`
+	cases := []struct {
+		name string
+		args string
+		want string   // 修复后的参数
+		errs []string // 无法修复的错误
+	}{
+		{"valid", `{"command":"ls","timeout":5}`, `{"command":"ls","timeout":5}`, nil},
+		{"number from string", `{"command":"ls","timeout":"5"}`, `{"command":"ls","timeout":5}`, nil},
+		{"string from number", `{"command":42}`, `{"command":"42"}`, nil},
+		{"enum case fixed", `{"command":"ls","mode":"FAST"}`, `{"command":"ls","mode":"fast"}`, nil},
+		{"array items", `{"command":"ls","tags":["1",2]}`, `{"command":"ls","tags":[1,2]}`, nil},
+		{"nested object", `{"command":"ls","opts":{"dry":"true"}}`, `{"command":"ls","opts":{"dry":true}}`, nil},
+		{"anyOf unchanged", `{"command":"ls","limit":"all"}`, `{"command":"ls","limit":"all"}`, nil},
+		{"anyOf repaired", `{"command":"ls","limit":"5"}`, `{"command":"ls","limit":5}`, nil},
+		{"oneOf prefers unchanged branch", `{"command":"ls","id":"5"}`, `{"command":"ls","id":"5"}`, nil},
+		{"anyOf mismatch", `{"command":"ls","limit":"none"}`, `{"command":"ls","limit":"none"}`, []string{"limit: does not match any of the allowed schemas"}},
+		{"$ref not constrained", `{"command":"ls","env":{"a":1}}`, `{"command":"ls","env":{"a":1}}`, nil},
+		{"missing required", `{"timeout":5}`, `{"timeout":5}`, []string{`arguments: missing required property "command"`}},
+		{"wrong type", `{"command":"ls","timeout":"soon"}`, `{"command":"ls","timeout":"soon"}`, []string{"timeout: expected integer, got string"}},
+		{"fractional integer", `{"command":"ls","timeout":1.5}`, `{"command":"ls","timeout":1.5}`, []string{"timeout: expected integer, got number"}},
+		{"enum mismatch", `{"command":"ls","mode":"slow"}`, `{"command":"ls","mode":"slow"}`, []string{`mode: must be one of ["fast","safe"]`}},
+		{"unexpected nested property", `{"command":"ls","opts":{"force":true}}`, `{"command":"ls","opts":{"force":true}}`, []string{`opts: unexpected property "force"`}},
+		{"errors in order", `{"timeout":"x","tags":["y"]}`, `{"tags":["y"],"timeout":"x"}`, []string{
+			`arguments: missing required property "command"`,
+			"tags[0]: expected integer, got string",
+			"timeout: expected integer, got string",
+		}},
+	}
+	var s map[string]interface{}
+	if err := json.Unmarshal([]byte(schema), &s); err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			var args interface{}
+			if err := json.Unmarshal([]byte(tc.args), &args); err != nil {
+				t.Fatal(err)
+			}
+			fixed, errs := validateValue(s, args, "")
+			got, _ := json.Marshal(fixed)
+			if string(got) != tc.want {
+				t.Errorf("fixed = %s, want %s", got, tc.want)
+			}
+			if strings.Join(errs, "\n") != strings.Join(tc.errs, "\n") {
+				t.Errorf("errors = %q, want %q", errs, tc.errs)
+			}
+		})
+	}
+}
+
+func TestRepairPrompt(t *testing.T) {
+	prompt := RepairPrompt([]ToolCall{
+		{Function: ToolCallFunction{Name: "Bash"}, ValidationErrors: []string{`arguments: missing required property "command"`}},
+		{Function: ToolCallFunction{Name: "Edit"}, ValidationErrors: []string{"count: expected integer, got string", "the tool call was not closed with </tool_use>"}},
+	})
+	for _, want := range []string{
+		"Bash:\n- arguments: missing required property \"command\"\n",
+		"Edit:\n- count: expected integer, got string\n- the tool call was not closed with </tool_use>\n",
+		"same format and order",
+	} {
+		if !strings.Contains(prompt, want) {
+			t.Errorf("prompt does not contain %q:\n%s", want, prompt)
+		}
+	}
+}
@@ -0,0 +1,369 @@
+package toolify
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// StreamEvent 流式解析产生的事件，Text、ToolCall、Progress 三选一
+type StreamEvent struct {
+	Text     string
+	ToolCall *ToolCall
+	Raw      string        // 工具调用块的原文
+	Progress *CallProgress // 未闭合调用块中新确定的内容，同一调用块最后总会有对应的 ToolCall
+}
+
+// IsText 是否为文本段
+func (ev StreamEvent) IsText() bool {
+	return ev.ToolCall == nil && ev.Progress == nil
+}
+
+// Argument 一个已经完整写出的参数
+type Argument struct {
+	Name  string
+	Value interface{}
+}
+
+// CallProgress 未闭合调用块的进度
+// 工具名确定时输出第一个，之后每有参数写完输出一个，Arguments 只包含新写完且通过校验的参数
+type CallProgress struct {
+	Name      string
+	Arguments []Argument
+}
+
+// StreamParser 按 Dialect 的起止标记增量解析流式响应中的调用块
+// 标记外的文本立即输出；可能是开始标记开头的片段会暂存，直到能确定是否为标记；
+// 工具调用在结束标记到达后整体输出，标记原文不会出现在文本中；
+// 开启 EnableProgress 后，调用块未闭合时也会输出已确定的工具名和参数
+type StreamParser struct {
+	dialect Dialect
+	delims  []Delimiter
+	tools   []ToolDefinition
+	buf     strings.Builder // 尚未输出的内容
+	open    *Delimiter      // buf 以该调用块的开始标记开头，等待结束标记
+	count   int             // 已输出的工具调用数
+
+	progress bool            // 是否输出未闭合调用块的进度
+	started  bool            // 当前调用块已输出过进度
+	stalled  bool            // 当前调用块有参数未通过校验，之后的参数等闭合后再输出
+	sent     map[string]bool // 当前调用块已输出的参数
+	checked  int             // 当前调用块上次解析进度时的长度
+}
+
+// NewStreamParser 创建流式解析器，tools 为空时所有内容原样作为文本输出
+func NewStreamParser(d Dialect, tools []ToolDefinition) *StreamParser {
+	return &StreamParser{dialect: d, delims: d.Delimiters(), tools: tools}
+}
+
+// Feed 写入一段增量文本，返回当前可以输出的事件
+func (p *StreamParser) Feed(delta string) []StreamEvent {
+	if len(p.tools) == 0 {
+		if delta == "" {
+			return nil
+		}
+		return []StreamEvent{{Text: delta}}
+	}
+	p.buf.WriteString(delta)
+	return p.drain(false)
+}
+
+// EnableProgress 开启未闭合调用块的进度输出，只对实现了 PartialDialect 的格式生效
+func (p *StreamParser) EnableProgress() {
+	p.progress = true
+}
+
+// Flush 流结束时调用，输出剩余内容
+// 未闭合的调用块不按文本输出：能确定工具名时作为带校验错误的调用输出，否则丢弃
+func (p *StreamParser) Flush() []StreamEvent {
+	if len(p.tools) == 0 {
+		return nil
+	}
+	return p.drain(true)
+}
+
+// Interrupt 正文被推理等其他内容打断时调用，把暂存的半个开始标记按文本输出
+// 已开始的调用块不受影响，继续等待结束标记
+func (p *StreamParser) Interrupt() []StreamEvent {
+	if p.open != nil || p.buf.Len() == 0 {
+		return nil
+	}
+	text := p.buf.String()
+	p.buf.Reset()
+	return []StreamEvent{{Text: text}}
+}
+
+// ToolCallCount 返回已输出的工具调用数
+func (p *StreamParser) ToolCallCount() int {
+	return p.count
+}
+
+// drain 尽可能多地处理缓冲区
+func (p *StreamParser) drain(final bool) []StreamEvent {
+	var events []StreamEvent
+	emitText := func(text string) {
+		if text == "" {
+			return
+		}
+		// 合并相邻文本，减少下游写出次数
+		if n := len(events); n > 0 && events[n-1].IsText() {
+			events[n-1].Text += text
+			return
+		}
+		events = append(events, StreamEvent{Text: text})
+	}
+
+	pending := p.buf.String()
+	for pending != "" {
+		if p.open != nil {
+			end := strings.Index(pending[len(p.open.Open):], p.open.Close)
+			if end < 0 {
+				if progress := p.parseProgress(pending); progress != nil {
+					events = append(events, StreamEvent{Progress: progress})
+				}
+				break
+			}
+			block := pending[:len(p.open.Open)+end+len(p.open.Close)]
+			pending = pending[len(block):]
+
+			if call, ok := p.parseBlock(block); ok {
+				events = append(events, StreamEvent{ToolCall: &call, Raw: block})
+			} else if p.started {
+				// 已经输出了进度，不能再按文本输出
+				if call, ok := p.partialCall(block, "the tool call could not be parsed"); ok {
+					events = append(events, StreamEvent{ToolCall: &call, Raw: block})
+				}
+			} else {
+				emitText(block)
+			}
+			p.endBlock()
+			continue
+		}
+
+		start, delim := p.findOpen(pending)
+		if start < 0 {
+			// 末尾可能是半个开始标记，先留着
+			keep := p.partialOpenSuffix(pending)
+			emitText(pending[:len(pending)-keep])
+			pending = pending[len(pending)-keep:]
+			break
+		}
+
+		emitText(pending[:start])
+		pending = pending[start:]
+		p.open = delim
+	}
+
+	if final {
+		if p.open != nil {
+			reason := fmt.Sprintf("the tool call was not closed with %s", strings.TrimSpace(p.open.Close))
+			if call, ok := p.partialCall(pending, reason); ok {
+				events = append(events, StreamEvent{ToolCall: &call, Raw: pending})
+			}
+			p.endBlock()
+		} else {
+			emitText(pending)
+		}
+		pending = ""
+	}
+
+	p.buf.Reset()
+	p.buf.WriteString(pending)
+	return events
+}
+
+// endBlock 当前调用块结束，清空进度状态
+func (p *StreamParser) endBlock() {
+	p.open = nil
+	p.started, p.stalled = false, false
+	p.sent = nil
+	p.checked = 0
+}
+
+// parseProgress 解析未闭合的调用块，返回新确定的工具名和参数，没有新内容时返回 nil
+// 参数按自己的 schema 校验，不合法的参数及其后的参数留到调用块闭合后随 ToolCall 输出
+func (p *StreamParser) parseProgress(block string) *CallProgress {
+	partial, ok := p.dialect.(PartialDialect)
+	if !ok || !p.progress || p.stalled {
+		return nil
+	}
+	// 只在新内容可能结束了工具名或参数时重新解析，长参数逐段到达时不必每次都解析
+	if !strings.ContainsAny(block[p.checked:], ">,}()") {
+		return nil
+	}
+	p.checked = len(block)
+
+	name, args := partial.ParsePartial(block, p.tools)
+	tool, ok := findTool(p.tools, name)
+	if !ok {
+		return nil
+	}
+	if p.sent == nil {
+		p.sent = make(map[string]bool)
+	}
+	progress := &CallProgress{Name: tool.GetName()}
+	for _, arg := range args {
+		if p.sent[arg.Name] {
+			continue
+		}
+		value, ok := validArgument(tool.GetParameters(), arg)
+		if !ok {
+			p.stalled = true
+			break
+		}
+		p.sent[arg.Name] = true
+		progress.Arguments = append(progress.Arguments, Argument{Name: arg.Name, Value: value})
+	}
+	if p.started && len(progress.Arguments) == 0 {
+		return nil
+	}
+	p.started = true
+	return progress
+}
+
+// validArgument 按参数自己的 schema 校验，结果与校验整个参数对象时该参数得到的值一致
+func validArgument(schema map[string]interface{}, arg Argument) (interface{}, bool) {
+	prop := propertySchema(schema, arg.Name)
+	if prop == nil {
+		if additional, isBool := schema["additionalProperties"].(bool); isBool && !additional {
+			return nil, false
+		}
+	}
+	value, errs := validateValue(prop, arg.Value, "."+arg.Name)
+	return value, len(errs) == 0
+}
+
+// partialCall 把无法正常解析的调用块中已经写完的参数作为工具调用输出，reason 记录在 ValidationErrors 中
+// 工具名无法确定时返回 false
+func (p *StreamParser) partialCall(block, reason string) (ToolCall, bool) {
+	partial, ok := p.dialect.(PartialDialect)
+	if !ok {
+		return ToolCall{}, false
+	}
+	name, parsed := partial.ParsePartial(block, p.tools)
+	args := make(map[string]interface{}, len(parsed))
+	for _, arg := range parsed {
+		args[arg.Name] = arg.Value
+	}
+	call, ok := newToolCall(p.tools, name, args, nil)
+	if !ok {
+		return ToolCall{}, false
+	}
+	call.ValidationErrors = append(call.ValidationErrors, reason)
+	call.ID = strconv.Itoa(p.count)
+	p.count++
+	return call, true
+}
+
+// findOpen 返回最早出现的开始标记位置
+func (p *StreamParser) findOpen(s string) (int, *Delimiter) {
+	start, found := -1, -1
+	for i, delim := range p.delims {
+		if idx := strings.Index(s, delim.Open); idx >= 0 && (start < 0 || idx < start) {
+			start, found = idx, i
+		}
+	}
+	if found < 0 {
+		return -1, nil
+	}
+	return start, &p.delims[found]
+}
+
+// partialOpenSuffix 返回 s 末尾可能是某个开始标记开头部分的最大长度
+func (p *StreamParser) partialOpenSuffix(s string) int {
+	keep := 0
+	for _, delim := range p.delims {
+		n := min(len(s), len(delim.Open)-1)
+		for ; n > keep; n-- {
+			if strings.HasPrefix(delim.Open, s[len(s)-n:]) {
+				keep = n
+				break
+			}
+		}
+	}
+	return keep
+}
+
+// parseBlock 解析一个完整的调用块
+func (p *StreamParser) parseBlock(block string) (ToolCall, bool) {
+	name, args, err := p.dialect.ParseBlock(block, p.tools)
+	if name == "" {
+		return ToolCall{}, false
+	}
+	call, ok := newToolCall(p.tools, name, args, err)
+	if !ok {
+		return ToolCall{}, false
+	}
+	call.ID = strconv.Itoa(p.count)
+	p.count++
+	return call, true
+}
+
+// ArgumentStream 把逐步写完的参数输出为 JSON 片段，所有片段按顺序拼接后是完整的参数对象
+// 用于流式输出 input_json_delta / function.arguments
+type ArgumentStream struct {
+	sent map[string]bool
+}
+
+// Next 输出新写完的参数，每个参数一个片段，已输出过的参数忽略
+func (s *ArgumentStream) Next(args []Argument) []string {
+	var chunks []string
+	for _, arg := range args {
+		if s.sent[arg.Name] {
+			continue
+		}
+		key, _ := json.Marshal(arg.Name)
+		value, _ := json.Marshal(arg.Value)
+		chunks = append(chunks, s.prefix()+string(key)+":"+string(value))
+		if s.sent == nil {
+			s.sent = make(map[string]bool)
+		}
+		s.sent[arg.Name] = true
+	}
+	return chunks
+}
+
+// Finish 按字段输出最终参数中尚未输出的部分并闭合对象，已输出的字段不再重复
+func (s *ArgumentStream) Finish(arguments string) []string {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(arguments), &fields); err != nil || len(fields) == 0 {
+		if len(s.sent) > 0 {
+			return []string{"}"}
+		}
+		return []string{arguments}
+	}
+
+	keys := make([]string, 0, len(fields))
+	for k := range fields {
+		if !s.sent[k] {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	chunks := make([]string, 0, len(keys)+1)
+	for _, k := range keys {
+		key, _ := json.Marshal(k)
+		chunks = append(chunks, s.prefix()+string(key)+":"+string(fields[k]))
+		if s.sent == nil {
+			s.sent = make(map[string]bool)
+		}
+		s.sent[k] = true
+	}
+	return append(chunks, "}")
+}
+
+// prefix 下一个字段前的分隔符
+func (s *ArgumentStream) prefix() string {
+	if len(s.sent) == 0 {
+		return "{"
+	}
+	return ","
+}
+
+// ArgumentChunks 将 JSON 参数按顶层字段拆成多个片段，按顺序拼接后与原文一致
+func ArgumentChunks(arguments string) []string {
+	return (&ArgumentStream{}).Finish(arguments)
+}
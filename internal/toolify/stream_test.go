@@ -0,0 +1,167 @@
+package toolify
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// feedRunes 逐字符写入解析器，模拟最细粒度的流式响应
+func feedRunes(p *StreamParser, s string) []StreamEvent {
+	var events []StreamEvent
+	for _, r := range s {
+		events = append(events, p.Feed(string(r))...)
+	}
+	return append(events, p.Flush()...)
+}
+
+func TestStreamProgress(t *testing.T) {
+	for _, name := range DialectNames() {
+		d, _ := GetDialect(name)
+		for _, tc := range roundTripCalls {
+			t.Run(name+"/"+tc.name, func(t *testing.T) {
+				parser := NewStreamParser(d, testTools)
+				parser.EnableProgress()
+				events := feedRunes(parser, "before\n"+d.RenderCall("call_1", tc.tool, tc.args)+"\nafter")
+
+				var (
+					text     string
+					args     ArgumentStream
+					chunks   []string
+					progress int
+					call     *ToolCall
+				)
+				for _, ev := range events {
+					switch {
+					case ev.Progress != nil:
+						if call != nil {
+							t.Fatal("progress after the tool call")
+						}
+						if ev.Progress.Name != tc.tool {
+							t.Fatalf("progress name = %q, want %q", ev.Progress.Name, tc.tool)
+						}
+						progress++
+						chunks = append(chunks, args.Next(ev.Progress.Arguments)...)
+					case ev.ToolCall != nil:
+						call = ev.ToolCall
+						chunks = append(chunks, args.Finish(call.Function.Arguments)...)
+					default:
+						text += ev.Text
+					}
+				}
+				if call == nil || progress == 0 {
+					t.Fatalf("call = %v, progress events = %d", call, progress)
+				}
+				if text != "before\n\nafter" {
+					t.Errorf("text = %q", text)
+				}
+				var got, want map[string]interface{}
+				if err := json.Unmarshal([]byte(strings.Join(chunks, "")), &got); err != nil {
+					t.Fatalf("chunks %q are not one JSON object: %v", chunks, err)
+				}
+				_ = json.Unmarshal([]byte(call.Function.Arguments), &want)
+				if !reflect.DeepEqual(got, want) {
+					t.Errorf("streamed arguments = %s, want %s", strings.Join(chunks, ""), call.Function.Arguments)
+				}
+			})
+		}
+	}
+}
+
+func TestParsePartial(t *testing.T) {
+	cases := []struct {
+		dialect string
+		block   string
+		name    string
+		args    []string
+	}{
+		{"xml", `<tool_use name="Bas`, "", nil},
+		{"xml", `<tool_use name="Edit">` + "\n" + `<parameter name="file_path">/a</parameter><parameter name="count">1`, "Edit", []string{"file_path"}},
+		{"xml", `<tool_use name="Edit"><parameter name="old"><![CDATA[</]]><![CDATA[/x]]></parameter>`, "Edit", []string{"old"}},
+		{"vm", `<vm_write path="/a.txt">partial`, "Write", []string{"file_path"}},
+		{"vm", `<vm_exec>rm -rf /tm`, "Bash", nil},
+		{"vm", `<vm_call name="Edit">{"file_path": "/a", "count": 12`, "Edit", []string{"file_path"}},
+		{"hermes", `<tool_call>` + "\n" + `{"name": "Bash", "arguments": {"command": "ls", "timeout": 5`, "Bash", []string{"command"}},
+		{"hermes", `<tool_call>{"arguments": {"command": "ls"}, "name": "Ba`, "", []string{"command"}},
+		{"json", "```json\n" + `{"name": "Edit", "arguments": {"meta": {"a": [1, 2]}, "old": "x`, "Edit", []string{"meta"}},
+		{"function", "```function_call\n" + `Edit(file_path="/a", count=1`, "Edit", []string{"file_path"}},
+		{"function", "```function_call\n" + `Edit(file_path="/a", count=1)`, "Edit", []string{"file_path", "count"}},
+		{"function", "```function_call\n" + `Edit({"old": "a", "count": 1`, "Edit", []string{"old"}},
+	}
+	for _, tc := range cases {
+		d, _ := GetDialect(tc.dialect)
+		name, args := d.(PartialDialect).ParsePartial(tc.block, testTools)
+		var names []string
+		for _, arg := range args {
+			names = append(names, arg.Name)
+		}
+		if name != tc.name || strings.Join(names, ",") != strings.Join(tc.args, ",") {
+			t.Errorf("%s %q: got %q %v, want %q %v", tc.dialect, tc.block, name, names, tc.name, tc.args)
+		}
+	}
+}
+
+func TestFlushUnclosedBlock(t *testing.T) {
+	cases := []struct {
+		name    string
+		dialect string
+		input   string
+		text    string
+		call    string // 工具名和参数，为空表示调用块被丢弃
+	}{
+		{"xml with finished parameter", "xml", "run <tool_use name=\"Bash\">\n<parameter name=\"command\">ls</parameter>\n", "run ", `Bash {"command":"ls"}`},
+		{"xml parameter cut off", "xml", "run <tool_use name=\"Bash\">\n<parameter name=\"command\">rm -rf /tm", "run ", `Bash {}`},
+		{"unknown tool", "xml", "run <tool_use name=\"Nope\">", "run ", ""},
+		{"vm tag", "vm", "run <vm_exec>rm -rf /tm", "run ", `Bash {}`},
+		{"json without a name", "json", "see ```json\n{\"a\": 1", "see ", ""},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			d, _ := GetDialect(tc.dialect)
+			var text string
+			var calls []string
+			for _, ev := range feedRunes(NewStreamParser(d, testTools), tc.input) {
+				if ev.ToolCall == nil {
+					text += ev.Text
+					continue
+				}
+				calls = append(calls, ev.ToolCall.Function.Name+" "+ev.ToolCall.Function.Arguments)
+				errs := strings.Join(ev.ToolCall.ValidationErrors, "; ")
+				if !strings.Contains(errs, "not closed") {
+					t.Errorf("validation errors = %q, want the unclosed block reported", errs)
+				}
+			}
+			if text != tc.text {
+				t.Errorf("text = %q, want %q", text, tc.text)
+			}
+			if strings.Join(calls, "|") != tc.call {
+				t.Errorf("calls = %q, want %q", calls, tc.call)
+			}
+		})
+	}
+}
+
+func TestArgumentStream(t *testing.T) {
+	cases := []struct {
+		name      string
+		progress  []Argument
+		arguments string
+		want      []string
+	}{
+		{"all at the end", nil, `{"b":1,"a":"x"}`, []string{`{"a":"x"`, `,"b":1`, `}`}},
+		{"empty object", nil, `{}`, []string{`{}`}},
+		{"not an object", nil, `oops`, []string{`oops`}},
+		{"some streamed", []Argument{{"b", 1}}, `{"a":"x","b":1}`, []string{`{"b":1`, `,"a":"x"`, `}`}},
+		{"all streamed", []Argument{{"a", "x"}, {"a", "y"}}, `{"a":"x"}`, []string{`{"a":"x"`, `}`}},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			var s ArgumentStream
+			got := append(s.Next(tc.progress), s.Finish(tc.arguments)...)
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("chunks = %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
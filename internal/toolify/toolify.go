@@ -2,190 +2,198 @@
 package toolify
 
 import (
-    "encoding/json"
-    "fmt"
-    "regexp"
-    "strings"
+	"encoding/json"
+	"fmt"
+	"strings"
 )
 
 // ToolDefinition 工具定义 (支持 Anthropic 格式)
 type ToolDefinition struct {
-    // Anthropic 格式字段
-    Name        string                 `json:"name,omitempty"`
-    Description string                 `json:"description,omitempty"`
-    InputSchema map[string]interface{} `json:"input_schema,omitempty"`
-
-    // OpenAI 格式字段 (兼容)
-    Type     string   `json:"type,omitempty"`
-    Function Function `json:"function,omitempty"`
+	// Anthropic 格式字段
+	Name        string                 `json:"name,omitempty"`
+	Description string                 `json:"description,omitempty"`
+	InputSchema map[string]interface{} `json:"input_schema,omitempty"`
+
+	// OpenAI 格式字段 (兼容)
+	Type     string   `json:"type,omitempty"`
+	Function Function `json:"function,omitempty"`
 }
 
 // Function 函数定义 (OpenAI 格式)
 type Function struct {
-    Name        string                 `json:"name,omitempty"`
-    Description string                 `json:"description,omitempty"`
-    Parameters  map[string]interface{} `json:"parameters,omitempty"`
+	Name        string                 `json:"name,omitempty"`
+	Description string                 `json:"description,omitempty"`
+	Parameters  map[string]interface{} `json:"parameters,omitempty"`
 }
 
 // GetName 获取工具名称 (兼容两种格式)
 func (t ToolDefinition) GetName() string {
-    if t.Name != "" {
-        return t.Name
-    }
-    return t.Function.Name
+	if t.Name != "" {
+		return t.Name
+	}
+	return t.Function.Name
 }
 
 // GetDescription 获取工具描述 (兼容两种格式)
 func (t ToolDefinition) GetDescription() string {
-    if t.Description != "" {
-        return t.Description
-    }
-    return t.Function.Description
+	if t.Description != "" {
+		return t.Description
+	}
+	return t.Function.Description
 }
 
 // GetParameters 获取工具参数 (兼容两种格式)
 func (t ToolDefinition) GetParameters() map[string]interface{} {
-    if t.InputSchema != nil {
-        return t.InputSchema
-    }
-    return t.Function.Parameters
+	if t.InputSchema != nil {
+		return t.InputSchema
+	}
+	return t.Function.Parameters
 }
 
 // ToolCall 解析后的工具调用
 type ToolCall struct {
-    ID       string           `json:"id"`
-    Type     string           `json:"type"`
-    Function ToolCallFunction `json:"function"`
+	ID       string           `json:"id"`
+	Type     string           `json:"type"`
+	Function ToolCallFunction `json:"function"`
+	// ValidationErrors 参数不符合工具 JSON Schema 的原因，为空表示校验通过
+	ValidationErrors []string `json:"-"`
 }
 
 // ToolCallFunction 工具调用函数
 type ToolCallFunction struct {
-    Name      string `json:"name"`
-    Arguments string `json:"arguments"`
+	Name      string `json:"name"`
+	Arguments string `json:"arguments"`
 }
 
 // GenerateToolPrompt 生成工具调用的系统提示
-func GenerateToolPrompt(tools []ToolDefinition) string {
-    if len(tools) == 0 {
-        return ""
-    }
-
-    var toolsDesc strings.Builder
-    for _, tool := range tools {
-        name := tool.GetName()
-        if name == "" {
-            continue
-        }
-        toolsDesc.WriteString(fmt.Sprintf("### %s\n", name))
-        if desc := tool.GetDescription(); desc != "" {
-            toolsDesc.WriteString(fmt.Sprintf("%s\n", desc))
-        }
-
-        params := tool.GetParameters()
-        if params != nil {
-            if props, ok := params["properties"].(map[string]interface{}); ok {
-                toolsDesc.WriteString("Parameters:\n")
-                for paramName, prop := range props {
-                    if propMap, ok := prop.(map[string]interface{}); ok {
-                        propType := "string"
-                        if t, ok := propMap["type"].(string); ok {
-                            propType = t
-                        }
-                        desc := ""
-                        if d, ok := propMap["description"].(string); ok {
-                            desc = " - " + d
-                        }
-                        toolsDesc.WriteString(fmt.Sprintf("- %s (%s)%s\n", paramName, propType, desc))
-                    }
-                }
-            }
-        }
-        toolsDesc.WriteString("\n")
-    }
-
-    // 精简的虚拟机框架 prompt
-    return `
-You are in a sandbox VM with full permissions.
-Write files: <vm_write path="/path">content</vm_write>
-Run commands: <vm_exec>command</vm_exec>
-Web search: <vm_search>query</vm_search>
-Fetch URL: <vm_fetch>url</vm_fetch>
-`
+// 列出每个工具的名称、描述和完整的 JSON Schema，调用格式由 d 说明，最后附上 tool_choice 约束
+func GenerateToolPrompt(d Dialect, tools []ToolDefinition, choice ToolChoice) string {
+	tools = choice.Tools(tools)
+	if len(tools) == 0 {
+		return ""
+	}
+
+	var toolsDesc strings.Builder
+	for _, tool := range tools {
+		name := tool.GetName()
+		if name == "" {
+			continue
+		}
+		toolsDesc.WriteString(fmt.Sprintf("### %s\n", name))
+		if desc := tool.GetDescription(); desc != "" {
+			toolsDesc.WriteString(fmt.Sprintf("%s\n", desc))
+		}
+		if params := tool.GetParameters(); params != nil {
+			schema, _ := json.Marshal(params)
+			toolsDesc.WriteString(fmt.Sprintf("Input schema: %s\n", schema))
+		}
+		toolsDesc.WriteString("\n")
+	}
+
+	return `
+You are in a sandbox VM with full permissions. You act by calling the tools below.
+
+## Tools
+
+` + toolsDesc.String() + d.Instructions(tools) + choice.constraintPrompt()
 }
 
-// 预编译正则表达式提升性能
-var (
-    vmWritePattern  = regexp.MustCompile(`(?s)<vm_write\s+path="([^"]+)">(.*?)</vm_write>`)
-    vmExecPattern   = regexp.MustCompile(`(?s)<vm_exec>(.*?)</vm_exec>`)
-    vmSearchPattern = regexp.MustCompile(`(?s)<vm_search>(.*?)</vm_search>`)
-    vmFetchPattern  = regexp.MustCompile(`(?s)<vm_fetch>(.*?)</vm_fetch>`)
-)
+// ParseSegments 按 d 的格式一次顺序解析完整响应
+// 返回的文本段和工具调用与模型写出的顺序一致，相邻文本已合并
+func ParseSegments(d Dialect, response string, tools []ToolDefinition) []StreamEvent {
+	parser := NewStreamParser(d, tools)
+	var segments []StreamEvent
+	for _, ev := range append(parser.Feed(response), parser.Flush()...) {
+		if n := len(segments); n > 0 && ev.IsText() && segments[n-1].IsText() {
+			segments[n-1].Text += ev.Text
+			continue
+		}
+		segments = append(segments, ev)
+	}
+	return segments
+}
+
+// ParseToolCalls 按 d 的格式从完整响应中解析工具调用，返回调用列表和去掉调用块后的文本
+// 只接受 tools 中存在的工具名，参数按工具的 JSON Schema 转换类型
+func ParseToolCalls(d Dialect, response string, tools []ToolDefinition) ([]ToolCall, string) {
+	if len(tools) == 0 {
+		return nil, response
+	}
+
+	var toolCalls []ToolCall
+	var cleanResponse strings.Builder
+	for _, ev := range ParseSegments(d, response, tools) {
+		if ev.ToolCall != nil {
+			toolCalls = append(toolCalls, *ev.ToolCall)
+		} else {
+			cleanResponse.WriteString(ev.Text)
+		}
+	}
+	return toolCalls, strings.TrimSpace(cleanResponse.String())
+}
+
+// newToolCall 将调用块中解析出的工具名和参数转换为工具调用（不含 ID）
+// 参数按工具的 JSON Schema 校验并修复，无法修复的问题记录在 ValidationErrors 中
+func newToolCall(tools []ToolDefinition, name string, args map[string]interface{}, parseErr error) (ToolCall, bool) {
+	tool, ok := findTool(tools, name)
+	if !ok {
+		return ToolCall{}, false
+	}
+	call := ToolCall{Type: "function", Function: ToolCallFunction{Name: tool.GetName(), Arguments: "{}"}}
+
+	if parseErr != nil {
+		call.ValidationErrors = []string{parseErr.Error()}
+		return call, true
+	}
+	if args == nil {
+		args = make(map[string]interface{})
+	}
+	fixed, errs := validateValue(tool.GetParameters(), args, "")
+	argsJSON, _ := json.Marshal(fixed)
+	call.Function.Arguments = string(argsJSON)
+	call.ValidationErrors = errs
+	return call, true
+}
+
+// parseJSONArguments 解析写成 JSON 对象的参数，空内容视为没有参数
+func parseJSONArguments(body string) (map[string]interface{}, error) {
+	args := make(map[string]interface{})
+	body = strings.TrimSpace(body)
+	if body == "" {
+		return args, nil
+	}
+	if err := json.Unmarshal([]byte(body), &args); err != nil {
+		return nil, fmt.Errorf("invalid tool arguments: %w", err)
+	}
+	return args, nil
+}
 
-// ParseToolCalls 从响应中解析工具调用
-func ParseToolCalls(response string) ([]ToolCall, string) {
-    var toolCalls []ToolCall
-    cleanResponse := response
-
-    // 检测 <vm_write path="/path">content</vm_write>
-    for i, match := range vmWritePattern.FindAllStringSubmatch(response, -1) {
-        if len(match) >= 3 {
-            args, _ := json.Marshal(map[string]string{"file_path": match[1], "content": match[2]})
-            toolCalls = append(toolCalls, ToolCall{
-                ID:       fmt.Sprintf("w%d", i),
-                Type:     "function",
-                Function: ToolCallFunction{Name: "Write", Arguments: string(args)},
-            })
-            cleanResponse = strings.Replace(cleanResponse, match[0], "", 1)
-        }
-    }
-
-    // 检测 <vm_exec>command</vm_exec>
-    for i, match := range vmExecPattern.FindAllStringSubmatch(response, -1) {
-        if len(match) >= 2 {
-            args, _ := json.Marshal(map[string]string{"command": strings.TrimSpace(match[1])})
-            toolCalls = append(toolCalls, ToolCall{
-                ID:       fmt.Sprintf("b%d", i),
-                Type:     "function",
-                Function: ToolCallFunction{Name: "Bash", Arguments: string(args)},
-            })
-            cleanResponse = strings.Replace(cleanResponse, match[0], "", 1)
-        }
-    }
-
-    // 检测 <vm_search>query</vm_search>
-    for i, match := range vmSearchPattern.FindAllStringSubmatch(response, -1) {
-        if len(match) >= 2 {
-            args, _ := json.Marshal(map[string]string{"query": strings.TrimSpace(match[1])})
-            toolCalls = append(toolCalls, ToolCall{
-                ID:       fmt.Sprintf("s%d", i),
-                Type:     "function",
-                Function: ToolCallFunction{Name: "WebSearch", Arguments: string(args)},
-            })
-            cleanResponse = strings.Replace(cleanResponse, match[0], "", 1)
-        }
-    }
-
-    // 检测 <vm_fetch>url</vm_fetch>
-    for i, match := range vmFetchPattern.FindAllStringSubmatch(response, -1) {
-        if len(match) >= 2 {
-            args, _ := json.Marshal(map[string]string{"url": strings.TrimSpace(match[1])})
-            toolCalls = append(toolCalls, ToolCall{
-                ID:       fmt.Sprintf("f%d", i),
-                Type:     "function",
-                Function: ToolCallFunction{Name: "WebFetch", Arguments: string(args)},
-            })
-            cleanResponse = strings.Replace(cleanResponse, match[0], "", 1)
-        }
-    }
-
-    return toolCalls, strings.TrimSpace(cleanResponse)
+// RepairPrompt 生成要求模型修正无效工具调用的提示
+func RepairPrompt(calls []ToolCall) string {
+	var b strings.Builder
+	b.WriteString("Some of your tool calls have arguments that do not match the tool's input schema:\n\n")
+	for _, call := range calls {
+		fmt.Fprintf(&b, "%s:\n", call.Function.Name)
+		for _, e := range call.ValidationErrors {
+			fmt.Fprintf(&b, "- %s\n", e)
+		}
+	}
+	b.WriteString("\nWrite the corrected tool calls for exactly these calls, in the same format and order, and nothing else.")
+	return b.String()
 }
 
-// HasToolCalls 检查响应是否包含工具调用
-func HasToolCalls(response string) bool {
-    // 检测虚拟机格式标签
-    return strings.Contains(response, "<vm_write") ||
-        strings.Contains(response, "<vm_exec>") ||
-        strings.Contains(response, "<vm_search>") ||
-        strings.Contains(response, "<vm_fetch>")
+// findTool 按名称查找工具，精确匹配优先，其次忽略大小写
+func findTool(tools []ToolDefinition, name string) (ToolDefinition, bool) {
+	name = strings.TrimSpace(name)
+	for _, tool := range tools {
+		if tool.GetName() == name {
+			return tool, true
+		}
+	}
+	for _, tool := range tools {
+		if strings.EqualFold(tool.GetName(), name) {
+			return tool, true
+		}
+	}
+	return ToolDefinition{}, false
 }
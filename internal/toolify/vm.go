@@ -0,0 +1,170 @@
+package toolify
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// vmDialect 虚拟机风格的标签，常用工具有专用标签，其余工具用 <vm_call>：
+//
+//	<vm_write path="/tmp/a.txt">content</vm_write>
+//	<vm_exec>ls -la</vm_exec>
+//	<vm_call name="Read">{"file_path": "/tmp/a.txt"}</vm_call>
+//
+// 历史中的调用在开始标签上带 id 属性，供模型与结果配对
+type vmDialect struct{}
+
+// vmTag 只有一个字符串参数的专用标签
+type vmTag struct {
+	tag   string
+	tool  string
+	param string
+	label string
+}
+
+var vmTags = []vmTag{
+	{tag: "vm_exec", tool: "Bash", param: "command", label: "Run commands"},
+	{tag: "vm_search", tool: "WebSearch", param: "query", label: "Web search"},
+	{tag: "vm_fetch", tool: "WebFetch", param: "url", label: "Fetch URL"},
+}
+
+var (
+	vmWritePattern = regexp.MustCompile(`(?s)^<vm_write\s+path="([^"]*)"[^>]*>(.*)</vm_write>$`)
+	vmCallPattern  = regexp.MustCompile(`(?s)^<vm_call\s+name="([^"]+)"[^>]*>(.*)</vm_call>$`)
+	vmWriteOpen    = regexp.MustCompile(`^<vm_write\s+path="([^"]*)"[^>]*>`)
+	vmCallOpen     = regexp.MustCompile(`^<vm_call\s+name="([^"]+)"[^>]*>`)
+	vmTagOpen      = regexp.MustCompile(`^<(` + vmTagNames() + `)(?:\s[^>]*)?>`)
+
+	// path 属性只转义 & 和 "，模型直接写出的路径（含反斜杠）原样保留
+	vmAttrEscaper   = strings.NewReplacer("&", "&amp;", `"`, "&quot;")
+	vmAttrUnescaper = strings.NewReplacer("&quot;", `"`, "&amp;", "&")
+)
+
+// vmTagNames 专用标签名的正则选择分支
+func vmTagNames() string {
+	names := make([]string, len(vmTags))
+	for i, t := range vmTags {
+		names[i] = t.tag
+	}
+	return strings.Join(names, "|")
+}
+
+// findVMTag 按开始标签查找专用标签，返回标签定义和开始标签的长度
+func findVMTag(block string) (vmTag, int, bool) {
+	match := vmTagOpen.FindStringSubmatch(block)
+	if match == nil {
+		return vmTag{}, 0, false
+	}
+	for _, t := range vmTags {
+		if t.tag == match[1] {
+			return t, len(match[0]), true
+		}
+	}
+	return vmTag{}, 0, false
+}
+
+func (vmDialect) Name() string { return "vm" }
+
+func (vmDialect) Instructions(tools []ToolDefinition) string {
+	var b strings.Builder
+	b.WriteString("## Calling a tool\n\n")
+	if _, ok := findTool(tools, "Write"); ok {
+		b.WriteString(`Write files: <vm_write path="/path">content</vm_write>` + "\n")
+	}
+	for _, t := range vmTags {
+		if _, ok := findTool(tools, t.tool); ok {
+			fmt.Fprintf(&b, "%s: <%s>%s</%s>\n", t.label, t.tag, t.param, t.tag)
+		}
+	}
+	b.WriteString(`Any other tool: <vm_call name="TOOL_NAME">{"PARAMETER_NAME": value}</vm_call>` + "\n\n")
+	b.WriteString(callRules("Inside <vm_call>, write the arguments as one JSON object matching the input schema. Inside the other tags, write the value as-is, without quotes or escaping."))
+	return b.String()
+}
+
+func (vmDialect) Delimiters() []Delimiter {
+	delims := []Delimiter{
+		{Open: "<vm_write ", Close: "</vm_write>"},
+		{Open: "<vm_call ", Close: "</vm_call>"},
+	}
+	for _, t := range vmTags {
+		close := "</" + t.tag + ">"
+		delims = append(delims, Delimiter{Open: "<" + t.tag + ">", Close: close}, Delimiter{Open: "<" + t.tag + " ", Close: close})
+	}
+	return delims
+}
+
+func (vmDialect) ParseBlock(block string, tools []ToolDefinition) (string, map[string]interface{}, error) {
+	if match := vmWritePattern.FindStringSubmatch(block); match != nil {
+		return "Write", map[string]interface{}{"file_path": vmAttrUnescaper.Replace(match[1]), "content": match[2]}, nil
+	}
+	if match := vmCallPattern.FindStringSubmatch(block); match != nil {
+		args, err := parseJSONArguments(match[2])
+		return match[1], args, err
+	}
+	if t, open, ok := findVMTag(block); ok {
+		close := "</" + t.tag + ">"
+		if strings.HasSuffix(block, close) && len(block) >= open+len(close) {
+			value := strings.TrimSpace(block[open : len(block)-len(close)])
+			return t.tool, map[string]interface{}{t.param: value}, nil
+		}
+	}
+	return "", nil, nil
+}
+
+// ParsePartial 开始标签写完后即可确定工具名，<vm_write> 的路径在开始标签中，<vm_call> 按 JSON 字段逐个读取
+// 专用标签的值要到结束标签才算写完
+func (vmDialect) ParsePartial(block string, tools []ToolDefinition) (string, []Argument) {
+	if match := vmWriteOpen.FindStringSubmatch(block); match != nil {
+		return "Write", []Argument{{Name: "file_path", Value: vmAttrUnescaper.Replace(match[1])}}
+	}
+	if match := vmCallOpen.FindStringSubmatch(block); match != nil {
+		return match[1], partialObject(block[len(match[0]):])
+	}
+	if t, _, ok := findVMTag(block); ok {
+		return t.tool, nil
+	}
+	return "", nil
+}
+
+// RenderCall 参数正好对应专用标签、且值能原样解析回来时使用专用标签，否则写成 <vm_call>
+func (vmDialect) RenderCall(id, name, arguments string) string {
+	var args map[string]interface{}
+	if err := json.Unmarshal([]byte(arguments), &args); err == nil {
+		if strings.EqualFold(name, "Write") && len(args) == 2 {
+			path, okPath := args["file_path"].(string)
+			content, okContent := args["content"].(string)
+			if okPath && okContent && !strings.Contains(content, "</vm_write>") {
+				return fmt.Sprintf(`<vm_write path="%s" id=%q>%s</vm_write>`, vmAttrEscaper.Replace(path), id, content)
+			}
+		}
+		for _, t := range vmTags {
+			value, ok := args[t.param].(string)
+			if !ok || !strings.EqualFold(name, t.tool) || len(args) != 1 {
+				continue
+			}
+			// 专用标签的值解析时会去掉首尾空白
+			if value == strings.TrimSpace(value) && !strings.Contains(value, "</"+t.tag+">") {
+				return fmt.Sprintf("<%s id=%q>%s</%s>", t.tag, id, value, t.tag)
+			}
+		}
+	}
+	// 重新编码一次，json.Marshal 会转义 <、>，值中不会出现 </vm_call>
+	if raw, err := json.Marshal(json.RawMessage(arguments)); err == nil {
+		arguments = string(raw)
+	}
+	return fmt.Sprintf("<vm_call name=%q id=%q>%s</vm_call>", name, id, arguments)
+}
+
+// RenderResult 渲染为 <vm_result> 块，带上与调用相同的 id 和工具名
+func (vmDialect) RenderResult(id, name, content string, isError bool) string {
+	attrs := fmt.Sprintf("id=%q", id)
+	if name != "" {
+		attrs = fmt.Sprintf("name=%q %s", name, attrs)
+	}
+	if isError {
+		attrs += ` error="true"`
+	}
+	return fmt.Sprintf("<vm_result %s>\n%s\n</vm_result>", attrs, content)
+}
@@ -0,0 +1,189 @@
+package toolify
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// xmlDialect 默认格式，每个参数写在单独的 <parameter> 标签中：
+//
+//	<tool_use name="Read">
+//	<parameter name="file_path">/tmp/a.txt</parameter>
+//	</tool_use>
+type xmlDialect struct{}
+
+// 预编译正则表达式提升性能
+var (
+	toolUsePattern   = regexp.MustCompile(`(?s)^<tool_use\s+name="([^"]+)"[^>]*>(.*?)</tool_use>$`)
+	toolUseOpen      = regexp.MustCompile(`^<tool_use\s+name="([^"]+)"[^>]*>`)
+	parameterPattern = regexp.MustCompile(`(?s)<parameter\s+name="([^"]+)"\s*>(.*?)</parameter>`)
+)
+
+func (xmlDialect) Name() string { return "xml" }
+
+func (xmlDialect) Instructions(tools []ToolDefinition) string {
+	return `## Calling a tool
+
+Write one block per call, exactly in this format:
+<tool_use name="TOOL_NAME">
+<parameter name="PARAMETER_NAME">value</parameter>
+</tool_use>
+
+Rules:
+- Only use the tool names listed above, spelled exactly.
+- Write one <parameter> per argument from the input schema. Strings are written as-is, without quotes or escaping. Numbers and booleans are written as literals, objects and arrays as JSON.
+- If a string contains "</parameter>" or "</tool_use>", wrap it in <![CDATA[...]]>.
+- You may write several blocks in one reply. They run in the order written.
+- After the last block, stop and wait. Each result comes back in a <tool_result> block carrying the id of its call.
+
+Earlier calls and their results appear in the conversation in the same format.
+`
+}
+
+func (xmlDialect) Delimiters() []Delimiter {
+	// 开始标记带空格，避免把 <tool_user> 之类的文本当成调用
+	return []Delimiter{{Open: "<tool_use ", Close: "</tool_use>"}}
+}
+
+func (xmlDialect) ParseBlock(block string, tools []ToolDefinition) (string, map[string]interface{}, error) {
+	match := toolUsePattern.FindStringSubmatch(block)
+	if match == nil {
+		return "", nil, nil
+	}
+	var schema map[string]interface{}
+	if tool, ok := findTool(tools, match[1]); ok {
+		schema = tool.GetParameters()
+	}
+	args, err := parseArguments(match[2], schema)
+	return match[1], args, err
+}
+
+// parseArguments 解析 tool_use 块内的参数
+// 优先读取 <parameter> 标签；没有标签时兼容直接写 JSON 对象的情况
+func parseArguments(body string, schema map[string]interface{}) (map[string]interface{}, error) {
+	args := make(map[string]interface{})
+
+	matches := parameterPattern.FindAllStringSubmatch(body, -1)
+	if len(matches) == 0 {
+		return parseJSONArguments(body)
+	}
+
+	for _, match := range matches {
+		name := strings.TrimSpace(match[1])
+		args[name] = parameterValue(match[2], schema, name)
+	}
+	return args, nil
+}
+
+// parameterValue 按 schema 转换 <parameter> 中的值，CDATA 中的值按字符串原样使用
+func parameterValue(raw string, schema map[string]interface{}, name string) interface{} {
+	if value, ok := decodeCDATA(raw); ok {
+		return value
+	}
+	return coerceValue(raw, propertySchema(schema, name))
+}
+
+// ParsePartial 开始标签写完后即可确定工具名，每个 </parameter> 之前的参数已经写完
+func (xmlDialect) ParsePartial(block string, tools []ToolDefinition) (string, []Argument) {
+	match := toolUseOpen.FindStringSubmatch(block)
+	if match == nil {
+		return "", nil
+	}
+	var schema map[string]interface{}
+	if tool, ok := findTool(tools, match[1]); ok {
+		schema = tool.GetParameters()
+	}
+	var args []Argument
+	for _, param := range parameterPattern.FindAllStringSubmatch(block[len(match[0]):], -1) {
+		name := strings.TrimSpace(param[1])
+		args = append(args, Argument{Name: name, Value: parameterValue(param[2], schema, name)})
+	}
+	return match[1], args
+}
+
+const (
+	cdataOpen  = "<![CDATA["
+	cdataClose = "]]>"
+)
+
+// encodeCDATA 把字符串写成一个或多个相连的 CDATA 段
+// 内容中的 "]]>" 和 "</" 被拆到两段之间，结果中不会出现结束标签，也不会提前结束 CDATA
+func encodeCDATA(s string) string {
+	s = strings.ReplaceAll(s, cdataClose, "]]"+cdataClose+cdataOpen+">")
+	s = strings.ReplaceAll(s, "</", "<"+cdataClose+cdataOpen+"/")
+	return cdataOpen + s + cdataClose
+}
+
+// decodeCDATA 解析由一个或多个相连 CDATA 段组成的值，不是这种形式时返回 false
+func decodeCDATA(s string) (string, bool) {
+	s = strings.TrimSpace(s)
+	if !strings.HasPrefix(s, cdataOpen) {
+		return "", false
+	}
+	var b strings.Builder
+	for s != "" {
+		if !strings.HasPrefix(s, cdataOpen) {
+			return "", false
+		}
+		end := strings.Index(s, cdataClose)
+		if end < 0 {
+			return "", false
+		}
+		b.WriteString(s[len(cdataOpen):end])
+		s = s[end+len(cdataClose):]
+	}
+	return b.String(), true
+}
+
+// needsCDATA 字符串原样写出后无法解析回原值时返回 true
+// 包括含有结束标签、首尾换行会被去掉，以及会被当成 JSON 字面量转换类型的情况
+func needsCDATA(s string) bool {
+	return strings.Contains(s, "</") || strings.Contains(s, cdataClose) || strings.HasPrefix(strings.TrimSpace(s), cdataOpen) ||
+		s != trimString(s) || json.Valid([]byte(strings.TrimSpace(s)))
+}
+
+// RenderCall 字符串参数原样写出（无法原样解析回来时写成 CDATA），其余类型写成 JSON
+func (xmlDialect) RenderCall(id, name, arguments string) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "<tool_use name=%q id=%q>\n", name, id)
+
+	var args map[string]interface{}
+	if err := json.Unmarshal([]byte(arguments), &args); err != nil {
+		b.WriteString(arguments)
+		b.WriteString("\n")
+	} else {
+		keys := make([]string, 0, len(args))
+		for k := range args {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			value, ok := args[k].(string)
+			if !ok {
+				// json.Marshal 会转义 <、>，值中不会出现结束标签
+				raw, _ := json.Marshal(args[k])
+				value = string(raw)
+			} else if needsCDATA(value) {
+				value = encodeCDATA(value)
+			}
+			fmt.Fprintf(&b, "<parameter name=%q>%s</parameter>\n", k, value)
+		}
+	}
+	b.WriteString("</tool_use>")
+	return b.String()
+}
+
+// RenderResult 渲染为 <tool_result> 块，通过 id 与调用配对
+func (xmlDialect) RenderResult(id, name, content string, isError bool) string {
+	attrs := fmt.Sprintf("id=%q", id)
+	if name != "" {
+		attrs = fmt.Sprintf("name=%q %s", name, attrs)
+	}
+	if isError {
+		attrs += ` error="true"`
+	}
+	return fmt.Sprintf("<tool_result %s>\n%s\n</tool_result>", attrs, content)
+}
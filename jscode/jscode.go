@@ -0,0 +1,19 @@
+// Package jscode 内嵌计算 x-is-human token 的 JS 文件，运行时不依赖工作目录下的 jscode/
+package jscode
+
+import _ "embed"
+
+// Env 浏览器环境模拟脚本
+//
+//go:embed env.js
+var Env string
+
+// Main token 计算入口模板，由 token 包替换其中的 $$...$$ 占位符
+//
+//go:embed main.js
+var Main string
+
+// Worker 常驻 node worker 入口，env.js 通过 stdin 传入
+//
+//go:embed worker.js
+var Worker string
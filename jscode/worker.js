@@ -0,0 +1,87 @@
+// 常驻 token 计算 worker
+//
+// 由 token 包通过 node -e 启动，stdin 第一行为 {"env":"<env.js 内容>"}，
+// worker 编译并在自己的 vm 上下文中执行一次 env.js 后回复 {"ready":true}，之后按行收发 JSON：
+//   请求: {"id":1,"script":"<c.js 内容>","script_url":"...","fp":{...}}
+//   响应: {"id":1,"token":"..."} 或 {"id":1,"error":"..."}
+// 任务复用同一个上下文，只替换 cursor_config 并执行 c.js；任务出错后重建上下文，避免残留状态影响之后的任务。
+const readline = require('readline');
+const vm = require('vm');
+
+let envScript = null;
+let context = null;
+
+function send(msg) {
+    process.stdout.write(JSON.stringify(msg) + '\n');
+}
+
+function createContext() {
+    const noop = function () {
+    };
+    const sandbox = {
+        console: {log: noop, info: noop, warn: noop, error: noop, debug: noop},
+        setTimeout, clearTimeout, setInterval, clearInterval, setImmediate, clearImmediate, queueMicrotask,
+        TextEncoder, TextDecoder, URL, URLSearchParams, atob, btoa, performance
+    };
+    const ctx = vm.createContext(sandbox);
+    vm.runInContext('globalThis.global = globalThis', ctx);
+    // env.js 只在访问时读取 cursor_config，每个任务开始前替换
+    ctx.cursor_config = {fp: {}};
+    envScript.runInContext(ctx);
+    vm.runInContext('dtavm = console; global.document = window.document;', ctx);
+    return ctx;
+}
+
+async function runJob(job) {
+    if (!context) {
+        context = createContext();
+    }
+    context.cursor_config = {
+        currentScriptSrc: job.script_url,
+        fp: job.fp
+    };
+    try {
+        vm.runInContext('window.V_C = undefined', context);
+        vm.runInContext(job.script, context, {filename: 'c.js'});
+        const value = await vm.runInContext('window.V_C[0]()', context);
+        return JSON.stringify(value);
+    } catch (e) {
+        context = null;
+        throw e;
+    }
+}
+
+function init(msg) {
+    try {
+        envScript = new vm.Script(msg.env, {filename: 'env.js'});
+        context = createContext();
+    } catch (e) {
+        send({error: 'load env.js: ' + String(e && e.stack || e)});
+        process.exit(1);
+    }
+    send({ready: true});
+}
+
+const rl = readline.createInterface({input: process.stdin, crlfDelay: Infinity});
+rl.on('line', async (line) => {
+    if (!line.trim()) {
+        return;
+    }
+    let msg;
+    try {
+        msg = JSON.parse(line);
+    } catch (e) {
+        send({id: 0, error: 'invalid job: ' + e.message});
+        return;
+    }
+    if (!envScript) {
+        init(msg);
+        return;
+    }
+    try {
+        send({id: msg.id, token: await runJob(msg)});
+    } catch (e) {
+        send({id: msg.id, error: String(e && e.stack || e)});
+    }
+});
+rl.on('close', () => process.exit(0));